@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
@@ -12,9 +13,11 @@ import (
 	"path/filepath"
 	"strings"
 
+	"github.com/TobiasYin/go-lsp/logs"
 	"github.com/tmc/langchaingo/llms"
 	"github.com/tmc/langchaingo/llms/ollama"
 	"github.com/tmc/langchaingo/schema"
+	"lspserver/lspserver"
 )
 
 // Config holds the configuration for the LLM model
@@ -81,8 +84,19 @@ func GetDiffs() (string, error) {
 func main() {
 	// Define and parse flags
 	method := flag.String("method", "full", "Analysis method: full or diff")
+	baselineFile := flag.String("baseline", lspserver.DefaultBaselineFile, "baseline of accepted findings")
+	updateBaseline := flag.Bool("update-baseline", false, "regenerate the baseline from the current findings instead of reporting")
 	flag.Parse()
 
+	// The diagnostics parser logs through go-lsp
+	logs.Init(log.New(io.Discard, "", 0))
+
+	baseline, err := lspserver.LoadBaseline(*baselineFile)
+	if err != nil {
+		log.Fatalf("Error loading baseline: %v", err)
+	}
+	newBaseline := &lspserver.Baseline{}
+
 	// Determine the directory of the binary
 	binaryDir, err := filepath.Abs(filepath.Dir(os.Args[0]))
 	if err != nil {
@@ -114,8 +128,8 @@ func main() {
 
 	// Handling the full or diff analysis
 	if *method == "full" {
-		
-		files, err := filepath.Glob("*.c") 
+
+		files, err := filepath.Glob("*.c")
 		if err != nil {
 			log.Fatalf("Error listing files: %v", err)
 		}
@@ -135,7 +149,43 @@ func main() {
 				log.Fatalf("Error analyzing code: %v", err)
 			}
 
-			report[file] = strings.TrimSpace(response)
+			response = strings.TrimSpace(response)
+			diagnostics, err := lspserver.DiagnosticsUnmarshal(file, response)
+			if err != nil {
+				if *updateBaseline {
+					// Don't drop the accepted findings of a file the model failed on
+					log.Printf("Keeping the baseline of %s, the response can't be parsed: %v", file, err)
+					newBaseline.Replace(file, baseline.Entries(file))
+					continue
+				}
+				// Keep unparsable responses as they are
+				report[file] = response
+				continue
+			}
+
+			if *updateBaseline {
+				newBaseline.Replace(file, lspserver.BaselineEntries(file, string(code), diagnostics))
+				continue
+			}
+
+			// Only report findings that are not in the baseline
+			fresh := baseline.Filter(file, string(code), diagnostics)
+			if fresh == nil {
+				fresh = []lspserver.LspDiagnostic{}
+			}
+			findings, err := lspserver.JSONStringify(fresh)
+			if err != nil {
+				log.Fatalf("Error marshaling findings: %v", err)
+			}
+			report[file] = findings
+		}
+
+		if *updateBaseline {
+			if err := newBaseline.Save(*baselineFile); err != nil {
+				log.Fatalf("Error writing baseline: %v", err)
+			}
+			fmt.Printf("Baseline with %d findings saved to %s\n", len(newBaseline.Findings), *baselineFile)
+			return
 		}
 	} else if *method == "diff" {
 		// Get the diffs from the repository
@@ -0,0 +1,332 @@
+package lspserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/TobiasYin/go-lsp/logs"
+)
+
+// analyzerFilePlaceholder in -analyzer is replaced with the document path,
+// without it the path is appended to the command.
+const analyzerFilePlaceholder = "{file}"
+
+// triageContextLines of code around a finding are sent to the backend.
+const triageContextLines = 5
+
+// cppcheck --xml (version 2) output
+type cppcheckResults struct {
+	Errors []cppcheckError `xml:"errors>error"`
+}
+
+type cppcheckError struct {
+	ID        string             `xml:"id,attr"`
+	Severity  string             `xml:"severity,attr"`
+	Msg       string             `xml:"msg,attr"`
+	Verbose   string             `xml:"verbose,attr"`
+	Locations []cppcheckLocation `xml:"location"`
+}
+
+type cppcheckLocation struct {
+	File   string `xml:"file,attr"`
+	Line   int    `xml:"line,attr"`
+	Column int    `xml:"column,attr"`
+}
+
+// The parts of SARIF 2.1.0 the findings are built from
+type sarifLog struct {
+	Runs []struct {
+		Tool struct {
+			Driver struct {
+				Name string `json:"name"`
+			} `json:"driver"`
+		} `json:"tool"`
+		Results []struct {
+			RuleID  string `json:"ruleId"`
+			Level   string `json:"level"`
+			Message struct {
+				Text string `json:"text"`
+			} `json:"message"`
+			Locations []struct {
+				PhysicalLocation struct {
+					ArtifactLocation struct {
+						URI string `json:"uri"`
+					} `json:"artifactLocation"`
+					Region struct {
+						StartLine   int `json:"startLine"`
+						StartColumn int `json:"startColumn"`
+						EndLine     int `json:"endLine"`
+						EndColumn   int `json:"endColumn"`
+					} `json:"region"`
+				} `json:"physicalLocation"`
+			} `json:"locations"`
+		} `json:"results"`
+	} `json:"runs"`
+}
+
+// clang and clang-tidy: file:line:column: warning: message [check-name]
+var clangDiagnosticRe = regexp.MustCompile(`(?m)^(.+?):(\d+):(\d+): (warning|error): (.*?)(?: \[([^\]]+)\])?\r?$`)
+
+/*
+ * RunAnalyzer runs the configured analyzer on a file. A non-zero exit status
+ * is not an error as long as the analyzer printed something, most analyzers
+ * exit with 1 when they found issues.
+ * @param command The analyzer command line, e.g. "cppcheck --xml {file}"
+ * @param file The file to analyse
+ * @return output The combined stdout and stderr of the analyzer
+ * @return error Any error that occurred while running it
+ */
+func RunAnalyzer(command string, file string) ([]byte, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil, errors.New("empty analyzer command")
+	}
+	replaced := false
+	for i := range args {
+		if strings.Contains(args[i], analyzerFilePlaceholder) {
+			args[i] = strings.ReplaceAll(args[i], analyzerFilePlaceholder, file)
+			replaced = true
+		}
+	}
+	if !replaced {
+		args = append(args, file)
+	}
+
+	logs.Printf("[+] Running analyzer: %v", args)
+	output, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+	var exitErr *exec.ExitError
+	if err != nil && !(errors.As(err, &exitErr) && len(output) > 0) {
+		return nil, fmt.Errorf("analyzer %s: %w", args[0], err)
+	}
+	return output, nil
+}
+
+/*
+ * ParseAnalyzerOutput turns analyzer output into diagnostics. cppcheck XML,
+ * SARIF and the clang/clang-tidy text format are recognised. The Uri of each
+ * diagnostic is the file name as reported by the analyzer and Source is the
+ * tool, so the provenance survives triage.
+ * @param output The analyzer output or report file content
+ * @return diagnostics The findings
+ * @return error Any error that occurred while decoding
+ */
+func ParseAnalyzerOutput(output []byte) ([]LspDiagnostic, error) {
+	if start := bytes.Index(output, []byte("<results")); start != -1 {
+		return parseCppcheckXML(output[start:])
+	}
+	if start := bytes.IndexByte(output, '{'); start != -1 && bytes.Contains(output, []byte(`"runs"`)) {
+		return parseSarif(output[start:])
+	}
+	return parseClangText(output), nil
+}
+
+func parseCppcheckXML(data []byte) ([]LspDiagnostic, error) {
+	var results cppcheckResults
+	if err := xml.Unmarshal(data, &results); err != nil {
+		return nil, fmt.Errorf("cppcheck xml: %w", err)
+	}
+
+	var diagnostics []LspDiagnostic
+	for _, e := range results.Errors {
+		// findings without a location are about the configuration
+		if len(e.Locations) == 0 {
+			continue
+		}
+		loc := e.Locations[0]
+		description := e.Verbose
+		if description == "" {
+			description = e.Msg
+		}
+		d := LspDiagnostic{
+			Uri:         loc.File,
+			LineNumber:  loc.Line,
+			Source:      "cppcheck",
+			Rule:        e.ID,
+			Severity:    analyzerSeverity(e.Severity),
+			Description: description,
+		}
+		if loc.Column > 0 {
+			d.Column, d.EndLine, d.EndColumn = loc.Column-1, loc.Line, loc.Column
+		}
+		diagnostics = append(diagnostics, d)
+	}
+	return diagnostics, nil
+}
+
+func parseSarif(data []byte) ([]LspDiagnostic, error) {
+	var log sarifLog
+	if err := json.NewDecoder(bytes.NewReader(data)).Decode(&log); err != nil {
+		return nil, fmt.Errorf("sarif: %w", err)
+	}
+
+	var diagnostics []LspDiagnostic
+	for _, run := range log.Runs {
+		tool := run.Tool.Driver.Name
+		for _, result := range run.Results {
+			if len(result.Locations) == 0 {
+				continue
+			}
+			loc := result.Locations[0].PhysicalLocation
+			region := loc.Region
+			d := LspDiagnostic{
+				Uri:         loc.ArtifactLocation.URI,
+				LineNumber:  region.StartLine,
+				Source:      tool,
+				Rule:        result.RuleID,
+				Severity:    analyzerSeverity(result.Level),
+				Description: result.Message.Text,
+			}
+			if region.StartColumn > 0 {
+				d.Column, d.EndLine, d.EndColumn = region.StartColumn-1, region.StartLine, region.StartColumn
+				if region.EndLine > 0 {
+					d.EndLine = region.EndLine
+				}
+				if region.EndColumn > 0 {
+					d.EndColumn = region.EndColumn - 1
+				}
+			}
+			diagnostics = append(diagnostics, d)
+		}
+	}
+	return diagnostics, nil
+}
+
+func parseClangText(output []byte) []LspDiagnostic {
+	var diagnostics []LspDiagnostic
+	for _, m := range clangDiagnosticRe.FindAllStringSubmatch(string(output), -1) {
+		line, _ := strconv.Atoi(m[2])
+		column, _ := strconv.Atoi(m[3])
+		source := "clang"
+		if m[6] != "" && !strings.HasPrefix(m[6], "-W") {
+			source = "clang-tidy"
+		}
+		diagnostics = append(diagnostics, LspDiagnostic{
+			Uri:         m[1],
+			LineNumber:  line,
+			Column:      column - 1,
+			EndLine:     line,
+			EndColumn:   column,
+			Source:      source,
+			Rule:        m[6],
+			Severity:    analyzerSeverity(m[4]),
+			Description: m[5],
+		})
+	}
+	return diagnostics
+}
+
+// analyzerSeverity maps cppcheck severities and SARIF levels to LSP names.
+func analyzerSeverity(severity string) string {
+	switch strings.ToLower(severity) {
+	case "error":
+		return "error"
+	case "warning", "":
+		// warning is also the SARIF default level
+		return "warning"
+	case "none":
+		return "hint"
+	}
+	// cppcheck style, performance, portability, information and SARIF note
+	return "information"
+}
+
+/*
+ * AnalyzerFindingsFor picks the findings that belong to one document and
+ * points them at its URI. Relative file names in the report are matched
+ * against the end of the document path.
+ * @param diagnostics The findings of a whole report
+ * @param uri The document URI
+ * @param path The document path
+ * @return diagnostics The findings of the document
+ */
+func AnalyzerFindingsFor(diagnostics []LspDiagnostic, uri string, path string) []LspDiagnostic {
+	path = filepath.ToSlash(filepath.Clean(path))
+
+	var matched []LspDiagnostic
+	for _, d := range diagnostics {
+		file := d.Uri
+		if strings.HasPrefix(file, "file://") {
+			if p, err := ConvertFileURIToPath(file); err == nil {
+				file = p
+			}
+		}
+		file = filepath.ToSlash(filepath.Clean(file))
+		if file != path && !strings.HasSuffix(path, "/"+file) {
+			continue
+		}
+		d.Uri = uri
+		matched = append(matched, d)
+	}
+	return matched
+}
+
+// TriageVerdict is the backend's answer for one analyzer finding.
+type TriageVerdict struct {
+	Verdict        string `json:"verdict"`
+	Explanation    string `json:"explanation"`
+	Recommendation string `json:"recommendation"`
+}
+
+var triageObjectRe = regexp.MustCompile(`(?s)\{.*\}`)
+
+// triageKey identifies the verdict of a model on a finding by its rule and
+// the content of its line, it stays valid while lines are added or removed
+// above it.
+func triageKey(model string, uri string, lines []string, finding LspDiagnostic) string {
+	return uri + "\x00" + model + "\x00" + finding.Rule + "\x00" + lineContent(lines, finding.LineNumber)
+}
+
+// ParseTriage extracts the JSON verdict from a backend response.
+func ParseTriage(response string) (TriageVerdict, error) {
+	var verdict TriageVerdict
+	match := triageObjectRe.FindString(response)
+	if match == "" {
+		return verdict, errors.New("no JSON object in triage response")
+	}
+	if err := json.Unmarshal([]byte(match), &verdict); err != nil {
+		return verdict, err
+	}
+	verdict.Verdict = strings.ToLower(strings.TrimSpace(verdict.Verdict))
+	return verdict, nil
+}
+
+// Dismissed reports whether the backend considers the finding a false
+// positive.
+func (v TriageVerdict) Dismissed() bool {
+	switch v.Verdict {
+	case "dismiss", "dismissed", "false positive", "false_positive":
+		return true
+	}
+	return false
+}
+
+// FindingPromptText is the finding as inserted into the triage prompt
+// ({{.Finding}}).
+func FindingPromptText(d LspDiagnostic) string {
+	return fmt.Sprintf("%s %s (%s) on line %d: %s", d.Source, d.Rule, d.Severity, d.LineNumber, d.Description)
+}
+
+// codeAround returns the lines around a 1-based line and the range it covers.
+func codeAround(text string, line int, context int) (string, int, int) {
+	lines := strings.Split(text, "\n")
+	start := line - context
+	if start < 1 {
+		start = 1
+	}
+	end := line + context
+	if end > len(lines) {
+		end = len(lines)
+	}
+	if start > end {
+		return "", line, line
+	}
+	return strings.Join(lines[start-1:end], "\n"), start, end
+}
@@ -0,0 +1,219 @@
+package lspserver
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+)
+
+func TestParseAnalyzerOutput(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   []LspDiagnostic
+		err    bool
+	}{
+		{
+			name: "cppcheck xml",
+			output: `Checking a.c ...
+<?xml version="1.0" encoding="UTF-8"?>
+<results version="2">
+    <cppcheck version="2.13"/>
+    <errors>
+        <error id="nullPointer" severity="error" msg="Null pointer" verbose="Null pointer dereference: p">
+            <location file="src/a.c" line="4" column="6"/>
+            <location file="src/a.c" line="2" column="1"/>
+        </error>
+        <error id="unusedVariable" severity="style" msg="Unused variable: x">
+            <location file="src/a.c" line="7"/>
+        </error>
+        <error id="missingInclude" severity="information" msg="Include not found"/>
+    </errors>
+</results>`,
+			want: []LspDiagnostic{
+				{Uri: "src/a.c", LineNumber: 4, Column: 5, EndLine: 4, EndColumn: 6, Source: "cppcheck", Rule: "nullPointer", Severity: "error", Description: "Null pointer dereference: p"},
+				{Uri: "src/a.c", LineNumber: 7, Source: "cppcheck", Rule: "unusedVariable", Severity: "information", Description: "Unused variable: x"},
+			},
+		},
+		{
+			name:   "cppcheck invalid xml",
+			output: `<results version="2"><errors><error id="x">`,
+			err:    true,
+		},
+		{
+			name: "sarif",
+			output: `{"version": "2.1.0", "runs": [{"tool": {"driver": {"name": "clang-tidy"}}, "results": [
+				{"ruleId": "bugprone-branch-clone", "level": "warning", "message": {"text": "repeated branch"},
+				 "locations": [{"physicalLocation": {"artifactLocation": {"uri": "file:///src/a.c"}, "region": {"startLine": 3, "startColumn": 5, "endLine": 4, "endColumn": 9}}}]},
+				{"ruleId": "note-rule", "level": "note", "message": {"text": "a note"},
+				 "locations": [{"physicalLocation": {"artifactLocation": {"uri": "b.c"}, "region": {"startLine": 9}}}]},
+				{"ruleId": "no-location", "message": {"text": "dropped"}}
+			]}]}`,
+			want: []LspDiagnostic{
+				{Uri: "file:///src/a.c", LineNumber: 3, Column: 4, EndLine: 4, EndColumn: 8, Source: "clang-tidy", Rule: "bugprone-branch-clone", Severity: "warning", Description: "repeated branch"},
+				{Uri: "b.c", LineNumber: 9, Source: "clang-tidy", Rule: "note-rule", Severity: "information", Description: "a note"},
+			},
+		},
+		{
+			name:   "sarif invalid json",
+			output: `{"runs": [}`,
+			err:    true,
+		},
+		{
+			name: "clang text",
+			output: "In file included from a.c:1:\r\n" +
+				"a.c:5:10: warning: unused variable 'x' [-Wunused-variable]\r\n" +
+				"a.c:8:3: error: use of undeclared identifier 'y'\n" +
+				"a.c:9:1: warning: function is too complex [readability-function-size]\n" +
+				"a.c:9:1: note: declared here\n",
+			want: []LspDiagnostic{
+				{Uri: "a.c", LineNumber: 5, Column: 9, EndLine: 5, EndColumn: 10, Source: "clang", Rule: "-Wunused-variable", Severity: "warning", Description: "unused variable 'x'"},
+				{Uri: "a.c", LineNumber: 8, Column: 2, EndLine: 8, EndColumn: 3, Source: "clang", Severity: "error", Description: "use of undeclared identifier 'y'"},
+				{Uri: "a.c", LineNumber: 9, Column: 0, EndLine: 9, EndColumn: 1, Source: "clang-tidy", Rule: "readability-function-size", Severity: "warning", Description: "function is too complex"},
+			},
+		},
+		{
+			name:   "nothing found",
+			output: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseAnalyzerOutput([]byte(tt.output))
+			if (err != nil) != tt.err {
+				t.Fatalf("error = %v, want error %v", err, tt.err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d findings %+v, want %d", len(got), got, len(tt.want))
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("finding %d = %+v, want %+v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestAnalyzerFindingsFor(t *testing.T) {
+	const uri = "file:///work/src/a.c"
+	findings := []LspDiagnostic{
+		{Uri: "/work/src/a.c", Rule: "absolute"},
+		{Uri: "src/a.c", Rule: "relative"},
+		{Uri: "file:///work/src/a.c", Rule: "uri"},
+		{Uri: "./src/./a.c", Rule: "unclean"},
+		{Uri: "b/src/a.c", Rule: "other directory"},
+		{Uri: "ba.c", Rule: "other file"},
+	}
+	got := AnalyzerFindingsFor(findings, uri, "/work/src/a.c")
+	want := []string{"absolute", "relative", "uri", "unclean"}
+	if len(got) != len(want) {
+		t.Fatalf("got %+v, want the rules %v", got, want)
+	}
+	for i, d := range got {
+		if d.Rule != want[i] || d.Uri != uri {
+			t.Errorf("finding %d = %s %s, want %s %s", i, d.Rule, d.Uri, want[i], uri)
+		}
+	}
+}
+
+func TestParseTriage(t *testing.T) {
+	tests := []struct {
+		response  string
+		verdict   string
+		dismissed bool
+		err       bool
+	}{
+		{`{"verdict": "confirmed", "explanation": "", "recommendation": ""}`, "confirmed", false, false},
+		{`{"verdict": "Confirm"}`, "confirm", false, false},
+		{`{"verdict": "dismiss"}`, "dismiss", true, false},
+		{`{"verdict": " Dismissed "}`, "dismissed", true, false},
+		{`{"verdict": "False Positive"}`, "false positive", true, false},
+		{`{"verdict": "FALSE_POSITIVE"}`, "false_positive", true, false},
+		{`{"verdict": "unsure"}`, "unsure", false, false},
+		{"The verdict:\n```json\n{\"verdict\": \"dismiss\",\n \"explanation\": \"checked above\"}\n```", "dismiss", true, false},
+		{`no verdict`, "", false, true},
+		{`{"verdict": }`, "", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.response, func(t *testing.T) {
+			v, err := ParseTriage(tt.response)
+			if (err != nil) != tt.err {
+				t.Fatalf("error = %v, want error %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			if v.Verdict != tt.verdict || v.Dismissed() != tt.dismissed {
+				t.Errorf("verdict %q dismissed %v, want %q %v", v.Verdict, v.Dismissed(), tt.verdict, tt.dismissed)
+			}
+		})
+	}
+}
+
+// triageBackend dismisses the findings of the rule "fp" and counts the
+// triage requests.
+type triageBackend struct {
+	LspBackend
+	asked int32
+	fail  bool
+}
+
+func (b *triageBackend) TriageFinding(ctx context.Context, uri string, profile *LanguageProfile, standard string, code string, startLine int, finding LspDiagnostic) (string, error) {
+	atomic.AddInt32(&b.asked, 1)
+	if b.fail {
+		return "", errors.New("no model")
+	}
+	if finding.Rule == "fp" {
+		return `{"verdict": "dismiss", "explanation": "not reachable"}`, nil
+	}
+	return `{"verdict": "confirmed", "explanation": "p may be NULL.", "recommendation": "Check p."}`, nil
+}
+
+func TestTriageFindings(t *testing.T) {
+	const uri = "file:///src/a.c"
+	text := "int *p;\nint x = *p;\nint y;\n"
+	findings := []LspDiagnostic{
+		{Uri: uri, LineNumber: 2, Rule: "nullPointer", Source: "cppcheck"},
+		{Uri: uri, LineNumber: 3, Rule: "fp", Source: "cppcheck"},
+	}
+	l := newTestServer(t)
+	backend := &triageBackend{LspBackend: l.backend}
+	l.backend = backend
+	state := newSessionState()
+	ctx := context.Background()
+
+	kept := l.triageFindings(ctx, state, uri, text, findings)
+	if len(kept) != 1 || kept[0].Rule != "nullPointer" || kept[0].Recommendation != "p may be NULL. Check p." {
+		t.Fatalf("kept %+v, want nullPointer with the recommendation", kept)
+	}
+	if n := atomic.LoadInt32(&backend.asked); n != 2 {
+		t.Fatalf("asked %d times, want 2", n)
+	}
+
+	// Verdicts are cached by the content of the line, not its number
+	moved := []LspDiagnostic{findings[0], findings[1]}
+	moved[0].LineNumber, moved[1].LineNumber = 3, 4
+	kept = l.triageFindings(ctx, state, uri, "\n"+text, moved)
+	if len(kept) != 1 || atomic.LoadInt32(&backend.asked) != 2 {
+		t.Errorf("kept %d findings after %d requests, want 1 after 2", len(kept), atomic.LoadInt32(&backend.asked))
+	}
+
+	// A changed line, another model or another document is asked again
+	l.triageFindings(ctx, state, uri, "int *p;\nint x = p[0];\nint y;\n", findings[:1])
+	state.setModel("model-x")
+	l.triageFindings(ctx, state, uri, text, findings[:1])
+	l.triageFindings(ctx, state, "file:///src/b.c", text, findings[:1])
+	if n := atomic.LoadInt32(&backend.asked); n != 5 {
+		t.Errorf("asked %d times, want 5", n)
+	}
+
+	// Findings are kept as reported, and not cached, when the backend fails
+	backend.fail = true
+	kept = l.triageFindings(ctx, state, uri, "int z;\n"+text, []LspDiagnostic{{Uri: uri, LineNumber: 1, Rule: "fp"}})
+	kept = l.triageFindings(ctx, state, uri, "int z;\n"+text, kept)
+	if len(kept) != 1 || kept[0].Recommendation != "" || atomic.LoadInt32(&backend.asked) != 7 {
+		t.Errorf("kept %+v after %d requests, want the finding after 7", kept, atomic.LoadInt32(&backend.asked))
+	}
+}
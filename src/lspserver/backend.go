@@ -1,15 +1,84 @@
 package lspserver
 
+import "context"
+
 var ParamBackend *string
 var ParamPromptFile *string
 var ParamConnectTest *bool
 var ParamRetryPromptFile *string
+var ParamPromptDir *string
+var ParamRulePacks *string
+var ParamPolicyFile *string
+var ParamDeviationRegister *string
+var ParamBaselineFile *string
+var ParamProfilesFile *string
+var ParamAnalyzerCommand *string
+var ParamAnalyzerOutput *string
+var ParamAnalyzerNoTriage *bool
+var ParamExplainComments *bool
+var ParamVerifyFixes *string
+var ParamListen *string
+var ParamWebSocketOrigins *string
+var ParamWebSocketToken *string
+var ParamTraceFile *string
+
 /* Backend agnostic methods */
 type LspBackend interface {
 	Start() error
-	AnalyseDocument(string, string) (string, error)
-	CompleteCode(string, string, string) ([]string, error)
-	GenerateCode(string, string, string, string) (string, error)
-	RefactorCodeLine(line string) (string, error)
-	ExplainCodeIssue(line string) (string, error)
+	AnalyseDocument(ctx context.Context, uri string, document string, profile *LanguageProfile, rules []Rule, progress AnalysisProgress) (string, error)
+	CompleteCode(ctx context.Context, uri string, profile *LanguageProfile, standard string, prefix string) ([]string, error)
+	GenerateCode(ctx context.Context, uri string, profile *LanguageProfile, standard string, prefix string, suffix string) (string, error)
+	RefactorCode(ctx context.Context, uri string, profile *LanguageProfile, standard string, code string, startLine int, findings []LspDiagnostic) (string, error)
+	ExplainFinding(ctx context.Context, uri string, profile *LanguageProfile, standard string, code string, startLine int, finding LspDiagnostic, rule string) (string, error)
+	TriageFinding(ctx context.Context, uri string, profile *LanguageProfile, standard string, code string, startLine int, finding LspDiagnostic) (string, error)
+	FixFindings(ctx context.Context, uri string, profile *LanguageProfile, standard string, code string, startLine int, findings []LspDiagnostic, rules string) (string, error)
+	Stop()
+}
+
+/*
+ * backendLifetime ends the requests of a backend when the server stops.
+ * Backends embed it and derive the context of every request from it.
+ */
+type backendLifetime struct {
+	ctx  context.Context
+	stop context.CancelFunc
+}
+
+func newBackendLifetime() backendLifetime {
+	ctx, stop := context.WithCancel(context.Background())
+	return backendLifetime{ctx: ctx, stop: stop}
+}
+
+// Stop cancels the requests in flight, later requests fail at once.
+func (b *backendLifetime) Stop() {
+	b.stop()
+}
+
+// withLifetime returns a context cancelled with ctx or by Stop.
+func (b *backendLifetime) withLifetime(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(b.ctx, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
+
+type modelKey struct{}
+
+// WithModel makes the backend requests made with ctx use model instead of
+// the backend's default model, so sessions can select models of their own.
+func WithModel(ctx context.Context, model string) context.Context {
+	if model == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, modelKey{}, model)
+}
+
+// modelFor returns the model selected with WithModel, or the default.
+func modelFor(ctx context.Context, defaultModel string) string {
+	if model, ok := ctx.Value(modelKey{}).(string); ok {
+		return model
+	}
+	return defaultModel
 }
@@ -0,0 +1,75 @@
+package lspserver
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/TobiasYin/go-lsp/logs"
+)
+
+/*
+ * lspBackendMock answers without a model, the same way every time. It lets
+ * the server run without Ollama or OpenAI, e.g. to replay a trace: analyses
+ * find nothing beyond the built-in checks, fixes don't change the code and
+ * explanations name the finding.
+ */
+type lspBackendMock struct {
+	backendLifetime
+}
+
+func NewMockBackend() LspBackend {
+	return &lspBackendMock{backendLifetime: newBackendLifetime()}
+}
+
+func (b *lspBackendMock) Start() error {
+	logs.Printf("Mock LSP Backend starting...")
+	return nil
+}
+
+func (b *lspBackendMock) AnalyseDocument(ctx context.Context, uri string, document string, profile *LanguageProfile, rules []Rule, progress AnalysisProgress) (string, error) {
+	ctx, cancel := b.withLifetime(ctx)
+	defer cancel()
+	chunks := ChunkDocument(document, profile)
+	var responseBuilder strings.Builder
+	total := len(rules) * len(chunks)
+	for r, rule := range rules {
+		for i := range chunks {
+			if err := ctx.Err(); err != nil {
+				return "", err
+			}
+			if progress != nil {
+				progress(r*len(chunks)+i, total, rule, i+1, len(chunks))
+			}
+			responseBuilder.WriteString("[]\n")
+		}
+	}
+	if responseBuilder.Len() == 0 {
+		return "[]", nil
+	}
+	return responseBuilder.String(), nil
+}
+
+func (b *lspBackendMock) GenerateCode(ctx context.Context, uri string, profile *LanguageProfile, standard string, prefix string, suffix string) (string, error) {
+	return "", nil
+}
+
+func (b *lspBackendMock) CompleteCode(ctx context.Context, uri string, profile *LanguageProfile, standard string, prefix string) ([]string, error) {
+	return nil, nil
+}
+
+func (b *lspBackendMock) RefactorCode(ctx context.Context, uri string, profile *LanguageProfile, standard string, code string, startLine int, findings []LspDiagnostic) (string, error) {
+	return "```\n" + code + "\n```", nil
+}
+
+func (b *lspBackendMock) ExplainFinding(ctx context.Context, uri string, profile *LanguageProfile, standard string, code string, startLine int, finding LspDiagnostic, rule string) (string, error) {
+	return fmt.Sprintf("%s on line %d: %s", finding.Rule, finding.LineNumber, finding.Description), nil
+}
+
+func (b *lspBackendMock) TriageFinding(ctx context.Context, uri string, profile *LanguageProfile, standard string, code string, startLine int, finding LspDiagnostic) (string, error) {
+	return `{"verdict": "confirmed", "explanation": "", "recommendation": ""}`, nil
+}
+
+func (b *lspBackendMock) FixFindings(ctx context.Context, uri string, profile *LanguageProfile, standard string, code string, startLine int, findings []LspDiagnostic, rules string) (string, error) {
+	return "```\n" + code + "\n```", nil
+}
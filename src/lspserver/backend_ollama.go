@@ -2,12 +2,8 @@ package lspserver
 
 import (
 	"context"
-	"fmt"
 	"math"
-	"os"
-	"runtime"
 	"strings"
-	"sync"
 
 	"github.com/TobiasYin/go-lsp/logs"
 	"github.com/tmc/langchaingo/llms"
@@ -15,9 +11,12 @@ import (
 	"github.com/tmc/langchaingo/schema"
 )
 
-/* backend specific private data */
+/*
+ * backend specific private data. The client and prompts are set by Start
+ * and only read afterwards, so the requests of all sessions run
+ * concurrently, each with its own context.
+ */
 type lspBackendOllama struct {
-	mutex            sync.Mutex
 	client           *ollama.Chat
 	connected        bool
 	modelName        string
@@ -25,18 +24,18 @@ type lspBackendOllama struct {
 	modelMaxTokens   int
 	modelTemperature float64
 	systemPromptFile string
-	systemPrompt     string
-	cancel           context.CancelFunc
+	prompts          *PromptTemplates
+	backendLifetime
 }
 
 func NewOllamaBackend() LspBackend {
 	return &lspBackendOllama{
-		mutex:            sync.Mutex{},
 		connected:        false,
 		modelName:        "deepseek-coder",
 		modelMaxTokens:   4096,
 		modelTemperature: math.SmallestNonzeroFloat64,
 		modelSeed:        42,
+		backendLifetime:  newBackendLifetime(),
 	}
 }
 
@@ -54,7 +53,6 @@ func (b *lspBackendOllama) Start() error {
 
 func (b *lspBackendOllama) connect() error {
 	var err error
-	var systemPrompt []byte
 
 	b.client, err = ollama.NewChat(ollama.WithLLMOptions(ollama.WithModel(b.modelName)))
 	logs.Printf("Ollama New Chat....\n")
@@ -62,26 +60,29 @@ func (b *lspBackendOllama) connect() error {
 		return err
 	}
 
-	systemPrompt, err = LoadPrompt(*ParamPromptFile)
-	logs.Printf("Prompts Loaded....\n%s", systemPrompt)
+	b.prompts, err = LoadPromptTemplates(*ParamPromptFile, *ParamPromptDir)
+	logs.Printf("Prompts Loaded....\n%s", *ParamPromptFile)
 	if err != nil {
 		return err
 	}
 
 	b.systemPromptFile = *ParamPromptFile
-	b.systemPrompt = string(systemPrompt)
 
 	return nil
 }
 
-func (b *lspBackendOllama) request(ctx context.Context, query string) (string, error) {
-	logs.Printf("System Prompt: %s\nQuery: %s\n", b.systemPrompt, query)
+func (b *lspBackendOllama) request(ctx context.Context, vars PromptVars) (string, error) {
+	systemPrompt, query, err := b.prompts.RenderPair(PromptAnalyseSystem, PromptAnalyseUser, vars)
+	if err != nil {
+		return "", err
+	}
+	logs.Printf("System Prompt: %s\nQuery: %s\n", systemPrompt, query)
 	completion, err := b.client.Call(ctx, []schema.ChatMessage{
-		schema.SystemChatMessage{Content: b.systemPrompt},
+		schema.SystemChatMessage{Content: systemPrompt},
 		schema.HumanChatMessage{Content: query},
 	},
 		llms.WithTemperature(b.modelTemperature),
-		llms.WithModel(b.modelName),
+		llms.WithModel(modelFor(ctx, b.modelName)),
 		llms.WithMaxTokens(b.modelMaxTokens),
 		llms.WithSeed(b.modelSeed),
 	)
@@ -94,112 +95,59 @@ func (b *lspBackendOllama) request(ctx context.Context, query string) (string, e
 	return completion.Content, nil
 }
 
-// preprocessDocument splits the document into chunks of 50 lines each with correct line numbers
-func preprocessDocument(document string) []string {
-	var lines []string
-	retryPrompt, err := os.ReadFile(*ParamRetryPromptFile)
-	if err != nil {
-		logs.Printf("Unable to read the retry prompt file")
-	}
-
-	// Check if the document starts with the retry prompt
-	if strings.HasPrefix(document, string(retryPrompt)) {
-		// Remove the retry prompt from the start of the document
-		document = strings.TrimPrefix(document, string(retryPrompt))
-	}
-
-	// Determine the newline character based on the OS
-	switch runtime.GOOS {
-	case "windows":
-		lines = strings.Split(document, "\r\n")
-	case "darwin":
-		lines = strings.Split(document, "\n")
-	default:
-		lines = strings.Split(document, "\n")
-	}
-
-	chunkSize := 30
-	var chunks []string
-	for i := 0; i < len(lines); i += chunkSize {
-		end := i + chunkSize
-		if end > len(lines) {
-			end = len(lines)
-		}
-		var chunk strings.Builder
-		for j := i; j < end; j++ {
-			chunk.WriteString(fmt.Sprintf("Line %d: %s\n", j+1, lines[j]))
-		}
-		chunks = append(chunks, chunk.String())
-	}
-
-	return chunks
-}
-
-func (b *lspBackendOllama) AnalyseDocument(uri string, document string) (string, error) {
+func (b *lspBackendOllama) AnalyseDocument(ctx context.Context, uri string, document string, profile *LanguageProfile, rules []Rule, progress AnalysisProgress) (string, error) {
 	logs.Printf("Analyse Document: %s\n%s", uri, document)
 
-	b.mutex.Lock()
-	defer b.mutex.Unlock()
-
-	// Cancel any previous request
-	if b.cancel != nil {
-		b.cancel()
-	}
-
-	ctx, cancel := context.WithCancel(context.Background())
-	b.cancel = cancel
+	ctx, cancel := b.withLifetime(ctx)
+	defer cancel()
 
 	logs.Printf("Document Input: %s", document)
 
-	chunks := preprocessDocument(document)
+	chunks := ChunkDocument(document, profile)
 	logs.Printf("Preprocessed Document into %d chunks", len(chunks))
 
-	var err error
-	PrevMod := b.modelName
-	if strings.HasSuffix(uri, ".py") {
-		b.modelName = "deepseek-coder"
-	} else {
-		b.modelName = "deepseek-coder"
-	}
-
-	if PrevMod != b.modelName {
-		b.client, err = ollama.NewChat(ollama.WithLLMOptions(ollama.WithModel(b.modelName)))
-		logs.Printf("Ollama New Chat....\n")
-		if err != nil {
-			return "", err
-		}
-	}
-	
 	var responseBuilder strings.Builder
-	for i, chunk := range chunks {
-		query := fmt.Sprintf("FileName: %s\nSource Code (Chunk %d):\n%s", uri, i+1, chunk)
-		response, err := b.request(ctx, query)
-		if err != nil {
-			return "", err
+	total := len(rules) * len(chunks)
+	for r, rule := range rules {
+		for i, chunk := range chunks {
+			if progress != nil {
+				progress(r*len(chunks)+i, total, rule, i+1, len(chunks))
+			}
+			vars := PromptVars{
+				FileName:   uri,
+				Language:   profile.LanguageID,
+				Standard:   rule.Standard,
+				Rule:       rule.PromptText(),
+				RuleID:     rule.ID,
+				ChunkIndex: i + 1,
+				StartLine:  chunk.StartLine,
+				EndLine:    chunk.EndLine,
+				Code:       chunk.Text,
+			}
+			response, err := b.request(ctx, vars)
+			if err != nil {
+				return "", err
+			}
+			responseBuilder.WriteString(TagRuleResponse(uri, response, rule))
+			responseBuilder.WriteString("\n")
+			logs.Printf("[+] Response for chunk %d with rule %s: %s", i+1, rule.ID, response)
 		}
-		responseBuilder.WriteString(response)
-		responseBuilder.WriteString("\n")
-		logs.Printf("[+] Response for chunk %d: %s", i+1, response)
 	}
 
 	return responseBuilder.String(), nil
 }
 
-func (b *lspBackendOllama) GenerateCode(uri string, prefix string, suffix string, systemPrompt string) (string, error) {
-	logs.Printf("OnGenerate: %s \n %s \n %s", systemPrompt, prefix, suffix)
-	b.mutex.Lock()
-	defer b.mutex.Unlock()
-	
-	// Cancel any previous request
-	if b.cancel != nil {
-		b.cancel()
-	}
+func (b *lspBackendOllama) GenerateCode(ctx context.Context, uri string, profile *LanguageProfile, standard string, prefix string, suffix string) (string, error) {
+	logs.Printf("OnGenerate: %s \n %s", prefix, suffix)
+	ctx, cancel := b.withLifetime(ctx)
+	defer cancel()
 
-	ctx, cancel := context.WithCancel(context.Background())
-	b.cancel = cancel
-
-	query := fmt.Sprintf("Complete the code following this prefix:\n%s<generate></generate>%s", prefix, suffix)
-	response, err := b.requestWithPrompt(ctx, query, systemPrompt) // Use custom prompt
+	vars := PromptVars{FileName: uri, Language: profile.LanguageID, Standard: standard, Prefix: prefix, Suffix: suffix}
+	systemPrompt, query, err := b.prompts.RenderPair(PromptGenerateSystem, PromptGenerateUser, vars)
+	if err != nil {
+		return "", err
+	}
+	response, err := b.requestWithPrompt(ctx, query, systemPrompt)
 	if err != nil {
 		return "", err
 	}
@@ -207,22 +155,18 @@ func (b *lspBackendOllama) GenerateCode(uri string, prefix string, suffix string
 	return response, nil
 }
 
-// Implement CompleteCode method for code completion with custom systemPrompt
-func (b *lspBackendOllama) CompleteCode(uri string, prefix string, systemPrompt string) ([]string, error) {
+// Implement CompleteCode method for code completion
+func (b *lspBackendOllama) CompleteCode(ctx context.Context, uri string, profile *LanguageProfile, standard string, prefix string) ([]string, error) {
 	logs.Printf("OnCompletion: %s", uri)
-	b.mutex.Lock()
-	defer b.mutex.Unlock()
+	ctx, cancel := b.withLifetime(ctx)
+	defer cancel()
 
-	// Cancel any previous request
-	if b.cancel != nil {
-		b.cancel()
+	vars := PromptVars{FileName: uri, Language: profile.LanguageID, Standard: standard, Prefix: prefix}
+	systemPrompt, query, err := b.prompts.RenderPair(PromptCompleteSystem, PromptCompleteUser, vars)
+	if err != nil {
+		return nil, err
 	}
-
-	ctx, cancel := context.WithCancel(context.Background())
-	b.cancel = cancel
-
-	query := fmt.Sprintf("Complete the code following this prefix:\n%s<PROVIDE_SUGGESTION_HERE>", prefix)
-	response, err := b.requestWithPrompt(ctx, query, systemPrompt) // Use custom prompt
+	response, err := b.requestWithPrompt(ctx, query, systemPrompt)
 	if err != nil {
 		return nil, err
 	}
@@ -231,22 +175,25 @@ func (b *lspBackendOllama) CompleteCode(uri string, prefix string, systemPrompt
 	return completions, nil
 }
 
-func (b *lspBackendOllama) RefactorCodeLine(line string) (string, error) {
-	logs.Printf("OnRefactorCodeLine: %s", line)
-	b.mutex.Lock()
-	defer b.mutex.Unlock()
-
-	// Cancel any previous request
-	if b.cancel != nil {
-		b.cancel()
+func (b *lspBackendOllama) RefactorCode(ctx context.Context, uri string, profile *LanguageProfile, standard string, code string, startLine int, findings []LspDiagnostic) (string, error) {
+	logs.Printf("OnRefactorCode: %s:%d", uri, startLine)
+	ctx, cancel := b.withLifetime(ctx)
+	defer cancel()
+
+	// Render the prompts for refactoring the code and its findings
+	vars := PromptVars{
+		FileName:  uri,
+		Language:  profile.LanguageID,
+		Standard:  standard,
+		StartLine: startLine,
+		EndLine:   startLine + strings.Count(code, "\n"),
+		Code:      code,
+		Finding:   FindingsPromptText(findings),
+	}
+	systemPrompt, query, err := b.prompts.RenderPair(PromptRefactorSystem, PromptRefactorUser, vars)
+	if err != nil {
+		return "", err
 	}
-
-	ctx, cancel := context.WithCancel(context.Background())
-	b.cancel = cancel
-
-	// Construct the query for refactoring the code line
-	query := fmt.Sprintf("Refactor the following line of code to improve its logic or structure:\n%s", line)
-	systemPrompt := "You are a coding assistant that helps refactor code to improve clarity, performance, and maintainability."
 
 	// Make the LLM request
 	response, err := b.requestWithPrompt(ctx, query, systemPrompt)
@@ -257,30 +204,76 @@ func (b *lspBackendOllama) RefactorCodeLine(line string) (string, error) {
 	return response, nil
 }
 
-func (b *lspBackendOllama) ExplainCodeIssue(line string) (string, error) {
-	logs.Printf("OnExplainCodeIssue: %s", line)
-	// b.mutex.Lock()
-	// defer b.mutex.Unlock()
+func (b *lspBackendOllama) ExplainFinding(ctx context.Context, uri string, profile *LanguageProfile, standard string, code string, startLine int, finding LspDiagnostic, rule string) (string, error) {
+	logs.Printf("OnExplainFinding: %s %s:%d", finding.Rule, uri, finding.LineNumber)
+	ctx, cancel := b.withLifetime(ctx)
+	defer cancel()
+
+	// Render the prompts for explaining the finding
+	vars := PromptVars{
+		FileName:  uri,
+		Language:  profile.LanguageID,
+		Standard:  standard,
+		Rule:      rule,
+		RuleID:    finding.Rule,
+		StartLine: startLine,
+		EndLine:   startLine + strings.Count(code, "\n"),
+		Code:      code,
+		Finding:   FindingPromptText(finding),
+	}
+	systemPrompt, query, err := b.prompts.RenderPair(PromptExplainSystem, PromptExplainUser, vars)
+	if err != nil {
+		return "", err
+	}
 
-	// // Cancel any previous request
-	// if b.cancel != nil {
-	// 	b.cancel()
-	// }
+	return b.requestWithPrompt(ctx, query, systemPrompt)
+}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	b.cancel = cancel
+func (b *lspBackendOllama) TriageFinding(ctx context.Context, uri string, profile *LanguageProfile, standard string, code string, startLine int, finding LspDiagnostic) (string, error) {
+	logs.Printf("OnTriageFinding: %s %s:%d", finding.Rule, uri, finding.LineNumber)
+	ctx, cancel := b.withLifetime(ctx)
+	defer cancel()
+
+	vars := PromptVars{
+		FileName:  uri,
+		Language:  profile.LanguageID,
+		Standard:  standard,
+		RuleID:    finding.Rule,
+		StartLine: startLine,
+		EndLine:   startLine + strings.Count(code, "\n"),
+		Code:      code,
+		Finding:   FindingPromptText(finding),
+	}
+	systemPrompt, query, err := b.prompts.RenderPair(PromptTriageSystem, PromptTriageUser, vars)
+	if err != nil {
+		return "", err
+	}
 
-	// Construct the query for explaining the issue with the code line
-	query := fmt.Sprintf("Explain potential issues or improvements for the following line of code:\n%s", line)
-	systemPrompt := "You are a coding assistant that identifies issues in code and provides clear explanations."
+	return b.requestWithPrompt(ctx, query, systemPrompt)
+}
 
-	// Make the LLM request
-	response, err := b.requestWithPrompt(ctx, query, systemPrompt)
+func (b *lspBackendOllama) FixFindings(ctx context.Context, uri string, profile *LanguageProfile, standard string, code string, startLine int, findings []LspDiagnostic, rules string) (string, error) {
+	logs.Printf("OnFixFindings: %d findings %s:%d", len(findings), uri, startLine)
+	ctx, cancel := b.withLifetime(ctx)
+	defer cancel()
+
+	vars := PromptVars{
+		FileName:  uri,
+		Language:  profile.LanguageID,
+		Standard:  standard,
+		Rule:      rules,
+		RuleID:    FindingRuleIDs(findings),
+		StartLine: startLine,
+		EndLine:   startLine + strings.Count(code, "\n"),
+		Code:      code,
+		Finding:   FindingsPromptText(findings),
+	}
+	systemPrompt, query, err := b.prompts.RenderPair(PromptFixSystem, PromptFixUser, vars)
 	if err != nil {
 		return "", err
 	}
 
-	return response, nil
+	return b.requestWithPrompt(ctx, query, systemPrompt)
 }
 
 // Updated request method to allow custom system prompts
@@ -291,7 +284,7 @@ func (b *lspBackendOllama) requestWithPrompt(ctx context.Context, query string,
 		schema.HumanChatMessage{Content: query},
 	},
 		llms.WithTemperature(b.modelTemperature),
-		llms.WithModel(b.modelName),
+		llms.WithModel(modelFor(ctx, b.modelName)),
 		llms.WithMaxTokens(b.modelMaxTokens),
 		llms.WithSeed(b.modelSeed),
 	)
@@ -303,4 +296,3 @@ func (b *lspBackendOllama) requestWithPrompt(ctx context.Context, query string,
 	logs.Printf(completion.Content)
 	return completion.Content, nil
 }
-
@@ -3,11 +3,9 @@ package lspserver
 import (
 	"context"
 	"errors"
-	"fmt"
 	"math"
 	"os"
 	"strings"
-	"sync"
 
 	"github.com/TobiasYin/go-lsp/logs"
 	"github.com/tmc/langchaingo/llms"
@@ -15,9 +13,12 @@ import (
 	"github.com/tmc/langchaingo/schema"
 )
 
-/* backend specific private data */
+/*
+ * backend specific private data. The client and prompts are set by Start
+ * and only read afterwards, so the requests of all sessions run
+ * concurrently, each with its own context.
+ */
 type lspBackendOpenAi struct {
-	mutex            sync.Mutex
 	client           *openai.Chat
 	connected        bool
 	modelName        string
@@ -25,49 +26,18 @@ type lspBackendOpenAi struct {
 	modelMaxTokens   int
 	modelTemperature float64
 	systemPromptFile string
-	systemPrompt     string
-}
-
-var misraRules = []string{
-	"Code MUST follow MISRA C Coding Guidelines.",
-	"Use 4 spaces for indentation; do not use tabs.",
-	"Aim for a maximum line length of 76 columns.",
-	"Place the `*` directly next to the variable name for pointers (e.g., `int *ptr`).",
-	"Align variable names where possible and match the style of surrounding code.",
-	"Enclose the statement forming the body of control structures (`if`, `else if`, `else`, `while`, `do ... while`, `for`) in braces.",
-	"An `if (expression)` construct must be followed by a compound statement; `else` must be followed by a compound statement or another `if` statement.",
-	"Terminate all `if ... else if` constructs with an `else` clause.",
-	"A pointer resulting from arithmetic on a pointer operand must address an element of the same array as that pointer operand.",
-	"Do not use the `sizeof` operator on function parameters declared as \"array of type\".",
-	"Do not use the Standard Library function `system` from `<stdlib.h>`.",
-	"Follow alignment (`<stdalign.h>`) and no-return functions (`<stdnoreturn.h>`) rules.",
-	"Do not use type generic expressions (`_Generic`).",
-	"Avoid using obsolescent language features.",
-	"Declare all variables at the beginning of a block.",
-	"Avoid using global variables; prefer static variables.",
-	"Use only approved control structures; avoid `goto` statements.",
-	"Ensure all loops have a fixed upper limit.",
-	"Keep functions short and focused on a single task.",
-	"Use function prototypes and limit the number of parameters.",
-	"Use only standard MISRA-compliant data types.",
-	"Avoid dynamic memory allocation (`malloc`, `calloc`, `free`).",
-	"Use consistent comment styles:\n  - Single-line: `/* Comment */`\n  - Multi-line:\n    ```\n    /*\n     * Multi-line comment\n     * continues here.\n     */\n    ```",
-	"Describe the intent, not the action; use full sentences, correct grammar, and spelling. Avoid non-obvious abbreviations.",
-	"Use K&R style for bracing; always brace even single-line statements.",
-	"Use a single exit point in functions, using `goto` for error handling.",
-	"Wrap non-trivial macros in `do {...} while (0)`.",
-	"Avoid magic numbers; use enumerations or constants.",
-	"Define bitfield widths for `BOOL`, enums, and flags to ensure proper alignment.",
+	prompts          *PromptTemplates
+	backendLifetime
 }
 
 func NewOpenAiBackend() LspBackend {
 	return &lspBackendOpenAi{
-		mutex:            sync.Mutex{},
 		connected:        false,
 		modelName:        "gpt-4-1106-preview",
 		modelMaxTokens:   4096,
 		modelTemperature: math.SmallestNonzeroFloat64,
 		modelSeed:        42,
+		backendLifetime:  newBackendLifetime(),
 	}
 }
 
@@ -85,7 +55,6 @@ func (b *lspBackendOpenAi) Start() error {
 
 func (b *lspBackendOpenAi) connect() error {
 	var err error
-	var systemPrompt []byte
 
 	if os.Getenv("OPENAI_API_KEY") == "" {
 		return errors.New("OPENAI_API_KEY not set")
@@ -96,15 +65,14 @@ func (b *lspBackendOpenAi) connect() error {
 		return err
 	}
 
-	systemPrompt, err = LoadPrompt(*ParamPromptFile)
+	b.prompts, err = LoadPromptTemplates(*ParamPromptFile, *ParamPromptDir)
 	if err != nil {
 		return err
 	}
 
 	b.systemPromptFile = *ParamPromptFile
-	b.systemPrompt = string(systemPrompt)
 	if *ParamConnectTest {
-		response, err := b.request("int main() { return 0; }", "")
+		response, err := b.request(context.Background(), PromptVars{FileName: "connect-test.c", Language: "c", Standard: defaultStandard, ChunkIndex: 1, Code: "int main() { return 0; }"})
 		if err != nil {
 			return err
 		}
@@ -113,17 +81,18 @@ func (b *lspBackendOpenAi) connect() error {
 	return nil
 }
 
-func (b *lspBackendOpenAi) request(query string, rule string) (string, error) {
-	ctx := context.Background()
-
-	prompt := fmt.Sprintf("%s\nRule: %s", b.systemPrompt, rule)
+func (b *lspBackendOpenAi) request(ctx context.Context, vars PromptVars) (string, error) {
+	prompt, query, err := b.prompts.RenderPair(PromptAnalyseSystem, PromptAnalyseUser, vars)
+	if err != nil {
+		return "", err
+	}
 
 	completion, err := b.client.Call(ctx, []schema.ChatMessage{
 		schema.SystemChatMessage{Content: prompt},
 		schema.HumanChatMessage{Content: query},
 	},
 		llms.WithTemperature(b.modelTemperature),
-		llms.WithModel(b.modelName),
+		llms.WithModel(modelFor(ctx, b.modelName)),
 		llms.WithMaxTokens(b.modelMaxTokens),
 		llms.WithSeed(b.modelSeed),
 	)
@@ -136,75 +105,57 @@ func (b *lspBackendOpenAi) request(query string, rule string) (string, error) {
 	return completion.Content, nil
 }
 
-// preprocessDocument2 splits the document into chunks of 30 lines each with correct line numbers
-func preprocessDocument2(document string) []string {
-	var lines []string
-	retryPrompt, err := os.ReadFile(*ParamRetryPromptFile)
-	if err != nil {
-		logs.Printf("Unable to read the retry prompt file")
-	}
-	// Check if the document starts with the retry prompt
-	if strings.HasPrefix(document, string(retryPrompt)) {
-		// Remove the retry prompt from the start of the document
-		document = strings.TrimPrefix(document, string(retryPrompt))
-	}
-
-	// Split the document into lines
-	lines = strings.Split(document, "\n")
-
-	chunkSize := 30
-	var chunks []string
-	for i := 0; i < len(lines); i += chunkSize {
-		end := i + chunkSize
-		if end > len(lines) {
-			end = len(lines)
-		}
-		var chunk strings.Builder
-		for j := i; j < end; j++ {
-			chunk.WriteString(fmt.Sprintf("Line %d: %s\n", j+1, lines[j]))
-		}
-		chunks = append(chunks, chunk.String())
-	}
-
-	return chunks
-}
-
-func (b *lspBackendOpenAi) AnalyseDocument(uri string, document string) (string, error) {
+func (b *lspBackendOpenAi) AnalyseDocument(ctx context.Context, uri string, document string, profile *LanguageProfile, rules []Rule, progress AnalysisProgress) (string, error) {
 	logs.Printf("AnalyseDocument: %s", document)
 
-	b.mutex.Lock()
-	defer b.mutex.Unlock()
+	ctx, cancel := b.withLifetime(ctx)
+	defer cancel()
 
 	logs.Printf("Document Input: %s", document)
 
-	chunks := preprocessDocument2(document)
+	chunks := ChunkDocument(document, profile)
 	logs.Printf("Preprocessed Document into %d chunks", len(chunks))
 
 	var responseBuilder strings.Builder
-	for _, rule := range misraRules {
+	total := len(rules) * len(chunks)
+	for r, rule := range rules {
 		for i, chunk := range chunks {
-			query := fmt.Sprintf("FileName: %s\nSource Code (Chunk %d):\n%s", uri, i+1, chunk)
-			response, err := b.request(query, rule)
+			if progress != nil {
+				progress(r*len(chunks)+i, total, rule, i+1, len(chunks))
+			}
+			vars := PromptVars{
+				FileName:   uri,
+				Language:   profile.LanguageID,
+				Standard:   rule.Standard,
+				Rule:       rule.PromptText(),
+				RuleID:     rule.ID,
+				ChunkIndex: i + 1,
+				StartLine:  chunk.StartLine,
+				EndLine:    chunk.EndLine,
+				Code:       chunk.Text,
+			}
+			response, err := b.request(ctx, vars)
 			if err != nil {
 				return "", err
 			}
-			responseBuilder.WriteString(response)
+			responseBuilder.WriteString(TagRuleResponse(uri, response, rule))
 			responseBuilder.WriteString("\n")
-			logs.Printf("[+] Response for chunk %d with rule %s: %s", i+1, rule, response)
+			logs.Printf("[+] Response for chunk %d with rule %s: %s", i+1, rule.ID, response)
 		}
 	}
 
 	return responseBuilder.String(), nil
 }
 
-func (b *lspBackendOpenAi) GenerateCode(uri string, prefix string, suffix string, systemPrompt string) (string, error) {
-	logs.Printf("OnGenerate: %s \n %s \n %s", systemPrompt, prefix, suffix)
+func (b *lspBackendOpenAi) GenerateCode(ctx context.Context, uri string, profile *LanguageProfile, standard string, prefix string, suffix string) (string, error) {
+	logs.Printf("OnGenerate: %s \n %s", prefix, suffix)
 
-	b.mutex.Lock()
-	defer b.mutex.Unlock()
-
-	query := fmt.Sprintf("Complete the code following this prefix:\n%s<generate></generate>%s", prefix, suffix)
-	response, err := b.requestWithPrompt(query, systemPrompt)
+	vars := PromptVars{FileName: uri, Language: profile.LanguageID, Standard: standard, Prefix: prefix, Suffix: suffix}
+	systemPrompt, query, err := b.prompts.RenderPair(PromptGenerateSystem, PromptGenerateUser, vars)
+	if err != nil {
+		return "", err
+	}
+	response, err := b.requestWithPrompt(ctx, query, systemPrompt)
 	if err != nil {
 		return "", err
 	}
@@ -214,34 +165,44 @@ func (b *lspBackendOpenAi) GenerateCode(uri string, prefix string, suffix string
 }
 
 // OnCompletion processes the completion request
-func (b *lspBackendOpenAi) CompleteCode(uri string, query string, systemPrompt string) ([]string, error) {
-	logs.Printf("OnCompletion: %s", query)
-
-	b.mutex.Lock()
-	defer b.mutex.Unlock()
+func (b *lspBackendOpenAi) CompleteCode(ctx context.Context, uri string, profile *LanguageProfile, standard string, prefix string) ([]string, error) {
+	logs.Printf("OnCompletion: %s", prefix)
 
-	response, err := b.requestWithPrompt(query, systemPrompt)
+	vars := PromptVars{FileName: uri, Language: profile.LanguageID, Standard: standard, Prefix: prefix}
+	systemPrompt, query, err := b.prompts.RenderPair(PromptCompleteSystem, PromptCompleteUser, vars)
 	if err != nil {
 		return nil, err
 	}
-	
+	response, err := b.requestWithPrompt(ctx, query, systemPrompt)
+	if err != nil {
+		return nil, err
+	}
+
 	logs.Printf("[+] Completion Response: %s", response)
 	completions := strings.Split(response, "\n")
 	return completions, nil
 }
 
-func (b *lspBackendOpenAi) RefactorCodeLine(line string) (string, error) {
-	logs.Printf("OnRefactorCodeLine: %s", line)
-
-	b.mutex.Lock()
-	defer b.mutex.Unlock()
-
-	// Construct the query for refactoring the code line
-	query := fmt.Sprintf("Refactor the following line of code to improve its logic or structure:\n%s", line)
-	systemPrompt := "You are a coding assistant that helps refactor code to improve clarity, performance, and maintainability."
+func (b *lspBackendOpenAi) RefactorCode(ctx context.Context, uri string, profile *LanguageProfile, standard string, code string, startLine int, findings []LspDiagnostic) (string, error) {
+	logs.Printf("OnRefactorCode: %s:%d", uri, startLine)
+
+	// Render the prompts for refactoring the code and its findings
+	vars := PromptVars{
+		FileName:  uri,
+		Language:  profile.LanguageID,
+		Standard:  standard,
+		StartLine: startLine,
+		EndLine:   startLine + strings.Count(code, "\n"),
+		Code:      code,
+		Finding:   FindingsPromptText(findings),
+	}
+	systemPrompt, query, err := b.prompts.RenderPair(PromptRefactorSystem, PromptRefactorUser, vars)
+	if err != nil {
+		return "", err
+	}
 
 	// Make the request to OpenAI
-	response, err := b.requestWithPrompt(query, systemPrompt)
+	response, err := b.requestWithPrompt(ctx, query, systemPrompt)
 	if err != nil {
 		return "", err
 	}
@@ -250,28 +211,86 @@ func (b *lspBackendOpenAi) RefactorCodeLine(line string) (string, error) {
 	return response, nil
 }
 
-func (b *lspBackendOpenAi) ExplainCodeIssue(line string) (string, error) {
-	logs.Printf("OnExplainCodeIssue: %s", line)
+func (b *lspBackendOpenAi) ExplainFinding(ctx context.Context, uri string, profile *LanguageProfile, standard string, code string, startLine int, finding LspDiagnostic, rule string) (string, error) {
+	logs.Printf("OnExplainFinding: %s %s:%d", finding.Rule, uri, finding.LineNumber)
+	// Render the prompts for explaining the finding
+	vars := PromptVars{
+		FileName:  uri,
+		Language:  profile.LanguageID,
+		Standard:  standard,
+		Rule:      rule,
+		RuleID:    finding.Rule,
+		StartLine: startLine,
+		EndLine:   startLine + strings.Count(code, "\n"),
+		Code:      code,
+		Finding:   FindingPromptText(finding),
+	}
+	systemPrompt, query, err := b.prompts.RenderPair(PromptExplainSystem, PromptExplainUser, vars)
+	if err != nil {
+		return "", err
+	}
+
+	return b.requestWithPrompt(ctx, query, systemPrompt)
+}
+
+func (b *lspBackendOpenAi) TriageFinding(ctx context.Context, uri string, profile *LanguageProfile, standard string, code string, startLine int, finding LspDiagnostic) (string, error) {
+	logs.Printf("OnTriageFinding: %s %s:%d", finding.Rule, uri, finding.LineNumber)
+
+	vars := PromptVars{
+		FileName:  uri,
+		Language:  profile.LanguageID,
+		Standard:  standard,
+		RuleID:    finding.Rule,
+		StartLine: startLine,
+		EndLine:   startLine + strings.Count(code, "\n"),
+		Code:      code,
+		Finding:   FindingPromptText(finding),
+	}
+	systemPrompt, query, err := b.prompts.RenderPair(PromptTriageSystem, PromptTriageUser, vars)
+	if err != nil {
+		return "", err
+	}
+
+	response, err := b.requestWithPrompt(ctx, query, systemPrompt)
+	if err != nil {
+		return "", err
+	}
 
-	// b.mutex.Lock()
-	// defer b.mutex.Unlock()
+	logs.Printf("[+] Triage Response: %s", response)
+	return response, nil
+}
 
-	// Construct the query for explaining the issue with the code line
-	query := fmt.Sprintf("Explain potential issues or improvements for the following line of code:\n%s", line)
-	systemPrompt := "You are a coding assistant that identifies issues in code and provides clear explanations."
+func (b *lspBackendOpenAi) FixFindings(ctx context.Context, uri string, profile *LanguageProfile, standard string, code string, startLine int, findings []LspDiagnostic, rules string) (string, error) {
+	logs.Printf("OnFixFindings: %d findings %s:%d", len(findings), uri, startLine)
+
+	vars := PromptVars{
+		FileName:  uri,
+		Language:  profile.LanguageID,
+		Standard:  standard,
+		Rule:      rules,
+		RuleID:    FindingRuleIDs(findings),
+		StartLine: startLine,
+		EndLine:   startLine + strings.Count(code, "\n"),
+		Code:      code,
+		Finding:   FindingsPromptText(findings),
+	}
+	systemPrompt, query, err := b.prompts.RenderPair(PromptFixSystem, PromptFixUser, vars)
+	if err != nil {
+		return "", err
+	}
 
-	// Make the request to OpenAI
-	response, err := b.requestWithPrompt(query, systemPrompt)
+	response, err := b.requestWithPrompt(ctx, query, systemPrompt)
 	if err != nil {
 		return "", err
 	}
 
-	logs.Printf("[+] Issue Explanation Response: %s", response)
+	logs.Printf("[+] Fix Response: %s", response)
 	return response, nil
 }
 
-func (b *lspBackendOpenAi) requestWithPrompt(query string, systemPrompt string) (string, error) {
-	ctx := context.Background()
+func (b *lspBackendOpenAi) requestWithPrompt(ctx context.Context, query string, systemPrompt string) (string, error) {
+	ctx, cancel := b.withLifetime(ctx)
+	defer cancel()
 	logs.Printf("Completion/Generation System Prompt: %s\nQuery: %s\n", systemPrompt, query)
 
 	completion, err := b.client.Call(ctx, []schema.ChatMessage{
@@ -279,7 +298,7 @@ func (b *lspBackendOpenAi) requestWithPrompt(query string, systemPrompt string)
 		schema.HumanChatMessage{Content: query},
 	},
 		llms.WithTemperature(b.modelTemperature),
-		llms.WithModel(b.modelName),
+		llms.WithModel(modelFor(ctx, b.modelName)),
 		llms.WithMaxTokens(b.modelMaxTokens),
 		llms.WithSeed(b.modelSeed),
 	)
@@ -289,4 +308,4 @@ func (b *lspBackendOpenAi) requestWithPrompt(query string, systemPrompt string)
 
 	logs.Printf(completion.Content)
 	return completion.Content, nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,182 @@
+package lspserver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// DefaultBaselineFile is looked up below the workspace root.
+const DefaultBaselineFile = ".fuzzlsp/baseline.json"
+
+const baselineVersion = 1
+
+// BaselineEntry is an accepted legacy finding. Fingerprint hashes the rule,
+// the normalized content of the flagged line and the enclosing function, so
+// entries survive code moving up or down in the file.
+type BaselineEntry struct {
+	Fingerprint string `json:"fingerprint"`
+	File        string `json:"file"`
+	Rule        string `json:"rule"`
+	Function    string `json:"function,omitempty"`
+	Line        int    `json:"line"`
+	Description string `json:"description,omitempty"`
+}
+
+type Baseline struct {
+	Version  int             `json:"version"`
+	Findings []BaselineEntry `json:"findings"`
+}
+
+/*
+ * LoadBaseline reads a baseline file. A missing file is not an error and
+ * results in a nil baseline which hides nothing.
+ * @param fileName The baseline file
+ * @return baseline The baseline or nil
+ * @return error Any error that occurred while reading or decoding
+ */
+func LoadBaseline(fileName string) (*Baseline, error) {
+	data, err := os.ReadFile(fileName)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	baseline := &Baseline{}
+	if err := json.Unmarshal(data, baseline); err != nil {
+		return nil, err
+	}
+	return baseline, nil
+}
+
+// Save writes the baseline sorted by file, line and rule so the committed
+// file diffs cleanly.
+func (b *Baseline) Save(fileName string) error {
+	sort.SliceStable(b.Findings, func(i, j int) bool {
+		x, y := b.Findings[i], b.Findings[j]
+		if x.File != y.File {
+			return x.File < y.File
+		}
+		if x.Line != y.Line {
+			return x.Line < y.Line
+		}
+		return x.Rule < y.Rule
+	})
+	b.Version = baselineVersion
+
+	data, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(fileName), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(fileName, append(data, '\n'), 0644)
+}
+
+/*
+ * BaselineEntries fingerprints the diagnostics of one file.
+ * @param file The file name as stored in the baseline (relative to the root)
+ * @param text The file content the diagnostics refer to
+ * @param diagnostics The diagnostics to fingerprint
+ * @return entries One entry per diagnostic
+ */
+func BaselineEntries(file string, text string, diagnostics []LspDiagnostic) []BaselineEntry {
+	lines := strings.Split(text, "\n")
+	functions := FindFunctions(text)
+
+	var entries []BaselineEntry
+	for _, d := range diagnostics {
+		function, _ := FunctionAt(functions, d.LineNumber)
+		entries = append(entries, BaselineEntry{
+			Fingerprint: fingerprint(d.Rule, lineContent(lines, d.LineNumber), function.Name),
+			File:        filepath.ToSlash(file),
+			Rule:        d.Rule,
+			Function:    function.Name,
+			Line:        d.LineNumber,
+			Description: d.Description,
+		})
+	}
+	return entries
+}
+
+/*
+ * Filter hides the diagnostics of a file that are in the baseline. Each
+ * baseline entry hides at most one finding, so a second identical finding
+ * added to the same function is still reported.
+ * @param file The file name as stored in the baseline
+ * @param text The file content the diagnostics refer to
+ * @param diagnostics The diagnostics to filter
+ * @return diagnostics The new diagnostics
+ */
+func (b *Baseline) Filter(file string, text string, diagnostics []LspDiagnostic) []LspDiagnostic {
+	if b == nil || len(diagnostics) == 0 {
+		return diagnostics
+	}
+
+	file = filepath.ToSlash(file)
+	known := make(map[string]int)
+	for _, entry := range b.Findings {
+		if entry.File == file {
+			known[entry.Fingerprint]++
+		}
+	}
+
+	var fresh []LspDiagnostic
+	for i, entry := range BaselineEntries(file, text, diagnostics) {
+		if known[entry.Fingerprint] > 0 {
+			known[entry.Fingerprint]--
+			continue
+		}
+		fresh = append(fresh, diagnostics[i])
+	}
+	return fresh
+}
+
+// Entries returns the entries of a file, none for a nil baseline.
+func (b *Baseline) Entries(file string) []BaselineEntry {
+	if b == nil {
+		return nil
+	}
+	file = filepath.ToSlash(file)
+	var entries []BaselineEntry
+	for _, entry := range b.Findings {
+		if entry.File == file {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// Replace drops the entries of a file and adds the new ones.
+func (b *Baseline) Replace(file string, entries []BaselineEntry) {
+	file = filepath.ToSlash(file)
+	var kept []BaselineEntry
+	for _, entry := range b.Findings {
+		if entry.File != file {
+			kept = append(kept, entry)
+		}
+	}
+	b.Findings = append(kept, entries...)
+}
+
+func fingerprint(rule string, content string, function string) string {
+	sum := sha256.Sum256([]byte(rule + "\x00" + content + "\x00" + function))
+	return hex.EncodeToString(sum[:12])
+}
+
+// lineContent returns the 1-based line with all whitespace collapsed.
+func lineContent(lines []string, line int) string {
+	if line < 1 || line > len(lines) {
+		return ""
+	}
+	return strings.Join(strings.Fields(lines[line-1]), " ")
+}
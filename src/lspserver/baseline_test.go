@@ -0,0 +1,77 @@
+package lspserver
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestBaselineFingerprint(t *testing.T) {
+	const original = "int f(void)\n{\n    return g();\n}\n"
+	finding := LspDiagnostic{Rule: "MISRA-17.7", LineNumber: 3}
+	want := BaselineEntries("a.c", original, []LspDiagnostic{finding})[0]
+	if want.Function != "f" {
+		t.Fatalf("function = %q, want f", want.Function)
+	}
+
+	tests := []struct {
+		name string
+		text string
+		line int
+		rule string
+		same bool
+	}{
+		{"unchanged", original, 3, "MISRA-17.7", true},
+		{"moved down", "/* header */\n\nint f(void)\n{\n    return g();\n}\n", 5, "MISRA-17.7", true},
+		{"whitespace changed", "int f(void)\n{\n\treturn   g();\n}\n", 3, "MISRA-17.7", true},
+		{"line changed", "int f(void)\n{\n    return h();\n}\n", 3, "MISRA-17.7", false},
+		{"other function", "int k(void)\n{\n    return g();\n}\n", 3, "MISRA-17.7", false},
+		{"other rule", original, 3, "MISRA-15.5", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entry := BaselineEntries("a.c", tt.text, []LspDiagnostic{{Rule: tt.rule, LineNumber: tt.line}})[0]
+			if same := entry.Fingerprint == want.Fingerprint; same != tt.same {
+				t.Errorf("fingerprint %s, original %s, same = %v, want %v", entry.Fingerprint, want.Fingerprint, same, tt.same)
+			}
+		})
+	}
+}
+
+func TestBaselineFilter(t *testing.T) {
+	const text = "void f(void)\n{\n    free(p);\n    free(p);\n}\n"
+	first := LspDiagnostic{Rule: "MISRA-21.3", LineNumber: 3}
+	second := LspDiagnostic{Rule: "MISRA-21.3", LineNumber: 4}
+
+	baseline := &Baseline{}
+	baseline.Replace("src/a.c", BaselineEntries("src/a.c", text, []LspDiagnostic{first}))
+
+	tests := []struct {
+		name        string
+		file        string
+		diagnostics []LspDiagnostic
+		fresh       int
+	}{
+		{"accepted finding", "src/a.c", []LspDiagnostic{first}, 0},
+		{"one entry hides one finding", "src/a.c", []LspDiagnostic{first, second}, 1},
+		{"other file", "src/b.c", []LspDiagnostic{first}, 1},
+		{"native separators", filepath.Join("src", "a.c"), []LspDiagnostic{first}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if fresh := baseline.Filter(tt.file, text, tt.diagnostics); len(fresh) != tt.fresh {
+				t.Errorf("got %d fresh findings, want %d", len(fresh), tt.fresh)
+			}
+		})
+	}
+
+	var none *Baseline
+	if fresh := none.Filter("src/a.c", text, []LspDiagnostic{first}); len(fresh) != 1 {
+		t.Errorf("a nil baseline hid %d findings", 1-len(fresh))
+	}
+	if entries := none.Entries("src/a.c"); entries != nil {
+		t.Errorf("a nil baseline has entries %+v", entries)
+	}
+	if entries := baseline.Entries("src/a.c"); len(entries) != 1 {
+		t.Errorf("got %d entries, want 1", len(entries))
+	}
+}
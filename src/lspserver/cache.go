@@ -0,0 +1,102 @@
+package lspserver
+
+import (
+	"container/list"
+	"sync"
+)
+
+// Sizes of the caches shared by all sessions, the least recently used
+// entries are dropped beyond them.
+const (
+	maxCachedAnalyses     = 256
+	maxCachedExplanations = 1024
+	maxCachedTriages      = 1024
+)
+
+/*
+ * lruCache is a cache of a bounded number of entries shared by the sessions.
+ * A long running server sees every version of every document edited, so the
+ * least recently used entries are dropped.
+ */
+type lruCache struct {
+	lock    sync.Mutex
+	size    int
+	order   *list.List // of *lruEntry, most recently used first
+	entries map[interface{}]*list.Element
+}
+
+type lruEntry struct {
+	key   interface{}
+	value interface{}
+}
+
+func newLRUCache(size int) *lruCache {
+	return &lruCache{size: size, order: list.New(), entries: make(map[interface{}]*list.Element)}
+}
+
+// Load returns the value of key and marks it as used.
+func (c *lruCache) Load(key interface{}) (interface{}, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	return element.Value.(*lruEntry).value, true
+}
+
+// Store sets the value of key, dropping the least recently used entry if the
+// cache is full.
+func (c *lruCache) Store(key interface{}, value interface{}) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if element, ok := c.entries[key]; ok {
+		element.Value.(*lruEntry).value = value
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&lruEntry{key: key, value: value})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEntry).key)
+	}
+}
+
+// Delete removes key.
+func (c *lruCache) Delete(key interface{}) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if element, ok := c.entries[key]; ok {
+		c.order.Remove(element)
+		delete(c.entries, key)
+	}
+}
+
+// DeleteFunc removes the keys del returns true for.
+func (c *lruCache) DeleteFunc(del func(key interface{}) bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for key, element := range c.entries {
+		if del(key) {
+			c.order.Remove(element)
+			delete(c.entries, key)
+		}
+	}
+}
+
+// Clear removes every entry.
+func (c *lruCache) Clear() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.order.Init()
+	c.entries = make(map[interface{}]*list.Element)
+}
+
+// Len returns the number of entries.
+func (c *lruCache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.order.Len()
+}
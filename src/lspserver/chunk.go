@@ -0,0 +1,149 @@
+package lspserver
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/TobiasYin/go-lsp/logs"
+)
+
+// chunkLines is the number of source lines sent to the model per request
+const chunkLines = 30
+
+// DocumentChunk is a numbered part of a document. Lines are 1-based and
+// inclusive, Text has every line prefixed with "Line <n>: ".
+type DocumentChunk struct {
+	StartLine int
+	EndLine   int
+	Text      string
+}
+
+/*
+ * ChunkDocument splits a document into chunks of at most chunkLines lines
+ * with the profile's chunker. The block and indent chunkers cut between top
+ * level items so a function is not split unless it is longer than a chunk.
+ * @param document The document content
+ * @param profile The language profile, nil chunks by lines
+ * @return chunks The chunks in document order
+ */
+func ChunkDocument(document string, profile *LanguageProfile) []DocumentChunk {
+	document = stripRetryPrompt(document)
+	lines := strings.Split(document, "\n")
+	for i := range lines {
+		lines[i] = strings.TrimSuffix(lines[i], "\r")
+	}
+
+	chunker := ChunkerLines
+	if profile != nil && profile.Chunker != "" {
+		chunker = profile.Chunker
+	}
+
+	var boundaries []int
+	switch chunker {
+	case ChunkerBlocks:
+		boundaries = blockBoundaries(document)
+	case ChunkerIndent:
+		boundaries = indentBoundaries(lines)
+	}
+	return packChunks(lines, boundaries)
+}
+
+// stripRetryPrompt removes the retry instruction the server puts in front
+// of the document when a response could not be parsed.
+func stripRetryPrompt(document string) string {
+	if ParamRetryPromptFile == nil || *ParamRetryPromptFile == "" {
+		return document
+	}
+	retryPrompt, err := os.ReadFile(*ParamRetryPromptFile)
+	if err != nil {
+		logs.Printf("Unable to read the retry prompt file")
+		return document
+	}
+	return strings.TrimPrefix(document, string(retryPrompt))
+}
+
+// blockBoundaries returns the 0-based lines that start a top level item,
+// i.e. follow a line where a top level block or declaration ended.
+func blockBoundaries(document string) []int {
+	code := stripCommentsAndStrings(document)
+	var boundaries []int
+	depth, line := 0, 0
+	for i := 0; i < len(code); i++ {
+		switch code[i] {
+		case '\n':
+			line++
+		case '{':
+			depth++
+		case '}':
+			if depth > 0 {
+				depth--
+			}
+			if depth == 0 {
+				boundaries = append(boundaries, line+1)
+			}
+		case ';':
+			if depth == 0 {
+				boundaries = append(boundaries, line+1)
+			}
+		}
+	}
+	return boundaries
+}
+
+// indentBoundaries returns the 0-based lines that start a top level
+// statement of an indentation based language.
+func indentBoundaries(lines []string) []int {
+	var boundaries []int
+	for i, line := range lines {
+		if line == "" || line[0] == ' ' || line[0] == '\t' || line[0] == '#' {
+			continue
+		}
+		if strings.ContainsAny(line[:1], ")]}") {
+			continue
+		}
+		boundaries = append(boundaries, i)
+	}
+	return boundaries
+}
+
+// packChunks fills chunks with whole items between boundaries, items longer
+// than a chunk are split by lines.
+func packChunks(lines []string, boundaries []int) []DocumentChunk {
+	var chunks []DocumentChunk
+	start := 0
+	flush := func(end int) {
+		if end <= start {
+			return
+		}
+		var text strings.Builder
+		for j := start; j < end; j++ {
+			text.WriteString(fmt.Sprintf("Line %d: %s\n", j+1, lines[j]))
+		}
+		chunks = append(chunks, DocumentChunk{StartLine: start + 1, EndLine: end, Text: text.String()})
+		start = end
+	}
+
+	next := 0
+	for start < len(lines) {
+		// the furthest boundary that keeps the chunk within chunkLines
+		end := -1
+		for next < len(boundaries) && boundaries[next] <= start {
+			next++
+		}
+		for j := next; j < len(boundaries) && boundaries[j]-start <= chunkLines; j++ {
+			end = boundaries[j]
+		}
+		if len(lines)-start <= chunkLines {
+			end = len(lines)
+		}
+		if end == -1 || end > len(lines) {
+			end = start + chunkLines
+			if end > len(lines) {
+				end = len(lines)
+			}
+		}
+		flush(end)
+	}
+	return chunks
+}
@@ -0,0 +1,142 @@
+package lspserver
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// cFunctions is a C document of n functions of size lines each.
+func cFunctions(n int, size int) string {
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&b, "int f%d(void)\n{\n", i)
+		for j := 0; j < size-3; j++ {
+			b.WriteString("    x++;\n")
+		}
+		b.WriteString("}\n")
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// pythonFunctions is a Python document of n functions of size lines each.
+func pythonFunctions(n int, size int) string {
+	var lines []string
+	for i := 0; i < n; i++ {
+		lines = append(lines, fmt.Sprintf("def f%d():", i))
+		for j := 0; j < size-1; j++ {
+			lines = append(lines, "    x += 1")
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestChunkDocument(t *testing.T) {
+	c, _ := ProfileFor("c", "")
+	python, _ := ProfileFor("python", "")
+	rust, _ := ProfileFor("rust", "")
+	tests := []struct {
+		name     string
+		document string
+		profile  *LanguageProfile
+		want     [][2]int // start and end line of every chunk
+	}{
+		{"empty", "", c, [][2]int{{1, 1}}},
+		{"short", "int a;\nint b;", c, [][2]int{{1, 2}}},
+		{"lines without profile", cFunctions(4, 10), nil, [][2]int{{1, 30}, {31, 40}}},
+		{"lines", cFunctions(4, 10), rust, [][2]int{{1, 30}, {31, 40}}},
+		{"blocks keep functions whole", cFunctions(4, 12), c, [][2]int{{1, 24}, {25, 48}}},
+		{"blocks split long functions", cFunctions(2, 40), c, [][2]int{{1, 30}, {31, 40}, {41, 70}, {71, 80}}},
+		{"braces in comments and strings", "int f(void)\n{\n    /* } */\n    s = \"}\";\n}\n" + cFunctions(3, 10), c, [][2]int{{1, 25}, {26, 35}}},
+		{"indent", pythonFunctions(3, 12), python, [][2]int{{1, 24}, {25, 36}}},
+		{"indent split long functions", pythonFunctions(1, 35), python, [][2]int{{1, 30}, {31, 35}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chunks := ChunkDocument(tt.document, tt.profile)
+			var got [][2]int
+			for _, chunk := range chunks {
+				got = append(got, [2]int{chunk.StartLine, chunk.EndLine})
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("chunks %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChunkDocumentCoverage(t *testing.T) {
+	// Every line is in exactly one chunk, numbered as in the document
+	documents := map[string]string{
+		"c":      cFunctions(7, 13) + "\n" + cFunctions(1, 45) + "\r\nint last;",
+		"python": pythonFunctions(5, 17) + "\n\n# done\n",
+		"rust":   cFunctions(5, 11),
+	}
+	for language, document := range documents {
+		profile, _ := ProfileFor(language, "")
+		lines := strings.Split(document, "\n")
+		next := 1
+		for _, chunk := range ChunkDocument(document, profile) {
+			if chunk.StartLine != next || chunk.EndLine < chunk.StartLine || chunk.EndLine-chunk.StartLine >= chunkLines {
+				t.Fatalf("%s: chunk %d-%d after line %d", language, chunk.StartLine, chunk.EndLine, next-1)
+			}
+			textLines := strings.Split(strings.TrimSuffix(chunk.Text, "\n"), "\n")
+			for i, text := range textLines {
+				line := chunk.StartLine + i
+				if want := fmt.Sprintf("Line %d: %s", line, strings.TrimSuffix(lines[line-1], "\r")); text != want {
+					t.Fatalf("%s: %q, want %q", language, text, want)
+				}
+			}
+			next = chunk.EndLine + 1
+		}
+		if next != len(lines)+1 {
+			t.Errorf("%s: chunks end at line %d of %d", language, next-1, len(lines))
+		}
+	}
+}
+
+func TestProfileFor(t *testing.T) {
+	tests := []struct {
+		languageID string
+		uri        string
+		want       string
+	}{
+		{"c", "file:///a.txt", "c"},
+		{"cuda-cpp", "", "cpp"},
+		{"", "file:///src/A.HPP", "cpp"},
+		{"", "file:///src/main.go", "go"},
+		{"plaintext", "file:///src/lib.rs", "rust"},
+		{"", "file:///README.md", ""},
+	}
+	for _, tt := range tests {
+		profile, ok := ProfileFor(tt.languageID, tt.uri)
+		got := ""
+		if ok {
+			got = profile.LanguageID
+		}
+		if got != tt.want {
+			t.Errorf("ProfileFor(%q, %q) = %q, want %q", tt.languageID, tt.uri, got, tt.want)
+		}
+	}
+}
+
+func TestProfileComment(t *testing.T) {
+	c, _ := ProfileFor("c", "")
+	python, _ := ProfileFor("python", "")
+	tests := []struct {
+		name    string
+		profile *LanguageProfile
+		text    string
+		want    string
+	}{
+		{"block", c, "one\ntwo", "/* one\ntwo */"},
+		{"text ending the block", c, "a */ b\n\nc", "// a */ b\n//\n// c"},
+		{"line comments", python, "one\ntwo", "# one\n# two"},
+		{"no comment syntax", &LanguageProfile{}, "x", "// x"},
+	}
+	for _, tt := range tests {
+		if got := tt.profile.Comment(tt.text); got != tt.want {
+			t.Errorf("%s: Comment = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package lspserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/TobiasYin/go-lsp/jsonrpc"
+	"github.com/TobiasYin/go-lsp/logs"
+	"github.com/TobiasYin/go-lsp/lsp/defines"
+)
+
+// userResponseTimeout bounds requests the user answers, the other requests
+// to the client time out after jsonrpc.DefaultCallTimeout.
+const userResponseTimeout = 5 * time.Minute
+
+// SettingsSection is the section of the client settings read with
+// workspace/configuration, e.g. "fuzzlsp.model" in VS Code.
+const SettingsSection = "fuzzlsp"
+
+// clientSettings are the FuzzLSP settings of the client.
+type clientSettings struct {
+	Model string `json:"model"`
+}
+
+// model is the model the session selected, empty for the backend's default.
+func (state *sessionState) model() string {
+	state.settingsLock.Lock()
+	defer state.settingsLock.Unlock()
+	return state.settings.Model
+}
+
+// setModel selects the model of the session's requests, the analyses,
+// explanations and triage verdicts are cached per model.
+func (state *sessionState) setModel(model string) {
+	state.settingsLock.Lock()
+	defer state.settingsLock.Unlock()
+	state.settings.Model = model
+}
+
+// backendContext makes the backend requests made with ctx use the model of
+// the session, see WithModel.
+func (state *sessionState) backendContext(ctx context.Context) context.Context {
+	return WithModel(ctx, state.model())
+}
+
+/*
+ * call sends a request to the client of the session the context belongs to
+ * and waits for the response.
+ * @param ctx The context of the handler the request is sent from
+ * @param method The method of the request
+ * @param params The params of the request
+ * @param result The response is decoded into it, may be nil
+ * @return error Any error the client responded with, a timeout or cancellation
+ */
+func (l *lspServer) call(ctx context.Context, method string, params interface{}, result interface{}) error {
+	session := jsonrpc.SessionFromContext(ctx)
+	if session == nil {
+		return fmt.Errorf("no client session to send %s to", method)
+	}
+	return session.Call(ctx, method, params, result)
+}
+
+// supportsWorkDoneProgress tells if the client accepts window/workDoneProgress/create.
+func (state *sessionState) supportsWorkDoneProgress() bool {
+	window := state.capabilities.Window
+	return window != nil && window.WorkDoneProgress != nil && *window.WorkDoneProgress
+}
+
+// supportsConfiguration tells if the client answers workspace/configuration.
+func (state *sessionState) supportsConfiguration() bool {
+	workspace := state.capabilities.Workspace
+	return workspace != nil && workspace.Configuration != nil && *workspace.Configuration
+}
+
+// supportsApplyEdit tells if the client accepts workspace/applyEdit.
+func (state *sessionState) supportsApplyEdit() bool {
+	workspace := state.capabilities.Workspace
+	return workspace != nil && workspace.ApplyEdit != nil && *workspace.ApplyEdit
+}
+
+// createProgress asks the client to create a progress for a token.
+func (l *lspServer) createProgress(ctx context.Context, token string) error {
+	return l.call(ctx, "window/workDoneProgress/create", defines.WorkDoneProgressCreateParams{Token: token}, nil)
+}
+
+/*
+ * applyEdit asks the client to apply a workspace edit.
+ * @param ctx The context of the handler
+ * @param label The label of the edit, e.g. shown in the undo stack
+ * @param edit The edit
+ * @return error The reason the client did not apply the edit
+ */
+func (l *lspServer) applyEdit(ctx context.Context, label string, edit defines.WorkspaceEdit) error {
+	if !l.state(ctx).supportsApplyEdit() {
+		return fmt.Errorf("the client can't apply edits")
+	}
+	var result defines.ApplyWorkspaceEditResult
+	params := defines.ApplyWorkspaceEditParams{Label: &label, Edit: edit}
+	if err := l.call(ctx, "workspace/applyEdit", params, &result); err != nil {
+		return err
+	}
+	if !result.Applied {
+		reason := "no reason given"
+		if result.FailureReason != nil {
+			reason = *result.FailureReason
+		}
+		return fmt.Errorf("the client did not apply the edit: %s", reason)
+	}
+	return nil
+}
+
+/*
+ * showMessageRequest shows a message with buttons and waits for the user.
+ * @param ctx The context of the handler
+ * @param messageType The type of the message
+ * @param message The message
+ * @param actions The titles of the buttons
+ * @return action The title of the chosen button, empty if dismissed
+ * @return error Any error that occurred, e.g. no answer in time
+ */
+func (l *lspServer) showMessageRequest(ctx context.Context, messageType defines.MessageType, message string, actions ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, userResponseTimeout)
+	defer cancel()
+
+	items := make([]defines.MessageActionItem, 0, len(actions))
+	for _, action := range actions {
+		items = append(items, defines.MessageActionItem{Title: action})
+	}
+	var chosen *defines.MessageActionItem
+	params := defines.ShowMessageRequestParams{Type: messageType, Message: message, Actions: &items}
+	if err := l.call(ctx, "window/showMessageRequest", params, &chosen); err != nil {
+		return "", err
+	}
+	if chosen == nil {
+		return "", nil
+	}
+	return chosen.Title, nil
+}
+
+/*
+ * loadSettings reads the FuzzLSP settings of the client with
+ * workspace/configuration and applies them. The settings are kept per
+ * session, a model selected by one client is only used for its requests.
+ * @param ctx The context of the handler
+ * @return error Any error that occurred while reading or applying
+ */
+func (l *lspServer) loadSettings(ctx context.Context) error {
+	state := l.state(ctx)
+	if !state.supportsConfiguration() {
+		return nil
+	}
+	section := SettingsSection
+	params := defines.ConfigurationParams{Items: []defines.ConfigurationItem{{Section: &section}}}
+	var result []json.RawMessage
+	if err := l.call(ctx, "workspace/configuration", params, &result); err != nil {
+		return err
+	}
+	if len(result) == 0 || string(result[0]) == "null" {
+		return nil
+	}
+
+	var settings clientSettings
+	if err := json.Unmarshal(result[0], &settings); err != nil {
+		return fmt.Errorf("invalid %s settings: %w", SettingsSection, err)
+	}
+	logs.Printf("[+] Client settings: %+v", settings)
+	state.settingsLock.Lock()
+	defer state.settingsLock.Unlock()
+	if settings.Model == "" {
+		// Keep a model selected with fuzzlsp.switchModel
+		settings.Model = state.settings.Model
+	}
+	state.settings = settings
+	return nil
+}
+
+/*
+ * OnDidChangeConfiguration reads the settings again when the user changed
+ * them.
+ * @param ctx The context of the notification
+ * @param req The changed settings, not used as they are read again
+ * @return error Any error that occurred while applying the settings
+ */
+func (l *lspServer) OnDidChangeConfiguration(ctx context.Context, req *defines.DidChangeConfigurationParams) error {
+	logs.Printf("OnDidChangeConfiguration")
+	if err := l.loadSettings(ctx); err != nil {
+		logs.Printf("Error loading settings: %v", err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,389 @@
+package lspserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/TobiasYin/go-lsp/logs"
+	"github.com/TobiasYin/go-lsp/lsp/defines"
+)
+
+// Commands callable with workspace/executeCommand
+const (
+	CommandAnalyzeFile      = "fuzzlsp.analyzeFile"      // [uri]
+	CommandAnalyzeWorkspace = "fuzzlsp.analyzeWorkspace" // []
+	CommandClearCache       = "fuzzlsp.clearCache"       // []
+	CommandExportReport     = "fuzzlsp.exportReport"     // [path], default <workspace>/.fuzzlsp/report.json
+	CommandSwitchModel      = "fuzzlsp.switchModel"      // [model]
+	CommandFixFile          = "fuzzlsp.fixFile"          // [uri]
+	CommandUpdateBaseline   = "fuzzlsp.updateBaseline"   // []
+	CommandExplainLine      = "fuzzlsp.explainLine"      // [uri, line], line counted from 1
+)
+
+// Commands are advertised in the executeCommandProvider capability.
+var Commands = []string{
+	CommandAnalyzeFile,
+	CommandAnalyzeWorkspace,
+	CommandClearCache,
+	CommandExportReport,
+	CommandSwitchModel,
+	CommandFixFile,
+	CommandUpdateBaseline,
+	CommandExplainLine,
+}
+
+// DefaultReportFile is where fuzzlsp.exportReport writes without a path,
+// relative to the workspace root.
+const DefaultReportFile = ".fuzzlsp/report.json"
+
+// maxWorkspaceFiles bounds fuzzlsp.analyzeWorkspace, every file is at least
+// one backend request per rule.
+const maxWorkspaceFiles = 500
+
+// confirmWorkspaceFiles is the number of files above which
+// fuzzlsp.analyzeWorkspace asks the user before analysing.
+const confirmWorkspaceFiles = 50
+
+/*
+ * OnExecuteCommand runs one of the FuzzLSP commands. The outcome is reported
+ * to the user with window/showMessage.
+ * @param ctx The context of the request
+ * @param req The command and its arguments
+ * @return error Any error that occurred while running the command
+ */
+func (l *lspServer) OnExecuteCommand(ctx context.Context, req *defines.ExecuteCommandParams) error {
+	logs.Printf("OnExecuteCommand: %s", req.Command)
+
+	var args []interface{}
+	if req.Arguments != nil {
+		args = *req.Arguments
+	}
+
+	var message string
+	var err error
+	switch req.Command {
+	case CommandAnalyzeFile:
+		uri, ok := stringArgument(args, 0)
+		if !ok {
+			return fmt.Errorf("%s needs the document URI", req.Command)
+		}
+		message, err = l.analyzeFile(ctx, uri)
+	case CommandAnalyzeWorkspace:
+		message, err = l.analyzeWorkspace(ctx)
+	case CommandClearCache:
+		message = l.clearCache(ctx)
+	case CommandExportReport:
+		path, _ := stringArgument(args, 0)
+		message, err = l.exportReport(ctx, path)
+	case CommandSwitchModel:
+		model, ok := stringArgument(args, 0)
+		if !ok || model == "" {
+			return fmt.Errorf("%s needs the model name", req.Command)
+		}
+		l.state(ctx).setModel(model)
+		message = "FuzzLSP now uses " + model
+	case CommandFixFile:
+		uri, ok := stringArgument(args, 0)
+		if !ok {
+			return fmt.Errorf("%s needs the document URI", req.Command)
+		}
+		message, err = l.fixFile(ctx, uri)
+	case CommandUpdateBaseline:
+		message, err = l.updateBaseline(ctx)
+	case CommandExplainLine:
+		uri, ok := stringArgument(args, 0)
+		line, lineOK := lineArgument(args, 1)
+		if !ok || !lineOK {
+			return fmt.Errorf("%s needs the document URI and line", req.Command)
+		}
+		message, err = l.explainLine(ctx, uri, line)
+	default:
+		return fmt.Errorf("unknown command %s", req.Command)
+	}
+	if err != nil {
+		logs.Printf("Command %s failed: %v", req.Command, err)
+		return err
+	}
+
+	l.showMessage(ctx, defines.MessageTypeInfo, message)
+	return nil
+}
+
+func stringArgument(args []interface{}, i int) (string, bool) {
+	if i >= len(args) {
+		return "", false
+	}
+	s, ok := args[i].(string)
+	return s, ok
+}
+
+// lineArgument returns a line number argument, JSON numbers are float64.
+func lineArgument(args []interface{}, i int) (int, bool) {
+	if i >= len(args) {
+		return 0, false
+	}
+	line, ok := args[i].(float64)
+	if !ok || line < 1 || line != float64(int(line)) {
+		return 0, false
+	}
+	return int(line), true
+}
+
+// showMessage shows a message to the user, failures are only logged.
+func (l *lspServer) showMessage(ctx context.Context, messageType defines.MessageType, message string) {
+	logs.Printf("%s", message)
+	params := defines.ShowMessageParams{Type: messageType, Message: message}
+	if err := l.SendNotification(ctx, "window/showMessage", params); err != nil {
+		logs.Printf("Error showing message: %v", err)
+	}
+}
+
+// analyzeFile analyses a document again even if it didn't change, asking
+// the backend instead of using the cached analysis and explanations.
+func (l *lspServer) analyzeFile(ctx context.Context, uri string) (string, error) {
+	state := l.state(ctx)
+	text, err := l.documentText(state, uri)
+	if err != nil {
+		return "", err
+	}
+	state.documents.Delete(uri)
+	l.forgetAnalysis(state, uri, text)
+	if err := l.updateDocumentStore(ctx, uri, text); err != nil {
+		return "", err
+	}
+	diagnostics, _ := state.documents.GetDiagnostics(uri)
+	return fmt.Sprintf("FuzzLSP found %d issues in %s", len(diagnostics), state.relativePath(uri)), nil
+}
+
+/*
+ * analyzeWorkspace analyses every file below the workspace folders that has a
+ * language profile. Hidden directories are skipped. The files done are
+ * reported with $/progress, cancelling it stops after the current file.
+ * @param ctx The context of the command
+ * @return message The summary for the user
+ * @return error Any error that occurred while walking the workspace
+ */
+func (l *lspServer) analyzeWorkspace(ctx context.Context) (message string, err error) {
+	state := l.state(ctx)
+	if len(state.folders) == 0 {
+		return "", fmt.Errorf("no workspace folder is open")
+	}
+
+	var files []string
+	for _, folder := range state.folders {
+		err = filepath.WalkDir(folder, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if entry.IsDir() {
+				if path != folder && strings.HasPrefix(entry.Name(), ".") {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if _, ok := ProfileFor("", path); ok {
+				files = append(files, path)
+			}
+			if len(files) >= maxWorkspaceFiles {
+				return filepath.SkipAll
+			}
+			return nil
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+	if len(files) > confirmWorkspaceFiles {
+		question := fmt.Sprintf("Analyse %d files? Every file is sent to the model once per rule.", len(files))
+		answer, err := l.showMessageRequest(ctx, defines.MessageTypeWarning, question, "Analyse", "Cancel")
+		if err != nil {
+			return "", err
+		}
+		if answer != "Analyse" {
+			return "FuzzLSP did not analyse the workspace", nil
+		}
+	}
+
+	progress := l.beginProgress(ctx, "FuzzLSP", fmt.Sprintf("Analysing %d files", len(files)))
+	defer func() { progress.End(err) }()
+
+	issues, failed := 0, 0
+	for i, path := range files {
+		if err := progress.Context().Err(); err != nil {
+			return "", err
+		}
+		uri := fileURI(path)
+		progress.Report(fmt.Sprintf("%d/%d %s", i+1, len(files), state.relativePath(uri)), uint(i*100/len(files)))
+		text, err := ReadFileContent(path)
+		if err == nil {
+			state.documents.Delete(uri)
+			err = l.updateDocumentStore(progress.Context(), uri, text)
+		}
+		if err != nil {
+			logs.Printf("Error analysing %s: %v", path, err)
+			failed++
+			continue
+		}
+		diagnostics, _ := state.documents.GetDiagnostics(uri)
+		issues += len(diagnostics)
+	}
+
+	message = fmt.Sprintf("FuzzLSP analysed %d files and found %d issues", len(files)-failed, issues)
+	if failed > 0 {
+		message += fmt.Sprintf(", %d files failed", failed)
+	}
+	return message, nil
+}
+
+/*
+ * fixFile fixes every finding of a document like the "Fix all findings in
+ * file" action and asks the client to apply the edit with workspace/applyEdit.
+ * @param ctx The context of the command
+ * @param uri The document URI
+ * @return message The summary for the user
+ * @return error Any error that occurred while fixing or applying
+ */
+func (l *lspServer) fixFile(ctx context.Context, uri string) (string, error) {
+	action, err := l.resolveFixAll(ctx, &defines.CodeAction{}, uri, "")
+	if err != nil {
+		return "", err
+	}
+	if err := l.applyEdit(ctx, "Fix all findings [FuzzLSP]", *action.Edit); err != nil {
+		return "", err
+	}
+	changes := *action.Edit.Changes
+	return fmt.Sprintf("FuzzLSP applied %d edits to %s", len(changes[uri]), l.state(ctx).relativePath(uri)), nil
+}
+
+/*
+ * updateBaseline accepts the current findings of the open documents: it
+ * writes them to the session's baseline file, keeping the entries of the
+ * other files, and hides them from then on.
+ * @param ctx The context of the command
+ * @return message The summary for the user
+ * @return error Any error that occurred while writing the baseline
+ */
+func (l *lspServer) updateBaseline(ctx context.Context) (string, error) {
+	state := l.state(ctx)
+	fileName := state.baselineFile()
+	if fileName == "" {
+		return "", fmt.Errorf("no workspace folder is open and -baseline is not set")
+	}
+
+	baseline := &Baseline{}
+	if state.baseline != nil {
+		baseline.Findings = append(baseline.Findings, state.baseline.Findings...)
+	}
+	documents := state.documents.Dump()
+	findings := make(map[string][]LspDiagnostic, len(documents))
+	accepted := 0
+	for uri, text := range documents {
+		profile, ok := state.profile(uri)
+		if !ok {
+			continue
+		}
+		diagnostics := state.policy.FilterDiagnostics(state.documents.ProviderDiagnostics(uri))
+		diagnostics, _ = ApplyDeviations(uri, text, profile, diagnostics)
+		entries := BaselineEntries(state.relativePath(uri), text, diagnostics)
+		baseline.Replace(state.relativePath(uri), entries)
+		findings[uri] = diagnostics
+		accepted += len(entries)
+	}
+	if err := baseline.Save(fileName); err != nil {
+		return "", err
+	}
+	state.baseline = baseline
+
+	for uri, diagnostics := range findings {
+		state.documents.UpdateDiagnostics(uri, baseline.Filter(state.relativePath(uri), documents[uri], diagnostics))
+	}
+	return fmt.Sprintf("FuzzLSP accepted %d findings of %d files in %s", accepted, len(findings), fileName), nil
+}
+
+// fileURI turns an absolute path into a file URI.
+func fileURI(path string) string {
+	path = filepath.ToSlash(path)
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return "file://" + path
+}
+
+// clearCache forgets the documents of the session and the analyses,
+// explanations and triage verdicts of all sessions, the next change of a
+// document analyses it again.
+func (l *lspServer) clearCache(ctx context.Context) string {
+	state := l.state(ctx)
+	documents := state.documents.Dump()
+	uris := make([]string, 0, len(documents))
+	for uri := range documents {
+		uris = append(uris, uri)
+	}
+	for _, uri := range uris {
+		state.documents.Delete(uri)
+	}
+	l.clearSharedCaches()
+	return fmt.Sprintf("FuzzLSP cleared the cache of %d documents", len(uris))
+}
+
+// forgetAnalysis drops the cached analysis of a document's text and the
+// explanations and triage verdicts of its findings, for every model.
+func (l *lspServer) forgetAnalysis(state *sessionState, uri string, text string) {
+	if profile, ok := state.profile(uri); ok {
+		l.analyses.Delete(analysisKey(state.model(), uri, text, profile, l.promptRules(state, profile)))
+	}
+	prefix := uri + "\x00"
+	ofDocument := func(key interface{}) bool {
+		return strings.HasPrefix(key.(string), prefix)
+	}
+	l.explanations.DeleteFunc(ofDocument)
+	l.triages.DeleteFunc(ofDocument)
+}
+
+// clearSharedCaches forgets the analyses, explanations and triage verdicts
+// of all sessions.
+func (l *lspServer) clearSharedCaches() {
+	l.analyses.Clear()
+	l.explanations.Clear()
+	l.triages.Clear()
+}
+
+/*
+ * exportReport writes the findings of every document the session analysed to
+ * a JSON file, keyed by the path relative to the workspace.
+ * @param ctx The context of the command
+ * @param path The report file, empty for DefaultReportFile
+ * @return message The summary for the user
+ * @return error Any error that occurred while writing
+ */
+func (l *lspServer) exportReport(ctx context.Context, path string) (string, error) {
+	state := l.state(ctx)
+	if path == "" {
+		path = filepath.Join(state.root, DefaultReportFile)
+	}
+
+	report := make(map[string][]LspDiagnostic)
+	for uri := range state.documents.Dump() {
+		diagnostics, err := state.documents.GetDiagnostics(uri)
+		if err != nil {
+			continue
+		}
+		report[state.relativePath(uri)] = diagnostics
+	}
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("FuzzLSP wrote the findings of %d files to %s", len(report), path), nil
+}
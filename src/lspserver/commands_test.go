@@ -0,0 +1,139 @@
+package lspserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func executeCommand(c *testClient, command string, args ...interface{}) error {
+	return c.request("workspace/executeCommand", map[string]interface{}{"command": command, "arguments": args}, nil)
+}
+
+// shownMessage returns the text of the next window/showMessage.
+func shownMessage(t *testing.T, c *testClient) string {
+	t.Helper()
+	var params struct {
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(c.next("window/showMessage").Params, &params); err != nil {
+		t.Fatal(err)
+	}
+	return params.Message
+}
+
+func TestExecuteCommandArguments(t *testing.T) {
+	l := newTestServer(t)
+	c := connectTestClient(t, l, nil)
+	c.initialize(t.TempDir(), `{}`)
+
+	tests := []struct {
+		command string
+		args    []interface{}
+		want    string
+	}{
+		{CommandAnalyzeFile, nil, "needs the document URI"},
+		{CommandAnalyzeFile, []interface{}{42}, "needs the document URI"},
+		{CommandFixFile, nil, "needs the document URI"},
+		{CommandSwitchModel, nil, "needs the model name"},
+		{CommandSwitchModel, []interface{}{""}, "needs the model name"},
+		{"fuzzlsp.unknown", nil, "unknown command"},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s%v", tt.command, tt.args), func(t *testing.T) {
+			err := executeCommand(c, tt.command, tt.args...)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestSwitchModel(t *testing.T) {
+	l := newTestServer(t)
+	backend := &modelRecorder{LspBackend: l.backend, models: make(map[string][]string)}
+	l.backend = backend
+	root := t.TempDir()
+	uri := "file://" + root + "/a.c"
+
+	a := connectTestClient(t, l, nil)
+	a.initialize(root, `{}`)
+	if err := executeCommand(a, CommandSwitchModel, "model-x"); err != nil {
+		t.Fatal(err)
+	}
+	if got := shownMessage(t, a); got != "FuzzLSP now uses model-x" {
+		t.Errorf("message = %q", got)
+	}
+	a.open(uri, "int a;\n")
+	waitFor(t, "the analysis of A", func() bool { return len(backend.analysed(uri)) == 1 })
+
+	// The same document is analysed again with the default model of B, but
+	// only once for B and C
+	b := connectTestClient(t, l, nil)
+	b.initialize(root, `{}`)
+	b.open(uri, "int a;\n")
+	waitFor(t, "the analysis of B", func() bool { return len(backend.analysed(uri)) == 2 })
+	c := connectTestClient(t, l, nil)
+	c.initialize(root, `{}`)
+	c.open(uri, "int a;\n")
+	waitFor(t, "the analysis of C", func() bool { return analysedSessions(l, uri) == 3 })
+
+	got := backend.analysed(uri)
+	if len(got) != 2 || got[0] != "model-x" || got[1] != "default" {
+		t.Errorf("analysed with %v, want [model-x default]", got)
+	}
+}
+
+// writeSources writes n C files to a new workspace.
+func writeSources(t *testing.T, n int) string {
+	t.Helper()
+	root := t.TempDir()
+	for i := 0; i < n; i++ {
+		if err := os.WriteFile(filepath.Join(root, fmt.Sprintf("f%d.c", i)), []byte("int x;\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func TestAnalyzeWorkspaceConfirmation(t *testing.T) {
+	tests := []struct {
+		name   string
+		files  int
+		answer interface{} // the chosen button, nil if dismissed
+		asked  bool
+		want   string
+	}{
+		{"few files", confirmWorkspaceFiles, nil, false, fmt.Sprintf("analysed %d files", confirmWorkspaceFiles)},
+		{"confirmed", confirmWorkspaceFiles + 1, map[string]string{"title": "Analyse"}, true, fmt.Sprintf("analysed %d files", confirmWorkspaceFiles+1)},
+		{"cancelled", confirmWorkspaceFiles + 1, map[string]string{"title": "Cancel"}, true, "did not analyse"},
+		{"dismissed", confirmWorkspaceFiles + 1, nil, true, "did not analyse"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var asked int32
+			l := newTestServer(t)
+			c := connectTestClient(t, l, map[string]func(json.RawMessage) (interface{}, error){
+				"window/showMessageRequest": func(json.RawMessage) (interface{}, error) {
+					atomic.StoreInt32(&asked, 1)
+					return tt.answer, nil
+				},
+			})
+			c.initialize(writeSources(t, tt.files), `{}`)
+
+			if err := executeCommand(c, CommandAnalyzeWorkspace); err != nil {
+				t.Fatal(err)
+			}
+			if got := shownMessage(t, c); !strings.Contains(got, tt.want) {
+				t.Errorf("message = %q, want %q", got, tt.want)
+			}
+			if (atomic.LoadInt32(&asked) == 1) != tt.asked {
+				t.Errorf("asked = %v, want %v", !tt.asked, tt.asked)
+			}
+		})
+	}
+}
@@ -0,0 +1,236 @@
+package lspserver
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+type CTokenKind int
+
+const (
+	CTokenIdent CTokenKind = iota
+	CTokenKeyword
+	CTokenNumber
+	CTokenString
+	CTokenChar
+	CTokenPunct
+	CTokenComment
+	CTokenDirective
+)
+
+// CToken is a token of a C or C++ document. Line is 1-based, Column and
+// EndColumn are 0-based UTF-16 offsets on Line as used by LSP positions.
+// Comments and directives may span lines, EndLine is the line they end on.
+type CToken struct {
+	Kind      CTokenKind
+	Text      string
+	Offset    int
+	Line      int
+	Column    int
+	EndLine   int
+	EndColumn int
+}
+
+var cKeywords = map[string]bool{
+	"auto": true, "break": true, "case": true, "char": true, "const": true,
+	"continue": true, "default": true, "do": true, "double": true, "else": true,
+	"enum": true, "extern": true, "float": true, "for": true, "goto": true,
+	"if": true, "inline": true, "int": true, "long": true, "register": true,
+	"restrict": true, "return": true, "short": true, "signed": true,
+	"sizeof": true, "static": true, "struct": true, "switch": true,
+	"typedef": true, "union": true, "unsigned": true, "void": true,
+	"volatile": true, "while": true, "_Alignas": true, "_Alignof": true,
+	"_Atomic": true, "_Bool": true, "_Complex": true, "_Generic": true,
+	"_Imaginary": true, "_Noreturn": true, "_Static_assert": true,
+	"_Thread_local": true,
+}
+
+// cPunctuators are the multi-character punctuators, longest first.
+var cPunctuators = []string{
+	"<<=", ">>=", "...",
+	"->", "++", "--", "<<", ">>", "<=", ">=", "==", "!=", "&&", "||",
+	"*=", "/=", "%=", "+=", "-=", "&=", "^=", "|=", "##", "::",
+}
+
+/*
+ * TokenizeC splits a C-like document into tokens. It is a lexer, not a
+ * parser: it understands comments, literals and preprocessor lines well
+ * enough for checks that look at token sequences, and never fails.
+ * @param text The document content
+ * @return tokens The tokens in document order, whitespace is dropped
+ */
+func TokenizeC(text string) []CToken {
+	var tokens []CToken
+	line, lineStart := 1, 0
+	atLineStart := true
+
+	emit := func(kind CTokenKind, start int, end int) {
+		token := CToken{
+			Kind:   kind,
+			Text:   text[start:end],
+			Offset: start,
+			Line:   line,
+			Column: utf16Len(text[lineStart:start]),
+		}
+		// advance over any newlines inside the token
+		for i := start; i < end; i++ {
+			if text[i] == '\n' {
+				line++
+				lineStart = i + 1
+			}
+		}
+		token.EndLine = line
+		token.EndColumn = utf16Len(text[lineStart:end])
+		tokens = append(tokens, token)
+	}
+
+	for i := 0; i < len(text); {
+		c := text[i]
+		start := i
+
+		switch {
+		case c == '\n':
+			line++
+			lineStart = i + 1
+			atLineStart = true
+			i++
+			continue
+		case c == ' ' || c == '\t' || c == '\r' || c == '\f' || c == '\v':
+			i++
+			continue
+		case atLineStart && c == '#':
+			for i < len(text) && text[i] != '\n' {
+				if text[i] == '\\' && i+1 < len(text) && text[i+1] == '\n' {
+					i += 2
+					continue
+				}
+				i++
+			}
+			emit(CTokenDirective, start, i)
+		case c == '/' && i+1 < len(text) && text[i+1] == '/':
+			for i < len(text) && text[i] != '\n' {
+				i++
+			}
+			emit(CTokenComment, start, i)
+		case c == '/' && i+1 < len(text) && text[i+1] == '*':
+			end := strings.Index(text[i+2:], "*/")
+			if end == -1 {
+				i = len(text)
+			} else {
+				i += 2 + end + 2
+			}
+			emit(CTokenComment, start, i)
+			// a comment in front of a directive doesn't hide it
+			continue
+		case c == '"' || c == '\'':
+			i = skipCLiteral(text, i)
+			if c == '"' {
+				emit(CTokenString, start, i)
+			} else {
+				emit(CTokenChar, start, i)
+			}
+		case isCIdentStart(c):
+			for i < len(text) && isCIdentChar(text[i]) {
+				i++
+			}
+			word := text[start:i]
+			if i < len(text) && (text[i] == '"' || text[i] == '\'') &&
+				(word == "L" || word == "u" || word == "U" || word == "u8") {
+				quote := text[i]
+				i = skipCLiteral(text, i)
+				if quote == '"' {
+					emit(CTokenString, start, i)
+				} else {
+					emit(CTokenChar, start, i)
+				}
+			} else if cKeywords[word] {
+				emit(CTokenKeyword, start, i)
+			} else {
+				emit(CTokenIdent, start, i)
+			}
+		case isCDigit(c) || (c == '.' && i+1 < len(text) && isCDigit(text[i+1])):
+			for i < len(text) {
+				ch := text[i]
+				if (ch == '+' || ch == '-') && strings.ContainsRune("eEpP", rune(text[i-1])) {
+					i++
+					continue
+				}
+				if !isCIdentChar(ch) && ch != '.' {
+					break
+				}
+				i++
+			}
+			emit(CTokenNumber, start, i)
+		default:
+			i++
+			for _, p := range cPunctuators {
+				if strings.HasPrefix(text[start:], p) {
+					i = start + len(p)
+					break
+				}
+			}
+			if c >= utf8.RuneSelf {
+				_, size := utf8.DecodeRuneInString(text[start:])
+				i = start + size
+			}
+			emit(CTokenPunct, start, i)
+		}
+		atLineStart = false
+	}
+	return tokens
+}
+
+// skipCLiteral returns the offset after the string or character literal
+// starting at i. Unterminated literals end at the end of the line.
+func skipCLiteral(text string, i int) int {
+	quote := text[i]
+	for i++; i < len(text); i++ {
+		switch text[i] {
+		case '\\':
+			if i+1 < len(text) && text[i+1] != '\n' {
+				i++
+			}
+		case quote:
+			return i + 1
+		case '\n':
+			return i
+		}
+	}
+	return i
+}
+
+// CodeTokens drops comments and preprocessor directives.
+func CodeTokens(tokens []CToken) []CToken {
+	var code []CToken
+	for _, t := range tokens {
+		if t.Kind != CTokenComment && t.Kind != CTokenDirective {
+			code = append(code, t)
+		}
+	}
+	return code
+}
+
+func isCIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isCIdentChar(c byte) bool {
+	return isCIdentStart(c) || isCDigit(c)
+}
+
+func isCDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// utf16Len is the length of s in UTF-16 code units.
+func utf16Len(s string) int {
+	n := 0
+	for _, r := range s {
+		if r >= 0x10000 {
+			n += 2
+		} else {
+			n++
+		}
+	}
+	return n
+}
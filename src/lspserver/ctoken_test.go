@@ -0,0 +1,98 @@
+package lspserver
+
+import "testing"
+
+func TestTokenizeC(t *testing.T) {
+	type token struct {
+		kind   CTokenKind
+		text   string
+		line   int
+		column int
+	}
+	tests := []struct {
+		name   string
+		text   string
+		tokens []token
+	}{
+		{"declaration", "int x = 42;", []token{
+			{CTokenKeyword, "int", 1, 0},
+			{CTokenIdent, "x", 1, 4},
+			{CTokenPunct, "=", 1, 6},
+			{CTokenNumber, "42", 1, 8},
+			{CTokenPunct, ";", 1, 10},
+		}},
+		{"multi-character punctuators", "a <<= b->c;", []token{
+			{CTokenIdent, "a", 1, 0},
+			{CTokenPunct, "<<=", 1, 2},
+			{CTokenIdent, "b", 1, 6},
+			{CTokenPunct, "->", 1, 7},
+			{CTokenIdent, "c", 1, 9},
+			{CTokenPunct, ";", 1, 10},
+		}},
+		{"comments", "// line\n/* block\n */ x", []token{
+			{CTokenComment, "// line", 1, 0},
+			{CTokenComment, "/* block\n */", 2, 0},
+			{CTokenIdent, "x", 3, 4},
+		}},
+		{"literals", `s = "a \" /* b"; c = '\'';`, []token{
+			{CTokenIdent, "s", 1, 0},
+			{CTokenPunct, "=", 1, 2},
+			{CTokenString, `"a \" /* b"`, 1, 4},
+			{CTokenPunct, ";", 1, 15},
+			{CTokenIdent, "c", 1, 17},
+			{CTokenPunct, "=", 1, 19},
+			{CTokenChar, `'\''`, 1, 21},
+			{CTokenPunct, ";", 1, 25},
+		}},
+		{"prefixed string", `L"wide"`, []token{
+			{CTokenString, `L"wide"`, 1, 0},
+		}},
+		{"directive with continuation", "#define A \\\n  1\nint", []token{
+			{CTokenDirective, "#define A \\\n  1", 1, 0},
+			{CTokenKeyword, "int", 3, 0},
+		}},
+		{"hash inside a line is no directive", "a # b", []token{
+			{CTokenIdent, "a", 1, 0},
+			{CTokenPunct, "#", 1, 2},
+			{CTokenIdent, "b", 1, 4},
+		}},
+		{"floating point", "1.5e-3f .5", []token{
+			{CTokenNumber, "1.5e-3f", 1, 0},
+			{CTokenNumber, ".5", 1, 8},
+		}},
+		{"utf-16 columns", "/* ä😀 */ x", []token{
+			{CTokenComment, "/* ä😀 */", 1, 0},
+			{CTokenIdent, "x", 1, 10},
+		}},
+		{"unterminated comment", "x /* open", []token{
+			{CTokenIdent, "x", 1, 0},
+			{CTokenComment, "/* open", 1, 2},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokens := TokenizeC(tt.text)
+			if len(tokens) != len(tt.tokens) {
+				t.Fatalf("got %d tokens, want %d: %+v", len(tokens), len(tt.tokens), tokens)
+			}
+			for i, want := range tt.tokens {
+				got := tokens[i]
+				if got.Kind != want.kind || got.Text != want.text || got.Line != want.line || got.Column != want.column {
+					t.Errorf("token %d = %d %q at %d:%d, want %d %q at %d:%d", i,
+						got.Kind, got.Text, got.Line, got.Column, want.kind, want.text, want.line, want.column)
+				}
+			}
+		})
+	}
+}
+
+func TestCodeTokensDropsComments(t *testing.T) {
+	code := CodeTokens(TokenizeC("#include <a.h>\n/* c */ int x; // d"))
+	var texts []string
+	for _, token := range code {
+		texts = append(texts, token.Text)
+	}
+	if len(texts) != 3 || texts[0] != "int" || texts[1] != "x" || texts[2] != ";" {
+		t.Errorf("CodeTokens = %q, want [int x ;]", texts)
+	}
+}
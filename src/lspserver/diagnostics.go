@@ -3,8 +3,8 @@ package lspserver
 import (
 	"encoding/json"
 	"fmt"
-	"regexp"
 	"github.com/TobiasYin/go-lsp/logs"
+	"regexp"
 )
 
 // See ./prompts/prompt_base.txt
@@ -16,13 +16,22 @@ type LspDiagnostic struct {
 	Severity       string `json:"severity"`
 	Description    string `json:"description"`
 	Recommendation string `json:"recommendation"`
+
+	// Exact range, set by the built-in checks. Columns are 0-based like LSP
+	// positions; EndLine 0 means only LineNumber is known.
+	Column    int `json:"column,omitempty"`
+	EndLine   int `json:"end_line,omitempty"`
+	EndColumn int `json:"end_column,omitempty"`
+
+	// Provider that found the issue, set by the document store
+	Provider string `json:"-"`
 }
 
 /*
  * DiagnosticToPrettyText takes a LspDiagnostic struct and returns a string with the fields formatted
  * @param d The LspDiagnostic struct to format
  * @return ret The formatted string
-*/
+ */
 func DiagnosticToPrettyText(d LspDiagnostic) string {
 	const fmtString string = `
 Source: %s
@@ -38,11 +47,11 @@ Recommendation: %s
  * @param d The LspDiagnostic struct to format
  * @return ret The formatted string
  * @return error Any error that occurred during marshalling
-*/
+ */
 func DiagnosticToJsonMarkup(d LspDiagnostic) (string, error) {
-	
+
 	value, err := json.MarshalIndent(d, "", "  ")
-	
+
 	if err != nil {
 		return "", err
 	}
@@ -50,6 +59,8 @@ func DiagnosticToJsonMarkup(d LspDiagnostic) (string, error) {
 	return fmt.Sprintf("#### diagnostics\n```json\n%s\n```", string(value)), nil
 }
 
+var emptyAnalysisRe = regexp.MustCompile(`^\s*(\[\s*\]\s*)+$`)
+
 /*
  * DiagnosticsUnmarshal takes a JSON object in a string format and unmarshals it into a slice of LspDiagnostic structs
  * @param analysis The string to unmarshal
@@ -57,7 +68,7 @@ func DiagnosticToJsonMarkup(d LspDiagnostic) (string, error) {
  * @return error Any error that occurred during unmarshalling
  */
 
- func DiagnosticsUnmarshal(uri, analysis string) ([]LspDiagnostic, error) {
+func DiagnosticsUnmarshal(uri, analysis string) ([]LspDiagnostic, error) {
 	logs.Printf("Analyse Document: %s", analysis)
 
 	// Define a regular expression to find JSON arrays in the input
@@ -65,6 +76,10 @@ func DiagnosticToJsonMarkup(d LspDiagnostic) (string, error) {
 	matches := re.FindAllString(analysis, -1)
 
 	if len(matches) == 0 {
+		// every rule answered with an empty array, nothing was found
+		if emptyAnalysisRe.MatchString(analysis) {
+			return nil, nil
+		}
 		return nil, fmt.Errorf("no valid JSON array found")
 	}
 
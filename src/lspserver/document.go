@@ -4,25 +4,47 @@ import (
 	"crypto/sha256"
 	"errors"
 	"fmt"
+	"sync"
+
 	"github.com/TobiasYin/go-lsp/logs"
 )
 
 type LspDocuments interface {
 	Load(uri string) (string, error)
 	Store(uri string, data string) error
+	StoreText(uri string, data string)
 	Delete(uri string) error
 	Dump() map[string]string
 	LoadAnalysis(uri string) (string, error)
 	StoreAnalysis(uri string, analysis string) error
 	UpdateDiagnostics(uri string, diagnostics []LspDiagnostic) error
 	GetDiagnostics(uri string) ([]LspDiagnostic, error)
+	UpdateProviderDiagnostics(uri string, provider string, diagnostics []LspDiagnostic) []LspDiagnostic
+	ProviderDiagnostics(uri string) []LspDiagnostic
+	StoreLanguage(uri string, languageID string)
+	LoadLanguage(uri string) string
 }
 
+// Diagnostic providers, each one replaces only its own findings.
+const (
+	DiagnosticProviderStatic   = "static"
+	DiagnosticProviderAnalyzer = "analyzer"
+	DiagnosticProviderLLM      = "llm"
+)
+
+// diagnosticProviders fixes the order findings are merged in.
+var diagnosticProviders = []string{DiagnosticProviderStatic, DiagnosticProviderAnalyzer, DiagnosticProviderLLM}
+
+// lspDocuments is used by the handlers of a session at the same time, every
+// accessor holds the lock.
 type lspDocuments struct {
+	lock        sync.RWMutex
 	data        map[string]string
 	data_hash   map[string][sha256.Size]byte
 	analysis    map[string]string
 	diagnostics map[string][]LspDiagnostic
+	providers   map[string]map[string][]LspDiagnostic
+	languages   map[string]string
 }
 
 func NewLspDocuments() LspDocuments {
@@ -31,11 +53,15 @@ func NewLspDocuments() LspDocuments {
 		data_hash:   make(map[string][sha256.Size]byte),
 		analysis:    make(map[string]string),
 		diagnostics: make(map[string][]LspDiagnostic),
+		providers:   make(map[string]map[string][]LspDiagnostic),
+		languages:   make(map[string]string),
 	}
 }
 
 func (d *lspDocuments) Load(uri string) (string, error) {
 	logs.Printf("[+] Loading Document....")
+	d.lock.RLock()
+	defer d.lock.RUnlock()
 	if d.data[uri] == "" {
 		s := fmt.Sprintf("document (%s) not found", uri)
 		return "", errors.New(s)
@@ -46,6 +72,8 @@ func (d *lspDocuments) Load(uri string) (string, error) {
 func (d *lspDocuments) Store(uri string, data string) error {
 	logs.Printf("[+] Storing Document....")
 	hash := sha256.Sum256([]byte(data))
+	d.lock.Lock()
+	defer d.lock.Unlock()
 	if d.data_hash[uri] == hash {
 		return errors.New("document already stored")
 	}
@@ -55,8 +83,18 @@ func (d *lspDocuments) Store(uri string, data string) error {
 	return nil
 }
 
+// StoreText updates the text of a document without marking it as analysed,
+// e.g. an unsaved buffer, so Store still accepts it for the next analysis.
+func (d *lspDocuments) StoreText(uri string, data string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.data[uri] = data
+}
+
 func (d *lspDocuments) Delete(uri string) error {
 	logs.Printf("[+] Clearing content")
+	d.lock.Lock()
+	defer d.lock.Unlock()
 	delete(d.data, uri)
 	delete(d.data_hash, uri)
 	return nil
@@ -64,17 +102,27 @@ func (d *lspDocuments) Delete(uri string) error {
 
 func (d *lspDocuments) Dump() map[string]string {
 	logs.Printf("[+] Dumping data")
-	return d.data
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	data := make(map[string]string, len(d.data))
+	for uri, text := range d.data {
+		data[uri] = text
+	}
+	return data
 }
 
 func (d *lspDocuments) StoreAnalysis(uri string, analysis string) error {
 	logs.Printf("[+] Storing Analysis")
+	d.lock.Lock()
+	defer d.lock.Unlock()
 	d.analysis[uri] = analysis
 	return nil
 }
 
 func (d *lspDocuments) LoadAnalysis(uri string) (string, error) {
 	logs.Printf("[+] Loading Analysis....")
+	d.lock.RLock()
+	defer d.lock.RUnlock()
 	if d.analysis[uri] == "" {
 		s := fmt.Sprintf("diagnostics (%s) not found", uri)
 		return "", errors.New(s)
@@ -84,6 +132,8 @@ func (d *lspDocuments) LoadAnalysis(uri string) (string, error) {
 
 func (d *lspDocuments) GetDiagnostics(uri string) ([]LspDiagnostic, error) {
 	logs.Printf("[+] GetDiagnostics....")
+	d.lock.RLock()
+	defer d.lock.RUnlock()
 	if d.diagnostics[uri] == nil {
 		s := fmt.Sprintf("diagnostics (%s) not found", uri)
 		return nil, errors.New(s)
@@ -93,10 +143,64 @@ func (d *lspDocuments) GetDiagnostics(uri string) ([]LspDiagnostic, error) {
 }
 
 func (d *lspDocuments) UpdateDiagnostics(uri string, diagnostics []LspDiagnostic) error {
-    logs.Printf("[+] UpdateDiagnostics for URI: %s with %d diagnostics\n", uri, len(diagnostics))
-    for _, diag := range diagnostics {
-        logs.Printf("Diagnostic: Line %d, Message: %s, Severity: %s", diag.LineNumber, diag.Description, diag.Severity)
-    }
-    d.diagnostics[uri] = diagnostics
-    return nil
+	logs.Printf("[+] UpdateDiagnostics for URI: %s with %d diagnostics\n", uri, len(diagnostics))
+	for _, diag := range diagnostics {
+		logs.Printf("Diagnostic: Line %d, Message: %s, Severity: %s", diag.LineNumber, diag.Description, diag.Severity)
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.diagnostics[uri] = diagnostics
+	return nil
+}
+
+/*
+ * UpdateProviderDiagnostics replaces the unfiltered findings of one provider
+ * and returns the findings of all providers. The result still has to go
+ * through UpdateDiagnostics to be reported.
+ * @param uri The document URI
+ * @param provider The provider, e.g. DiagnosticProviderStatic
+ * @param diagnostics The provider's findings
+ * @return diagnostics The findings of every provider
+ */
+func (d *lspDocuments) UpdateProviderDiagnostics(uri string, provider string, diagnostics []LspDiagnostic) []LspDiagnostic {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.providers[uri] == nil {
+		d.providers[uri] = make(map[string][]LspDiagnostic)
+	}
+	for i := range diagnostics {
+		diagnostics[i].Provider = provider
+	}
+	d.providers[uri][provider] = diagnostics
+
+	var all []LspDiagnostic
+	for _, name := range diagnosticProviders {
+		all = append(all, d.providers[uri][name]...)
+	}
+	return all
+}
+
+// ProviderDiagnostics returns the unfiltered findings of every provider.
+func (d *lspDocuments) ProviderDiagnostics(uri string) []LspDiagnostic {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	var all []LspDiagnostic
+	for _, name := range diagnosticProviders {
+		all = append(all, d.providers[uri][name]...)
+	}
+	return all
+}
+
+// StoreLanguage remembers the languageId the client opened the document with.
+func (d *lspDocuments) StoreLanguage(uri string, languageID string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.languages[uri] = languageID
+}
+
+// LoadLanguage returns the document's languageId, empty if it is unknown.
+func (d *lspDocuments) LoadLanguage(uri string) string {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	return d.languages[uri]
 }
@@ -0,0 +1,197 @@
+package lspserver
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/TobiasYin/go-lsp/lsp/defines"
+)
+
+var fencedCodeRe = regexp.MustCompile("(?s)```[A-Za-z0-9_+#.-]*[ \t]*\r?\n(.*?)\r?\n?```")
+
+// maxDiffCells bounds the LCS table, larger regions become a single hunk.
+const maxDiffCells = 4000000
+
+/*
+ * ExtractCode returns the code in a model response. The longest fenced code
+ * block wins; a response without fences is taken as code as it is.
+ * @param response The raw model response
+ * @return code The code without fences and surrounding prose
+ */
+func ExtractCode(response string) string {
+	best := ""
+	found := false
+	for _, m := range fencedCodeRe.FindAllStringSubmatch(response, -1) {
+		if !found || len(m[1]) > len(best) {
+			best = m[1]
+			found = true
+		}
+	}
+	if found {
+		return best
+	}
+	return strings.Trim(response, "\r\n")
+}
+
+// lineHunk is a run of changed lines. OldStart is the 0-based index of the
+// first removed line (or of the line the added lines go in front of).
+type lineHunk struct {
+	OldStart int
+	Removed  []string
+	Added    []string
+}
+
+// diffLines computes the changed runs between two line slices from their
+// longest common subsequence.
+func diffLines(a []string, b []string) []lineHunk {
+	// strip the common prefix and suffix, they are the usual case
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	a, b = a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	if len(a) == 0 && len(b) == 0 {
+		return nil
+	}
+	if len(a)*len(b) > maxDiffCells || len(a) == 0 || len(b) == 0 {
+		return []lineHunk{{OldStart: prefix, Removed: a, Added: b}}
+	}
+
+	// lcs[i][j] is the LCS length of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var hunks []lineHunk
+	var current *lineHunk
+	open := func(i int) {
+		if current == nil {
+			hunks = append(hunks, lineHunk{OldStart: prefix + i})
+			current = &hunks[len(hunks)-1]
+		}
+	}
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			current = nil
+			i++
+			j++
+		case j < len(b) && (i == len(a) || lcs[i][j+1] >= lcs[i+1][j]):
+			open(i)
+			current.Added = append(current.Added, b[j])
+			j++
+		default:
+			open(i)
+			current.Removed = append(current.Removed, a[i])
+			i++
+		}
+	}
+	return hunks
+}
+
+/*
+ * MinimalEdits compares the original lines of a region with their
+ * replacement and returns one edit per run of changed lines, so unchanged
+ * lines (and the editor's markers on them) are left alone.
+ * @param original The original text of the region (whole lines)
+ * @param replacement The new text of the region
+ * @param startLine The 1-based line the region starts on
+ * @return edits The edits, empty if the texts are the same line for line
+ */
+func MinimalEdits(original string, replacement string, startLine int) []defines.TextEdit {
+	var edits []defines.TextEdit
+	lines := splitRegion(original)
+	for _, hunk := range diffLines(lines, splitRegion(replacement)) {
+		first := uint(startLine - 1 + hunk.OldStart)
+		// hunks at the end of the region are anchored to the end of the line
+		// before them, the region may end the document without a newline
+		atEnd := hunk.OldStart > 0 && hunk.OldStart+len(hunk.Removed) == len(lines)
+		previous := defines.Position{}
+		if atEnd {
+			previous = defines.Position{Line: first - 1, Character: uint(utf16Len(lines[hunk.OldStart-1]))}
+		}
+		switch {
+		case len(hunk.Removed) == 0 && atEnd:
+			// pure insertion after the last line
+			edits = append(edits, defines.TextEdit{
+				Range:   defines.Range{Start: previous, End: previous},
+				NewText: "\n" + strings.Join(hunk.Added, "\n"),
+			})
+		case len(hunk.Added) == 0 && atEnd:
+			// pure deletion of the last lines with the newline before them
+			last := hunk.Removed[len(hunk.Removed)-1]
+			edits = append(edits, defines.TextEdit{
+				Range: defines.Range{
+					Start: previous,
+					End:   defines.Position{Line: first + uint(len(hunk.Removed)-1), Character: uint(utf16Len(last))},
+				},
+			})
+		case len(hunk.Removed) == 0:
+			// pure insertion in front of the next unchanged line
+			edits = append(edits, defines.TextEdit{
+				Range:   defines.Range{Start: defines.Position{Line: first}, End: defines.Position{Line: first}},
+				NewText: strings.Join(hunk.Added, "\n") + "\n",
+			})
+		case len(hunk.Added) == 0:
+			// pure deletion of whole lines
+			edits = append(edits, defines.TextEdit{
+				Range: defines.Range{
+					Start: defines.Position{Line: first},
+					End:   defines.Position{Line: first + uint(len(hunk.Removed))},
+				},
+			})
+		default:
+			last := hunk.Removed[len(hunk.Removed)-1]
+			edits = append(edits, defines.TextEdit{
+				Range: defines.Range{
+					Start: defines.Position{Line: first},
+					End:   defines.Position{Line: first + uint(len(hunk.Removed)-1), Character: uint(utf16Len(last))},
+				},
+				NewText: strings.Join(hunk.Added, "\n"),
+			})
+		}
+	}
+	return edits
+}
+
+// splitRegion splits text into lines without a trailing empty line and
+// without carriage returns.
+func splitRegion(text string) []string {
+	lines := strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+	for i := range lines {
+		lines[i] = strings.TrimSuffix(lines[i], "\r")
+	}
+	return lines
+}
+
+// lineRange returns the 1-based lines start..end of text joined by "\n".
+func lineRange(text string, start int, end int) string {
+	lines := strings.Split(text, "\n")
+	if start < 1 {
+		start = 1
+	}
+	if end > len(lines) {
+		end = len(lines)
+	}
+	if start > end {
+		return ""
+	}
+	return strings.Join(lines[start-1:end], "\n")
+}
@@ -0,0 +1,73 @@
+package lspserver
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMinimalEdits(t *testing.T) {
+	tests := []struct {
+		name        string
+		document    string
+		start, end  int // 1-based lines of the region
+		replacement string
+		want        string
+		edits       int
+	}{
+		{"unchanged", "a\nb\nc\n", 1, 3, "a\nb\nc", "a\nb\nc\n", 0},
+		{"change a line", "a\nb\nc\n", 1, 3, "a\nB\nc", "a\nB\nc\n", 1},
+		{"insert a line", "a\nb\nc\n", 1, 3, "a\nb\nx\nc", "a\nb\nx\nc\n", 1},
+		{"delete a line", "a\nb\nc\n", 1, 3, "a\nc", "a\nc\n", 1},
+		{"two separate changes", "a\nb\nc\nd\ne\n", 1, 5, "A\nb\nc\nd\nE", "A\nb\nc\nd\nE\n", 2},
+		{"region in the middle", "0\na\nb\nz\n", 2, 3, "a\nb\nc", "0\na\nb\nc\nz\n", 1},
+		{"append at the end", "a\nb\n", 1, 2, "a\nb\nc", "a\nb\nc\n", 1},
+		{"append at the end without newline", "a\nb", 1, 2, "a\nb\nc", "a\nb\nc", 1},
+		{"delete the last line without newline", "a\nb\nc", 1, 3, "a\nb", "a\nb", 1},
+		{"delete the last lines", "x\na\nb\nc\n", 2, 4, "a", "x\na\n", 1},
+		{"replace the last line without newline", "a\nb", 1, 2, "a\nB", "a\nB", 1},
+		{"insert at the start", "a\nb", 1, 2, "x\na\nb", "x\na\nb", 1},
+		{"utf-16 end of line", "ä😀\nb", 1, 2, "x\nb", "x\nb", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			original := lineRange(tt.document, tt.start, tt.end)
+			edits := MinimalEdits(original, tt.replacement, tt.start)
+			if len(edits) != tt.edits {
+				t.Errorf("got %d edits, want %d: %+v", len(edits), tt.edits, edits)
+			}
+			lines := uint(strings.Count(tt.document, "\n") + 1)
+			for _, e := range edits {
+				if e.Range.Start.Line >= lines || e.Range.End.Line >= lines {
+					t.Errorf("edit %+v is past the end of the %d lines", e.Range, lines)
+				}
+			}
+			got, err := ApplyEdits(tt.document, edits)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("edited document = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtractCode(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+		want     string
+	}{
+		{"fenced", "Here:\n```c\nint x;\n```\nDone.", "int x;"},
+		{"longest block wins", "```\na\n```\ntext\n```c\nint b;\nint c;\n```", "int b;\nint c;"},
+		{"no fences", "\nint x;\n", "int x;"},
+		{"crlf", "```c\r\nint x;\r\n```", "int x;"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ExtractCode(tt.response); got != tt.want {
+				t.Errorf("ExtractCode = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
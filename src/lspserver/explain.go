@@ -0,0 +1,262 @@
+package lspserver
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"strings"
+
+	"github.com/TobiasYin/go-lsp/logs"
+	"github.com/TobiasYin/go-lsp/lsp/defines"
+)
+
+// explainContextLines around a finding are sent with an explanation request.
+const explainContextLines = 10
+
+/*
+ * ExplanationMarkdown renders a finding for the hover: the finding, the rule
+ * text and rationale and the examples of the rule pack, followed by the
+ * model's explanation when one was requested.
+ * @param d The finding
+ * @param rule The rule of the finding, nil if no rule pack has it
+ * @param language The language of the examples' code blocks
+ * @param reasoning The model's explanation, may be empty
+ * @return markdown The hover text
+ */
+func ExplanationMarkdown(d LspDiagnostic, rule *Rule, language string, reasoning string) string {
+	var b strings.Builder
+
+	title := d.Rule
+	if rule != nil && rule.Title != "" {
+		title += ": " + rule.Title
+	}
+	fmt.Fprintf(&b, "### %s\n", title)
+
+	var meta []string
+	if d.Severity != "" {
+		meta = append(meta, "**Severity:** "+d.Severity)
+	}
+	if d.Source != "" {
+		meta = append(meta, "**Source:** "+d.Source)
+	}
+	if rule != nil && rule.Standard != "" {
+		meta = append(meta, "**Standard:** "+rule.Standard)
+	}
+	if len(meta) > 0 {
+		b.WriteString(strings.Join(meta, " · ") + "\n\n")
+	}
+	if d.Description != "" {
+		b.WriteString(d.Description + "\n\n")
+	}
+
+	if rule != nil {
+		if rule.Description != "" {
+			fmt.Fprintf(&b, "**Rule:** %s\n\n", rule.Description)
+		}
+		if rule.Rationale != "" {
+			fmt.Fprintf(&b, "**Rationale:** %s\n\n", rule.Rationale)
+		}
+	}
+	if d.Recommendation != "" && (rule == nil || d.Recommendation != rule.Description) {
+		fmt.Fprintf(&b, "**Recommendation:** %s\n\n", d.Recommendation)
+	}
+
+	if rule != nil {
+		for _, example := range rule.Examples {
+			if example.NonCompliant != "" {
+				fmt.Fprintf(&b, "#### Non-compliant\n```%s\n%s\n```\n", language, strings.TrimRight(example.NonCompliant, "\n"))
+			}
+			if example.Compliant != "" {
+				fmt.Fprintf(&b, "#### Compliant\n```%s\n%s\n```\n", language, strings.TrimRight(example.Compliant, "\n"))
+			}
+		}
+	}
+
+	if reasoning != "" {
+		fmt.Fprintf(&b, "#### Explanation\n%s\n", strings.TrimSpace(reasoning))
+	}
+	return strings.TrimRight(b.String(), "\n")
+}
+
+// explanationKey identifies a finding in the explanation cache by the model,
+// its rule, its line and a hash of the code sent with the request, so an
+// explanation isn't shown anymore once that code changed.
+func explanationKey(model string, uri string, text string, d LspDiagnostic) string {
+	code, _, _ := codeAround(text, d.LineNumber, explainContextLines)
+	return fmt.Sprintf("%s\x00%s\x00%s:%d\x00%x", uri, model, d.Rule, d.LineNumber, sha256.Sum256([]byte(code)))
+}
+
+// explanation returns the cached explanation of a finding by the session's model.
+func (l *lspServer) explanation(state *sessionState, uri string, text string, d LspDiagnostic) string {
+	if value, ok := l.explanations.Load(explanationKey(state.model(), uri, text, d)); ok {
+		return value.(string)
+	}
+	return ""
+}
+
+/*
+ * explainFinding asks the backend why a finding is an issue, with the code
+ * around it and the rule text, and caches the answer for the hover.
+ * @param ctx The context of the request
+ * @param state The state of the session
+ * @param uri The document URI
+ * @param text The document content
+ * @param d The finding
+ * @return explanation The model's explanation
+ * @return error Any error that occurred while asking the backend
+ */
+func (l *lspServer) explainFinding(ctx context.Context, state *sessionState, uri string, text string, d LspDiagnostic) (string, error) {
+	if cached := l.explanation(state, uri, text, d); cached != "" {
+		return cached, nil
+	}
+
+	code, start, _ := codeAround(text, d.LineNumber, explainContextLines)
+	ruleText := ""
+	if r, ok := l.documentRules(state, uri).Lookup(d.Rule); ok {
+		ruleText = r.Title + ": " + r.Description
+	}
+
+	profile, standard := l.promptTarget(state, uri, []LspDiagnostic{d})
+	explanation, err := l.backend.ExplainFinding(state.backendContext(ctx), uri, profile, standard, code, start, d, ruleText)
+	if err != nil {
+		return "", err
+	}
+	l.explanations.Store(explanationKey(state.model(), uri, text, d), explanation)
+	return explanation, nil
+}
+
+/*
+ * hoverMarkdown renders every finding on a line for the hover, separated by
+ * rules.
+ * @param state The state of the session
+ * @param uri The document URI
+ * @param text The document content
+ * @param diagnostics The findings on the line
+ * @return markdown The hover text, empty without findings
+ */
+func (l *lspServer) hoverMarkdown(state *sessionState, uri string, text string, diagnostics []LspDiagnostic) string {
+	rules := l.documentRules(state, uri)
+	language := ""
+	if profile, ok := state.profile(uri); ok {
+		language = profile.LanguageID
+	}
+
+	var sections []string
+	for _, d := range diagnostics {
+		var rule *Rule
+		if r, ok := rules.Lookup(d.Rule); ok {
+			rule = &r
+		}
+		sections = append(sections, ExplanationMarkdown(d, rule, language, l.explanation(state, uri, text, d)))
+	}
+	return strings.Join(sections, "\n\n---\n\n")
+}
+
+// explainCommand runs fuzzlsp.explainLine for the first line of the range.
+func (l *lspServer) explainCommand(uri defines.DocumentUri, actionRange defines.Range) *defines.Command {
+	return &defines.Command{
+		Title:     "Explain issue",
+		Command:   CommandExplainLine,
+		Arguments: &[]interface{}{uri, actionRange.Start.Line + 1},
+	}
+}
+
+/*
+ * explainFindings requests the model's explanation of every finding on a
+ * line.
+ * @param ctx The context of the request
+ * @param state The state of the session
+ * @param uri The document URI
+ * @param text The document content
+ * @param line The line, counted from 1
+ * @return findings The findings on the line
+ * @return explanations The explanation of each finding
+ * @return error No findings on the line or a backend error
+ */
+func (l *lspServer) explainFindings(ctx context.Context, state *sessionState, uri string, text string, line int) ([]LspDiagnostic, []string, error) {
+	diagnostics, err := state.documents.GetDiagnostics(uri)
+	if err != nil {
+		return nil, nil, err
+	}
+	findings := diagnosticsIn(diagnostics, line, line)
+	if len(findings) == 0 {
+		return nil, nil, fmt.Errorf("no findings on line %d", line)
+	}
+
+	explanations := make([]string, 0, len(findings))
+	for _, d := range findings {
+		explanation, err := l.explainFinding(ctx, state, uri, text, d)
+		if err != nil {
+			logs.Printf("LLM error for explanation: %v", err)
+			return nil, nil, err
+		}
+		explanations = append(explanations, explanation)
+	}
+	return findings, explanations, nil
+}
+
+/*
+ * explainLine runs fuzzlsp.explainLine, the command of the "Explain issue"
+ * action. The explanation is returned for window/showMessage and is shown by
+ * the hover of the line afterwards.
+ * @param ctx The context of the request
+ * @param uri The document URI
+ * @param line The line, counted from 1
+ * @return message The explanation of every finding on the line
+ * @return error Any error that occurred while explaining
+ */
+func (l *lspServer) explainLine(ctx context.Context, uri string, line int) (string, error) {
+	state := l.state(ctx)
+	text, err := l.documentText(state, uri)
+	if err != nil {
+		return "", err
+	}
+	findings, explanations, err := l.explainFindings(ctx, state, uri, text, line)
+	if err != nil {
+		return "", err
+	}
+	messages := make([]string, len(findings))
+	for i, d := range findings {
+		messages[i] = fmt.Sprintf("%s on line %d: %s", d.Rule, d.LineNumber, strings.TrimSpace(explanations[i]))
+	}
+	return strings.Join(messages, "\n\n"), nil
+}
+
+/*
+ * resolveExplanation resolves the opt-in "Insert explanation as comment"
+ * action of -explain-comments, it inserts the model's explanation of the
+ * findings on the action's line above the line.
+ * @param ctx The context of the request
+ * @param state The state of the session
+ * @param req The code action to resolve
+ * @param uri The document URI
+ * @param text The document content
+ * @param actionRange The range the action was requested for
+ * @return action The action with the edit inserting the comment
+ * @return error Any error that occurred while explaining
+ */
+func (l *lspServer) resolveExplanation(ctx context.Context, state *sessionState, req *defines.CodeAction, uri string, text string, actionRange defines.Range) (*defines.CodeAction, error) {
+	line := int(actionRange.Start.Line) + 1
+	_, explanations, err := l.explainFindings(ctx, state, uri, text, line)
+	if err != nil {
+		return nil, err
+	}
+
+	// Insert the explanation as a comment above the line, in the document's comment syntax
+	profile, ok := state.profile(uri)
+	if !ok {
+		profile, _ = ProfileFor("c", "")
+	}
+	lines := strings.Split(text, "\n")
+	lineText := strings.TrimSuffix(lines[line-1], "\r")
+	indent := lineText[:len(lineText)-len(strings.TrimLeft(lineText, " \t"))]
+	comment := profile.Comment(strings.TrimSpace(strings.Join(explanations, "\n")))
+	comment = indent + strings.ReplaceAll(comment, "\n", "\n"+indent)
+
+	position := defines.Position{Line: actionRange.Start.Line}
+	changes := map[string][]defines.TextEdit{
+		uri: {{Range: defines.Range{Start: position, End: position}, NewText: comment + "\n"}},
+	}
+	req.Edit = &defines.WorkspaceEdit{Changes: &changes}
+	return req, nil
+}
@@ -0,0 +1,185 @@
+package lspserver
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestExplanationMarkdown(t *testing.T) {
+	d := LspDiagnostic{Rule: "MISRA-15.5", Severity: "warning", Source: "FuzzLSP", Description: "Early return", Recommendation: "Use one exit"}
+	rule := &Rule{
+		ID:          "MISRA-15.5",
+		Title:       "Single point of exit",
+		Standard:    "MISRA C:2012",
+		Description: "A function should have a single point of exit",
+		Rationale:   "Easier to verify",
+		Examples:    []RuleExample{{NonCompliant: "return 1;\n", Compliant: "r = 1;"}},
+	}
+	tests := []struct {
+		name      string
+		rule      *Rule
+		reasoning string
+		want      []string
+		not       []string
+	}{
+		{
+			name: "without rule",
+			want: []string{"### MISRA-15.5\n", "**Severity:** warning · **Source:** FuzzLSP", "Early return", "**Recommendation:** Use one exit"},
+			not:  []string{"**Rule:**", "#### Explanation"},
+		},
+		{
+			name: "with rule",
+			rule: rule,
+			want: []string{"### MISRA-15.5: Single point of exit\n", "**Standard:** MISRA C:2012", "**Rule:** A function should have a single point of exit",
+				"**Rationale:** Easier to verify", "#### Non-compliant\n```c\nreturn 1;\n```", "#### Compliant\n```c\nr = 1;\n```"},
+			not: []string{"#### Explanation"},
+		},
+		{
+			name:      "with explanation",
+			rule:      rule,
+			reasoning: "  The function returns twice.\n",
+			want:      []string{"#### Explanation\nThe function returns twice."},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ExplanationMarkdown(d, tt.rule, "c", tt.reasoning)
+			for _, want := range tt.want {
+				if !strings.Contains(got, want) {
+					t.Errorf("missing %q in\n%s", want, got)
+				}
+			}
+			for _, not := range tt.not {
+				if strings.Contains(got, not) {
+					t.Errorf("unexpected %q in\n%s", not, got)
+				}
+			}
+		})
+	}
+}
+
+// explainCounter is the region backend counting the explanations asked for.
+type explainCounter struct {
+	*regionBackend
+	explained int32
+}
+
+func (b *explainCounter) ExplainFinding(ctx context.Context, uri string, profile *LanguageProfile, standard string, code string, startLine int, finding LspDiagnostic, rule string) (string, error) {
+	atomic.AddInt32(&b.explained, 1)
+	return "Line " + finding.Description + " returns early.", nil
+}
+
+func TestExplainAction(t *testing.T) {
+	l := newTestServer(t)
+	backend := &explainCounter{regionBackend: &regionBackend{LspBackend: l.backend}}
+	l.backend = backend
+	c := connectTestClient(t, l, nil)
+	root := t.TempDir()
+	c.initialize(root, `{}`)
+	uri := "file://" + root + "/a.c"
+	c.open(uri, "int f(int x)\n{\n    if (x)\n        return early;\n    return 0;\n}\n")
+	waitFor(t, "the analysis", func() bool { return analysedSessions(l, uri) == 1 })
+
+	var actions []json.RawMessage
+	params := map[string]interface{}{
+		"textDocument": map[string]string{"uri": uri},
+		"range":        map[string]interface{}{"start": map[string]int{"line": 3, "character": 0}, "end": map[string]int{"line": 3, "character": 0}},
+		"context":      map[string]interface{}{"diagnostics": []interface{}{}},
+	}
+	if err := c.request("textDocument/codeAction", params, &actions); err != nil {
+		t.Fatal(err)
+	}
+	var explain json.RawMessage
+	for _, action := range actions {
+		if strings.Contains(string(action), "Explain issue") {
+			explain = action
+		}
+	}
+	if explain == nil {
+		t.Fatalf("no explain action in %s", actions)
+	}
+	var action struct {
+		Command struct {
+			Command   string        `json:"command"`
+			Arguments []interface{} `json:"arguments"`
+		} `json:"command"`
+		Data interface{} `json:"data"`
+	}
+	if err := json.Unmarshal(explain, &action); err != nil {
+		t.Fatal(err)
+	}
+	if action.Command.Command != CommandExplainLine || action.Data != nil {
+		t.Fatalf("explain action %s, want the %s command", explain, CommandExplainLine)
+	}
+
+	// Resolving the action, as clients do before showing it, asks nothing
+	if err := c.request("codeAction/resolve", json.RawMessage(explain), nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&backend.explained); n != 0 {
+		t.Errorf("resolving asked for %d explanations", n)
+	}
+
+	// Running its command shows the explanation and adds it to the hover
+	if err := executeCommand(c, action.Command.Command, action.Command.Arguments...); err != nil {
+		t.Fatal(err)
+	}
+	if got := shownMessage(t, c); !strings.HasPrefix(got, "MISRA-15.5 on line 4: Line") {
+		t.Errorf("message = %q", got)
+	}
+	var hover struct {
+		Contents struct {
+			Value string `json:"value"`
+		} `json:"contents"`
+	}
+	hoverParams := map[string]interface{}{
+		"textDocument": map[string]string{"uri": uri},
+		"position":     map[string]int{"line": 3, "character": 8},
+	}
+	if err := c.request("textDocument/hover", hoverParams, &hover); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(hover.Contents.Value, "#### Explanation\nLine") {
+		t.Errorf("hover without the explanation:\n%s", hover.Contents.Value)
+	}
+
+	// Explanations are cached
+	if err := executeCommand(c, CommandExplainLine, uri, 4); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&backend.explained); n != 1 {
+		t.Errorf("asked for %d explanations, want 1", n)
+	}
+}
+
+func TestExplainLineArguments(t *testing.T) {
+	l := newTestServer(t)
+	c := connectTestClient(t, l, nil)
+	root := t.TempDir()
+	c.initialize(root, `{}`)
+	uri := "file://" + root + "/a.c"
+	c.open(uri, "int a;\n")
+	waitFor(t, "the analysis", func() bool { return analysedSessions(l, uri) == 1 })
+
+	tests := []struct {
+		name string
+		args []interface{}
+		want string
+	}{
+		{"no line", []interface{}{uri}, "needs the document URI and line"},
+		{"line 0", []interface{}{uri, 0}, "needs the document URI and line"},
+		{"fraction", []interface{}{uri, 1.5}, "needs the document URI and line"},
+		{"no findings", []interface{}{uri, 1}, "diagnostics (" + uri + ") not found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := executeCommand(c, CommandExplainLine, tt.args...)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
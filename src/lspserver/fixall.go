@@ -0,0 +1,219 @@
+package lspserver
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/TobiasYin/go-lsp/logs"
+	"github.com/TobiasYin/go-lsp/lsp/defines"
+)
+
+// CodeActionKindFixAll is the kind of the action fixing every finding of a
+// file, editors can run it on save with "source.fixAll.fuzzlsp".
+const CodeActionKindFixAll = defines.CodeActionKindSourceFixAll + ".fuzzlsp"
+
+// fixGroup is a region of a document fixed with a single backend request.
+// Lines are 1-based and inclusive.
+type fixGroup struct {
+	StartLine int
+	EndLine   int
+	Findings  []LspDiagnostic
+}
+
+/*
+ * fixAllActions offers the source.fixAll.fuzzlsp action for the whole file
+ * and a "Fix all <rule> in file" action for every rule of the relevant
+ * findings that occurs more than once in the file.
+ * @param uri The document URI
+ * @param relevant The findings the code action request is about
+ * @param all The findings of the document
+ * @return actions The fix-all actions, resolved by resolveFixAll
+ */
+func fixAllActions(uri defines.DocumentUri, relevant []LspDiagnostic, all []LspDiagnostic) []defines.CodeAction {
+	var actions []defines.CodeAction
+	if len(all) == 0 {
+		return actions
+	}
+
+	count := make(map[string]int)
+	for _, d := range all {
+		count[d.Rule]++
+	}
+	quickKind := defines.CodeActionKindQuickFix
+	var offered []string
+	for _, d := range relevant {
+		if count[d.Rule] < 2 || containsString(offered, d.Rule) {
+			continue
+		}
+		offered = append(offered, d.Rule)
+		actions = append(actions, defines.CodeAction{
+			Title: fmt.Sprintf("Fix all %s in file (%d) [FuzzLSP]", d.Rule, count[d.Rule]),
+			Kind:  &quickKind,
+			Data: map[string]interface{}{
+				"uri":    uri,
+				"fixAll": true,
+				"rule":   d.Rule,
+			},
+		})
+	}
+
+	fixAllKind := CodeActionKindFixAll
+	actions = append(actions, defines.CodeAction{
+		Title: fmt.Sprintf("Fix all findings in file (%d) [FuzzLSP]", len(all)),
+		Kind:  &fixAllKind,
+		Data: map[string]interface{}{
+			"uri":    uri,
+			"fixAll": true,
+		},
+	})
+	return actions
+}
+
+/*
+ * resolveFixAll fixes the findings of a document, optionally only those of
+ * one rule. The findings are grouped by the function they are in, every
+ * group is fixed with one backend request and the edits of all groups are
+ * returned in a single WorkspaceEdit. Findings that could not be fixed are
+ * reported to the user with window/showMessage.
+ * @param ctx The context of the request
+ * @param req The code action to resolve
+ * @param uri The document URI
+ * @param rule The rule to fix, empty for every finding
+ * @return action The action with its edit
+ * @return error Any error that occurred, or none of the findings was fixed
+ */
+func (l *lspServer) resolveFixAll(ctx context.Context, req *defines.CodeAction, uri string, rule string) (*defines.CodeAction, error) {
+	state := l.state(ctx)
+	diagnostics, err := state.documents.GetDiagnostics(uri)
+	if err != nil {
+		return nil, err
+	}
+	var findings []LspDiagnostic
+	for _, d := range diagnostics {
+		if rule == "" || d.Rule == rule {
+			findings = append(findings, d)
+		}
+	}
+	if len(findings) == 0 {
+		return nil, fmt.Errorf("no findings to fix in %s", uri)
+	}
+
+	text, err := l.documentText(state, uri)
+	if err != nil {
+		logs.Printf("Error loading document content: %s", err)
+		return nil, err
+	}
+	profile, _ := l.promptTarget(state, uri, nil)
+
+	var edits []defines.TextEdit
+	var unfixed []LspDiagnostic
+	for _, group := range l.groupFindings(state, uri, text, findings) {
+		code := lineRange(text, group.StartLine, group.EndLine)
+		_, standard := l.promptTarget(state, uri, group.Findings)
+		response, err := l.backend.FixFindings(state.backendContext(ctx), uri, profile, standard, code, group.StartLine, group.Findings, l.rulesPromptText(state, uri, group.Findings))
+		if err != nil {
+			logs.Printf("LLM error fixing lines %d-%d: %v", group.StartLine, group.EndLine, err)
+			unfixed = append(unfixed, group.Findings...)
+			continue
+		}
+		refactoring, err := BuildRefactoring(uri, profile, code, group.StartLine, response)
+		if err != nil || len(refactoring.Edits) == 0 {
+			logs.Printf("No usable fix for lines %d-%d: %v", group.StartLine, group.EndLine, err)
+			unfixed = append(unfixed, group.Findings...)
+			continue
+		}
+		logs.Printf("[+] Fix for lines %d-%d:\n%s", group.StartLine, group.EndLine, refactoring.Diff)
+
+		verification, err := l.checkFix(ctx, state, uri, text, refactoring, group.Findings)
+		if err != nil {
+			logs.Printf("%v", err)
+			unfixed = append(unfixed, group.Findings...)
+			continue
+		}
+		unfixed = append(unfixed, verification.Remaining...)
+		edits = append(edits, refactoring.Edits...)
+	}
+
+	if len(unfixed) > 0 {
+		l.reportUnfixed(ctx, state, uri, unfixed, len(findings))
+	}
+	if len(edits) == 0 {
+		return nil, fmt.Errorf("none of the %d findings could be fixed", len(findings))
+	}
+
+	changes := map[string][]defines.TextEdit{uri: edits}
+	req.Edit = &defines.WorkspaceEdit{Changes: &changes}
+	return req, nil
+}
+
+/*
+ * groupFindings puts findings in the same function (or in overlapping
+ * regions outside of functions) into one group. The groups don't overlap,
+ * so their edits can be merged into one WorkspaceEdit.
+ * @param state The state of the session
+ * @param uri The document URI
+ * @param text The document content
+ * @param findings The findings to group
+ * @return groups The groups in document order
+ */
+func (l *lspServer) groupFindings(state *sessionState, uri string, text string, findings []LspDiagnostic) []fixGroup {
+	var groups []fixGroup
+	for _, d := range findings {
+		start, end := l.fixRegion(state, uri, text, d.LineNumber)
+		groups = append(groups, fixGroup{StartLine: start, EndLine: end, Findings: []LspDiagnostic{d}})
+	}
+	sort.SliceStable(groups, func(i, j int) bool {
+		return groups[i].StartLine < groups[j].StartLine
+	})
+
+	var merged []fixGroup
+	for _, g := range groups {
+		if n := len(merged); n > 0 && g.StartLine <= merged[n-1].EndLine {
+			last := &merged[n-1]
+			last.EndLine = max(last.EndLine, g.EndLine)
+			last.Findings = append(last.Findings, g.Findings...)
+			continue
+		}
+		merged = append(merged, g)
+	}
+	return merged
+}
+
+// reportUnfixed tells the user which findings the fix-all action left alone.
+func (l *lspServer) reportUnfixed(ctx context.Context, state *sessionState, uri string, unfixed []LspDiagnostic, total int) {
+	var items []string
+	for _, d := range unfixed {
+		items = append(items, fmt.Sprintf("%s (line %d)", d.Rule, d.LineNumber))
+	}
+	message := fmt.Sprintf("FuzzLSP could not fix %d of %d findings in %s: %s",
+		len(unfixed), total, state.relativePath(uri), strings.Join(items, ", "))
+	l.showMessage(ctx, defines.MessageTypeWarning, message)
+}
+
+/*
+ * filterActions drops the actions the client did not ask for with the
+ * "only" field of the code action context.
+ * @param actions The actions
+ * @param only The requested kinds, nil for all
+ * @return actions The actions of a requested kind or a sub-kind of one
+ */
+func filterActions(actions []defines.CodeAction, only *[]defines.CodeActionKind) []defines.CodeAction {
+	if only == nil || len(*only) == 0 {
+		return actions
+	}
+	var filtered []defines.CodeAction
+	for _, action := range actions {
+		if action.Kind == nil {
+			continue
+		}
+		for _, kind := range *only {
+			if *action.Kind == kind || strings.HasPrefix(string(*action.Kind), string(kind)+".") {
+				filtered = append(filtered, action)
+				break
+			}
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,113 @@
+package lspserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/TobiasYin/go-lsp/lsp/defines"
+)
+
+func TestGroupFindings(t *testing.T) {
+	c := "int f(int x)\n{\n    x++;\n    x++;\n    return x;\n}\n\nint g(int x)\n{\n    x--;\n    x--;\n    return x;\n}\n"
+	python := strings.Repeat("x = 1\n", 70)
+	tests := []struct {
+		name  string
+		uri   string
+		text  string
+		lines []int
+		want  string
+	}{
+		{"one group per function", "file:///a.c", c, []int{10, 3, 12, 5}, "[1-6 3,5] [8-13 10,12]"},
+		{"same line twice", "file:///a.c", c, []int{4, 4}, "[1-6 4,4]"},
+		{"overlapping regions", "file:///a.py", python, []int{50, 20, 5}, "[1-30 5,20] [40-60 50]"},
+		{"adjacent regions", "file:///a.py", python, []int{11, 32}, "[1-21 11] [22-42 32]"},
+		{"outside of functions", "file:///a.c", c + strings.Repeat("int v;\n", 30), []int{30, 3}, "[1-6 3] [20-40 30]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newTestServer(t)
+			var findings []LspDiagnostic
+			for _, line := range tt.lines {
+				findings = append(findings, finding("R", line))
+			}
+			var got []string
+			for _, g := range l.groupFindings(newSessionState(), tt.uri, tt.text, findings) {
+				var lines []string
+				for _, d := range g.Findings {
+					lines = append(lines, fmt.Sprint(d.LineNumber))
+				}
+				got = append(got, fmt.Sprintf("[%d-%d %s]", g.StartLine, g.EndLine, strings.Join(lines, ",")))
+			}
+			if strings.Join(got, " ") != tt.want {
+				t.Errorf("groups %s, want %s", strings.Join(got, " "), tt.want)
+			}
+		})
+	}
+}
+
+// fixingBackend is the region backend fixing every early return, one fix
+// request per group.
+type fixingBackend struct {
+	*regionBackend
+	fixed []int // the first line of every fixed region
+}
+
+func (b *fixingBackend) FixFindings(ctx context.Context, uri string, profile *LanguageProfile, standard string, code string, startLine int, findings []LspDiagnostic, rules string) (string, error) {
+	b.lock.Lock()
+	b.fixed = append(b.fixed, startLine)
+	b.lock.Unlock()
+	return "```c\n" + strings.ReplaceAll(code, "return early;", "r = early;") + "\n```", nil
+}
+
+func TestFixAll(t *testing.T) {
+	l := newTestServer(t)
+	backend := &fixingBackend{regionBackend: &regionBackend{}}
+	backend.LspBackend = l.backend
+	l.backend = backend
+	c := connectTestClient(t, l, nil)
+	root := t.TempDir()
+	c.initialize(root, `{}`)
+	uri := "file://" + root + "/a.c"
+	text := "int f(int x)\n{\n    if (x) {\n        return early;\n    }\n    if (!x) {\n        return early;\n    }\n    return 0;\n}\n\n" +
+		"int g(int x)\n{\n    if (x) {\n        return early;\n    }\n    return 0;\n}\n"
+	c.open(uri, text)
+	waitFor(t, "the analysis", func() bool { return analysedSessions(l, uri) == 1 })
+
+	var actions []defines.CodeAction
+	params := map[string]interface{}{
+		"textDocument": map[string]string{"uri": uri},
+		"range":        map[string]interface{}{"start": map[string]int{"line": 0, "character": 0}, "end": map[string]int{"line": 0, "character": 0}},
+		"context":      map[string]interface{}{"diagnostics": []interface{}{}, "only": []string{string(CodeActionKindFixAll)}},
+	}
+	if err := c.request("textDocument/codeAction", params, &actions); err != nil {
+		t.Fatal(err)
+	}
+	if len(actions) != 1 || actions[0].Title != "Fix all findings in file (3) [FuzzLSP]" {
+		t.Fatalf("actions %+v, want the fix-all action", actions)
+	}
+
+	var resolved struct {
+		Edit struct {
+			Changes map[string][]defines.TextEdit `json:"changes"`
+		} `json:"edit"`
+	}
+	raw, _ := json.Marshal(actions[0])
+	if err := c.request("codeAction/resolve", json.RawMessage(raw), &resolved); err != nil {
+		t.Fatal(err)
+	}
+
+	// The two findings of f are fixed with one request, all edits in one WorkspaceEdit
+	if fmt.Sprint(backend.fixed) != "[1 12]" {
+		t.Errorf("fixed the regions starting on %v, want [1 12]", backend.fixed)
+	}
+	fixed, err := ApplyEdits(text, resolved.Edit.Changes[uri])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := strings.ReplaceAll(text, "return early;", "r = early;"); fixed != want {
+		t.Errorf("fixed document\n%s\nwant\n%s", fixed, want)
+	}
+}
@@ -0,0 +1,101 @@
+package lspserver
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/TobiasYin/go-lsp/jsonrpc"
+	"github.com/TobiasYin/go-lsp/logs"
+)
+
+/*
+ * OnShutdown answers the shutdown request. The session answers the requests
+ * arriving after it with InvalidRequest until the exit notification. With
+ * stdio the client is the only one, so the server stops its work right away.
+ * @param ctx The context of the request
+ * @param req The params, there are none
+ * @return error Any error that occurred during the request
+ */
+func (l *lspServer) OnShutdown(ctx context.Context, req *interface{}) error {
+	logs.Printf("OnShutdown")
+	l.shutdownRequested.Store(true)
+	if session := jsonrpc.SessionFromContext(ctx); session != nil {
+		session.Shutdown()
+	}
+	if l.stdio {
+		l.Shutdown()
+	}
+	return nil
+}
+
+/*
+ * OnExit ends the process with stdio, with 0 after a shutdown request and 1
+ * without one. A client of a socket only ends its own session, the server
+ * keeps serving the others.
+ * @param ctx The context of the notification
+ * @param req The params, there are none
+ * @return error Any error that occurred
+ */
+func (l *lspServer) OnExit(ctx context.Context, req *interface{}) error {
+	logs.Printf("OnExit")
+	if l.stdio {
+		l.exit()
+	}
+	if session := jsonrpc.SessionFromContext(ctx); session != nil {
+		session.Close()
+	}
+	return nil
+}
+
+/*
+ * Shutdown stops the work of the server, once: it cancels the backend
+ * requests and operations in flight, writes the deviation registers, drops
+ * the caches and ends the trace.
+ */
+func (l *lspServer) Shutdown() {
+	l.shutdownOnce.Do(func() {
+		logs.Printf("Shutting down")
+		if l.backend != nil {
+			l.backend.Stop()
+		}
+		l.sessions.Range(func(_, value interface{}) bool {
+			state := value.(*sessionState)
+			state.progress.Range(func(_, p interface{}) bool {
+				p.(*workDoneProgress).cancel()
+				return true
+			})
+			state.exportDeviations()
+			return true
+		})
+		l.clearSharedCaches()
+		if err := l.tracer.Close(); err != nil {
+			logs.Printf("Error closing the trace: %v", err)
+		}
+	})
+}
+
+// exit shuts down and ends the process. With stdio the status is 0 only if
+// the client asked for the shutdown, as LSP wants; a server on a socket
+// has no single client and exits with 0.
+func (l *lspServer) exit() {
+	l.Shutdown()
+	code := 0
+	if l.stdio && !l.shutdownRequested.Load() {
+		code = 1
+	}
+	logs.Printf("Exiting with status %d", code)
+	l.exitProcess(code)
+}
+
+// exitOnSignal exits like on the exit notification on SIGINT and SIGTERM.
+func (l *lspServer) exitOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		logs.Printf("Got %v", sig)
+		l.exit()
+	}()
+}
@@ -0,0 +1,163 @@
+package lspserver
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// stopCounter is the mock backend counting Stop calls.
+type stopCounter struct {
+	LspBackend
+	stopped int32
+}
+
+func (b *stopCounter) Stop() {
+	atomic.AddInt32(&b.stopped, 1)
+	b.LspBackend.Stop()
+}
+
+// exitRecorder replaces os.Exit of the server, it returns the channel
+// receiving the exit status.
+func exitRecorder(l *lspServer) chan int {
+	codes := make(chan int, 1)
+	l.exitProcess = func(code int) { codes <- code }
+	return codes
+}
+
+func TestExitStatus(t *testing.T) {
+	tests := []struct {
+		name     string
+		stdio    bool
+		shutdown bool
+		want     int // the exit status, -1 if the process keeps running
+	}{
+		{"stdio after shutdown", true, true, 0},
+		{"stdio without shutdown", true, false, 1},
+		{"socket after shutdown", false, true, -1},
+		{"socket without shutdown", false, false, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newTestServer(t)
+			l.stdio = tt.stdio
+			backend := &stopCounter{LspBackend: l.backend}
+			l.backend = backend
+			codes := exitRecorder(l)
+			c := connectTestClient(t, l, nil)
+			other := connectTestClient(t, l, nil)
+			c.initialize(t.TempDir(), `{}`)
+			other.initialize(t.TempDir(), `{}`)
+
+			if tt.shutdown {
+				if err := c.request("shutdown", nil, nil); err != nil {
+					t.Fatal(err)
+				}
+				// The session refuses requests until the exit
+				if err := c.request("textDocument/hover", map[string]interface{}{}, nil); err == nil {
+					t.Error("answered a request after the shutdown")
+				}
+			}
+			c.notify("exit", nil)
+			waitFor(t, "the session to end", func() bool { return sessionCount(l) == 1 })
+
+			if tt.want == -1 {
+				select {
+				case code := <-codes:
+					t.Fatalf("exited with %d", code)
+				default:
+				}
+				// The other client is still served by the running backend
+				if err := executeCommand(other, CommandClearCache); err != nil {
+					t.Fatal(err)
+				}
+				if n := atomic.LoadInt32(&backend.stopped); n != 0 {
+					t.Errorf("stopped the backend %d times", n)
+				}
+				return
+			}
+			if code := <-codes; code != tt.want {
+				t.Errorf("exited with %d, want %d", code, tt.want)
+			}
+			if n := atomic.LoadInt32(&backend.stopped); n != 1 {
+				t.Errorf("stopped the backend %d times, want once", n)
+			}
+		})
+	}
+}
+
+func TestShutdownOnce(t *testing.T) {
+	l := newTestServer(t)
+	backend := &stopCounter{LspBackend: l.backend}
+	l.backend = backend
+	codes := exitRecorder(l)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l.Shutdown()
+		}()
+	}
+	wg.Wait()
+	l.exit()
+	if n := atomic.LoadInt32(&backend.stopped); n != 1 {
+		t.Errorf("stopped the backend %d times, want once", n)
+	}
+	if code := <-codes; code != 0 {
+		t.Errorf("a server on a socket exited with %d, want 0", code)
+	}
+}
+
+func TestShutdownSessions(t *testing.T) {
+	register := *ParamDeviationRegister
+	*ParamDeviationRegister = "deviations.json"
+	t.Cleanup(func() { *ParamDeviationRegister = register })
+
+	l := newTestServer(t)
+	backend := &blockingBackend{LspBackend: l.backend, started: make(chan context.Context, 2)}
+	l.backend = backend
+	exitRecorder(l)
+
+	// Both sessions analyse a document with a deviation until the shutdown
+	var clients []*testClient
+	var roots []string
+	for i := 0; i < 2; i++ {
+		c := connectTestClient(t, l, progressHandlers)
+		root := t.TempDir()
+		c.initialize(root, progressCapabilities)
+		c.open("file://"+root+"/a.c", "int f(void)\n{\n    return 0; /* fuzzlsp-deviation MISRA-15.5: single exit, T-1 */\n}\n")
+		nextProgress(t, c)
+		<-backend.started
+		clients = append(clients, c)
+		roots = append(roots, root)
+	}
+	for _, root := range roots {
+		if err := os.Remove(filepath.Join(root, "deviations.json")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	l.Shutdown()
+	for i, c := range clients {
+		if _, end := nextProgress(t, c); end.Kind != "end" || end.Message != "Cancelled" {
+			t.Errorf("progress of session %d after the shutdown = %+v, want the end", i, end)
+		}
+		data, err := os.ReadFile(filepath.Join(roots[i], "deviations.json"))
+		if err != nil {
+			t.Fatalf("session %d: %v", i, err)
+		}
+		var deviations []Deviation
+		if err := json.Unmarshal(data, &deviations); err != nil {
+			t.Fatal(err)
+		}
+		if len(deviations) != 1 || deviations[0].Rule != "MISRA-15.5" || deviations[0].Uri != "file://"+roots[i]+"/a.c" {
+			t.Errorf("session %d exported %+v", i, deviations)
+		}
+	}
+}
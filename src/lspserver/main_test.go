@@ -0,0 +1,287 @@
+package lspserver
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/textproto"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/TobiasYin/go-lsp/logs"
+)
+
+func TestMain(m *testing.M) {
+	logs.Init(log.New(io.Discard, "", 0))
+	setTestParams()
+	os.Exit(m.Run())
+}
+
+// setTestParams gives every flag its zero value and selects the mock backend.
+func setTestParams() {
+	str := func(s string) *string { return &s }
+	ParamBackend = str("mock")
+	ParamPromptFile = str("")
+	ParamConnectTest = new(bool)
+	ParamRetryPromptFile = str("")
+	ParamPromptDir = str("")
+	ParamRulePacks = str("")
+	ParamPolicyFile = str("")
+	ParamDeviationRegister = str("")
+	ParamBaselineFile = str("")
+	ParamProfilesFile = str("")
+	ParamAnalyzerCommand = str("")
+	ParamAnalyzerOutput = str("")
+	ParamAnalyzerNoTriage = new(bool)
+	ParamExplainComments = new(bool)
+	ParamVerifyFixes = str("")
+	ParamListen = str("")
+	ParamWebSocketOrigins = str("")
+	ParamWebSocketToken = str("")
+	ParamTraceFile = str("")
+}
+
+// testTimeout bounds every wait of the tests for the server.
+const testTimeout = 5 * time.Second
+
+// newTestServer creates a server with the mock backend, clients are
+// connected to it with connectTestClient.
+func newTestServer(t *testing.T) *lspServer {
+	t.Helper()
+	l, err := newServer("fuzzlsp-test", Listen{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+// testMessage is any message between the test client and the server.
+type testMessage struct {
+	Jsonrpc string           `json:"jsonrpc"`
+	ID      *json.RawMessage `json:"id,omitempty"`
+	Method  string           `json:"method,omitempty"`
+	Params  json.RawMessage  `json:"params,omitempty"`
+	Result  json.RawMessage  `json:"result,omitempty"`
+	Error   *testError       `json:"error,omitempty"`
+}
+
+type testError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *testError) Error() string {
+	return fmt.Sprintf("%d: %s", e.Code, e.Message)
+}
+
+/*
+ * testClient is an LSP client talking to a test server over a pipe. It
+ * answers the requests of the server with the handlers of their methods and
+ * keeps the requests and notifications it received in order.
+ */
+type testClient struct {
+	t         *testing.T
+	conn      net.Conn
+	writeLock sync.Mutex // serializes the messages to the server
+	lock      sync.Mutex // guards nextID and pending
+	nextID    int
+	pending   map[int]chan testMessage
+	handlers  map[string]func(params json.RawMessage) (interface{}, error)
+	received  chan testMessage
+}
+
+/*
+ * connectTestClient connects a client to the server, it is disconnected
+ * when the test ends.
+ * @param t The test
+ * @param l The server
+ * @param handlers Answer the requests of the server by method, requests
+ * without a handler get a MethodNotFound error
+ * @return client The connected client
+ */
+func connectTestClient(t *testing.T, l *lspServer, handlers map[string]func(params json.RawMessage) (interface{}, error)) *testClient {
+	t.Helper()
+	serverConn, clientConn := net.Pipe()
+	go l.server.ServeConn(serverConn)
+	return newTestClient(t, clientConn, handlers)
+}
+
+// newTestClient talks to a server over a connection, see connectTestClient.
+func newTestClient(t *testing.T, conn net.Conn, handlers map[string]func(params json.RawMessage) (interface{}, error)) *testClient {
+	c := &testClient{
+		t:        t,
+		conn:     conn,
+		pending:  make(map[int]chan testMessage),
+		handlers: handlers,
+		received: make(chan testMessage, 1000),
+	}
+	go c.read()
+	t.Cleanup(c.close)
+	return c
+}
+
+func (c *testClient) close() {
+	c.conn.Close()
+}
+
+func (c *testClient) read() {
+	r := textproto.NewReader(bufio.NewReader(c.conn))
+	for {
+		header, err := r.ReadMIMEHeader()
+		if err != nil {
+			return
+		}
+		length, err := strconv.Atoi(header.Get("Content-Length"))
+		if err != nil {
+			return
+		}
+		content := make([]byte, length)
+		if _, err := io.ReadFull(r.R, content); err != nil {
+			return
+		}
+		var msg testMessage
+		if err := json.Unmarshal(content, &msg); err != nil {
+			c.t.Errorf("invalid message %s: %v", content, err)
+			return
+		}
+
+		if msg.Method == "" {
+			var id int
+			if msg.ID != nil {
+				json.Unmarshal(*msg.ID, &id)
+			}
+			c.lock.Lock()
+			done, ok := c.pending[id]
+			delete(c.pending, id)
+			c.lock.Unlock()
+			if ok {
+				done <- msg
+			}
+			continue
+		}
+		c.received <- msg
+		if msg.ID != nil {
+			go c.answer(msg)
+		}
+	}
+}
+
+// answer responds to a request of the server with its handler.
+func (c *testClient) answer(req testMessage) {
+	resp := testMessage{Jsonrpc: "2.0", ID: req.ID}
+	handler, ok := c.handlers[req.Method]
+	if !ok {
+		resp.Error = &testError{Code: -32601, Message: "method not found: " + req.Method}
+	} else if result, err := handler(req.Params); err != nil {
+		resp.Error = &testError{Code: -32603, Message: err.Error()}
+	} else {
+		resp.Result, _ = json.Marshal(result)
+	}
+	c.write(resp)
+}
+
+func (c *testClient) write(msg testMessage) {
+	msg.Jsonrpc = "2.0"
+	content, err := json.Marshal(msg)
+	if err != nil {
+		c.t.Errorf("marshal %+v: %v", msg, err)
+		return
+	}
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	fmt.Fprintf(c.conn, "Content-Length: %d\r\n\r\n%s", len(content), content)
+}
+
+// request sends a request and decodes the result into result unless it is nil.
+func (c *testClient) request(method string, params interface{}, result interface{}) error {
+	c.t.Helper()
+	c.lock.Lock()
+	c.nextID++
+	id := c.nextID
+	done := make(chan testMessage, 1)
+	c.pending[id] = done
+	c.lock.Unlock()
+
+	rawID := json.RawMessage(strconv.Itoa(id))
+	rawParams, _ := json.Marshal(params)
+	c.write(testMessage{ID: &rawID, Method: method, Params: rawParams})
+
+	select {
+	case resp := <-done:
+		if resp.Error != nil {
+			return resp.Error
+		}
+		if result == nil || len(resp.Result) == 0 {
+			return nil
+		}
+		return json.Unmarshal(resp.Result, result)
+	case <-time.After(testTimeout):
+		c.t.Fatalf("no response to %s", method)
+		return nil
+	}
+}
+
+func (c *testClient) notify(method string, params interface{}) {
+	rawParams, _ := json.Marshal(params)
+	c.write(testMessage{Method: method, Params: rawParams})
+}
+
+/*
+ * initialize initializes the session.
+ * @param root The workspace root
+ * @param capabilities The capabilities of the client as JSON
+ */
+func (c *testClient) initialize(root string, capabilities string) {
+	c.t.Helper()
+	params := map[string]interface{}{
+		"rootUri":      "file://" + root,
+		"capabilities": json.RawMessage(capabilities),
+	}
+	if err := c.request("initialize", params, nil); err != nil {
+		c.t.Fatalf("initialize: %v", err)
+	}
+	c.notify("initialized", map[string]interface{}{})
+}
+
+// open opens a C document.
+func (c *testClient) open(uri string, text string) {
+	c.notify("textDocument/didOpen", map[string]interface{}{
+		"textDocument": map[string]interface{}{"uri": uri, "languageId": "c", "version": 1, "text": text},
+	})
+}
+
+// next returns the next request or notification of the server with the
+// method, skipping the others.
+func (c *testClient) next(method string) testMessage {
+	c.t.Helper()
+	timeout := time.After(testTimeout)
+	for {
+		select {
+		case msg := <-c.received:
+			if msg.Method == method {
+				return msg
+			}
+		case <-timeout:
+			c.t.Fatalf("the server did not send %s", method)
+			return testMessage{}
+		}
+	}
+}
+
+// waitFor waits until cond holds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
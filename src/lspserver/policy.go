@@ -0,0 +1,200 @@
+package lspserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/TobiasYin/go-lsp/logs"
+	"gopkg.in/yaml.v3"
+)
+
+// policyFiles are looked up, in order, below the workspace root.
+var policyFiles = []string{
+	".fuzzlsp/policy.json",
+	".fuzzlsp/policy.yaml",
+	".fuzzlsp/policy.yml",
+}
+
+// severityOff in SeverityOverrides disables a rule or a whole category.
+const severityOff = "off"
+
+/*
+ * Policy is the per project rule selection. It picks the rule packs,
+ * disables rules (IDs or patterns such as "STYLE-*") and remaps severities.
+ * SeverityOverrides is keyed by rule ID or rule category, in any case; the
+ * value is a rule category (mandatory, required, advisory), an LSP severity
+ * (error, warning, information, hint) or "off".
+ */
+type Policy struct {
+	RulePacks         []string          `json:"rule_packs" yaml:"rule_packs"`
+	DisabledRules     []string          `json:"disabled_rules" yaml:"disabled_rules"`
+	SeverityOverrides map[string]string `json:"severity_overrides" yaml:"severity_overrides"`
+
+	// dir is used to resolve relative rule pack paths
+	dir string
+}
+
+/*
+ * LoadPolicy reads the workspace policy. An explicit file wins over the
+ * default locations below root; no policy file at all is not an error.
+ * @param root The workspace root directory, may be empty
+ * @param file Explicit policy file, may be empty
+ * @return policy The policy or nil if there is none
+ * @return error Any error that occurred while reading or decoding
+ */
+func LoadPolicy(root string, file string) (*Policy, error) {
+	if file == "" {
+		if root == "" {
+			return nil, nil
+		}
+		for _, name := range policyFiles {
+			candidate := filepath.Join(root, name)
+			if _, err := os.Stat(candidate); err == nil {
+				file = candidate
+				break
+			}
+		}
+		if file == "" {
+			return nil, nil
+		}
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	policy := &Policy{}
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, policy)
+	default:
+		err = json.Unmarshal(data, policy)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("policy %s: %w", file, err)
+	}
+	policy.normalize()
+
+	policy.dir = root
+	if policy.dir == "" {
+		policy.dir = filepath.Dir(file)
+	}
+	logs.Printf("[+] Loaded policy %s", file)
+	return policy, nil
+}
+
+// normalize lowercases the override keys, so that rule IDs and categories
+// such as the CERT levels "L1" to "L3" match in any case.
+func (p *Policy) normalize() {
+	overrides := make(map[string]string, len(p.SeverityOverrides))
+	for key, severity := range p.SeverityOverrides {
+		overrides[strings.ToLower(key)] = severity
+	}
+	p.SeverityOverrides = overrides
+}
+
+// RulePackSpec returns the policy's rule packs in the -rule-packs format,
+// with relative paths resolved against the workspace root.
+func (p *Policy) RulePackSpec() string {
+	if p == nil || len(p.RulePacks) == 0 {
+		return ""
+	}
+	var packs []string
+	for _, pack := range p.RulePacks {
+		candidate := pack
+		if !filepath.IsAbs(candidate) {
+			candidate = filepath.Join(p.dir, pack)
+		}
+		if _, err := os.Stat(candidate); err == nil {
+			pack = candidate
+		}
+		packs = append(packs, pack)
+	}
+	return strings.Join(packs, ",")
+}
+
+// Disabled reports whether the rule was switched off by the policy.
+func (p *Policy) Disabled(ruleID string) bool {
+	if p == nil {
+		return false
+	}
+	for _, pattern := range p.DisabledRules {
+		if matched, _ := path.Match(pattern, ruleID); matched {
+			return true
+		}
+	}
+	return strings.EqualFold(p.SeverityOverrides[strings.ToLower(ruleID)], severityOff)
+}
+
+// severity returns the override for a rule ID, falling back to the category.
+func (p *Policy) severity(ruleID string, category string) (string, bool) {
+	if p == nil {
+		return "", false
+	}
+	if severity, ok := p.SeverityOverrides[strings.ToLower(ruleID)]; ok {
+		return severity, true
+	}
+	severity, ok := p.SeverityOverrides[strings.ToLower(category)]
+	return severity, ok
+}
+
+/*
+ * SelectRules drops disabled rules and applies category overrides so the
+ * prompt only asks for the rules the project cares about.
+ * @param rules The rules of the loaded rule packs
+ * @return rules The rules enabled by the policy
+ */
+func (p *Policy) SelectRules(rules []Rule) []Rule {
+	if p == nil {
+		return rules
+	}
+	var selected []Rule
+	for _, rule := range rules {
+		if p.Disabled(rule.ID) {
+			continue
+		}
+		if severity, ok := p.severity(rule.ID, rule.Category); ok {
+			if strings.EqualFold(severity, severityOff) {
+				continue
+			}
+			if _, isLsp := lspSeverityName(severity); isLsp {
+				rule.Severity = severity
+			} else {
+				rule.Category = severity
+			}
+		}
+		selected = append(selected, rule)
+	}
+	return selected
+}
+
+/*
+ * FilterDiagnostics removes findings for disabled rules and rewrites the
+ * severity of the remaining ones according to the overrides.
+ * @param diagnostics The parsed diagnostics
+ * @return diagnostics The diagnostics to report
+ */
+func (p *Policy) FilterDiagnostics(diagnostics []LspDiagnostic) []LspDiagnostic {
+	if p == nil {
+		return diagnostics
+	}
+	var filtered []LspDiagnostic
+	for _, d := range diagnostics {
+		if p.Disabled(d.Rule) {
+			continue
+		}
+		if severity, ok := p.severity(d.Rule, d.Severity); ok {
+			if strings.EqualFold(severity, severityOff) {
+				continue
+			}
+			d.Severity = severity
+		}
+		filtered = append(filtered, d)
+	}
+	return filtered
+}
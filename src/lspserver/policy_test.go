@@ -0,0 +1,74 @@
+package lspserver
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func loadTestPolicy(t *testing.T, name string, content string) *Policy {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	policy, err := LoadPolicy("", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return policy
+}
+
+func TestPolicySeverityOverrideCase(t *testing.T) {
+	policy := loadTestPolicy(t, "policy.yaml", `
+severity_overrides:
+  L1: error
+  l3: "off"
+  Advisory: hint
+  misra-15.7: warning
+`)
+
+	tests := []struct {
+		name     string
+		rule     Rule
+		severity string // empty if the rule is dropped
+	}{
+		{"upper case category key", Rule{ID: "CERT-EXP33-C", Category: "L1"}, "error"},
+		{"lower case key, upper case category", Rule{ID: "CERT-MSC30-C", Category: "L3"}, ""},
+		{"mixed case key", Rule{ID: "MISRA-10.1", Category: "advisory"}, "hint"},
+		{"rule ID in another case", Rule{ID: "MISRA-15.7", Category: "required"}, "warning"},
+		{"no override", Rule{ID: "CERT-INT30-C", Category: "L2", Severity: "information"}, "information"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			selected := policy.SelectRules([]Rule{tt.rule})
+			if tt.severity == "" {
+				if len(selected) != 0 {
+					t.Fatalf("SelectRules kept %+v, want it dropped", selected[0])
+				}
+				return
+			}
+			if len(selected) != 1 {
+				t.Fatalf("SelectRules dropped the rule")
+			}
+			if selected[0].Severity != tt.severity {
+				t.Errorf("severity = %q, want %q", selected[0].Severity, tt.severity)
+			}
+		})
+	}
+}
+
+func TestPolicyFilterDiagnosticsCategoryCase(t *testing.T) {
+	policy := loadTestPolicy(t, "policy.json", `{"severity_overrides": {"L2": "warning", "MISRA-21.3": "off"}}`)
+
+	diagnostics := policy.FilterDiagnostics([]LspDiagnostic{
+		{Rule: "CERT-INT30-C", Severity: "L2"},
+		{Rule: "misra-21.3", Severity: "required"},
+	})
+	if len(diagnostics) != 1 {
+		t.Fatalf("got %d diagnostics, want 1: %+v", len(diagnostics), diagnostics)
+	}
+	if diagnostics[0].Severity != "warning" {
+		t.Errorf("severity = %q, want %q", diagnostics[0].Severity, "warning")
+	}
+}
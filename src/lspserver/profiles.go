@@ -0,0 +1,173 @@
+package lspserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/TobiasYin/go-lsp/logs"
+)
+
+// Chunkers split a document into the pieces sent to the model.
+const (
+	ChunkerLines  = "lines"  // fixed blocks of chunkLines lines
+	ChunkerBlocks = "blocks" // top level brace blocks (C, C++, Go)
+	ChunkerIndent = "indent" // top level statements by indentation (Python)
+)
+
+/*
+ * LanguageProfile decides how documents of one language are analysed: the
+ * rule packs used when neither -rule-packs nor the policy pick any, how the
+ * document is chunked, the comment syntax of inserted text and whether the
+ * token based built-in checks apply. Analysis prompts are looked up as
+ * "<language_id>.<template>" first (e.g. python.analyse.system.tmpl in the
+ * prompt directory) and fall back to the shared templates.
+ */
+type LanguageProfile struct {
+	LanguageID   string   `json:"language_id"`
+	Aliases      []string `json:"aliases,omitempty"`
+	Extensions   []string `json:"extensions"`
+	RulePacks    string   `json:"rule_packs"`
+	Chunker      string   `json:"chunker"`
+	LineComment  string   `json:"line_comment"`
+	BlockComment []string `json:"block_comment,omitempty"`
+	CLike        bool     `json:"c_like"`
+}
+
+var languageProfiles = []*LanguageProfile{
+	{
+		LanguageID:   "c",
+		Aliases:      []string{"h"},
+		Extensions:   []string{".c", ".h"},
+		RulePacks:    DefaultRulePacks,
+		Chunker:      ChunkerBlocks,
+		LineComment:  "//",
+		BlockComment: []string{"/*", "*/"},
+		CLike:        true,
+	},
+	{
+		LanguageID:   "cpp",
+		Aliases:      []string{"hpp", "cuda-cpp"},
+		Extensions:   []string{".cc", ".cpp", ".cxx", ".hh", ".hpp", ".hxx"},
+		RulePacks:    "autosar-cpp14,fuzzlsp-style",
+		Chunker:      ChunkerBlocks,
+		LineComment:  "//",
+		BlockComment: []string{"/*", "*/"},
+		CLike:        true,
+	},
+	{
+		LanguageID:  "python",
+		Extensions:  []string{".py", ".pyi"},
+		RulePacks:   "python-pep8",
+		Chunker:     ChunkerIndent,
+		LineComment: "#",
+	},
+	{
+		LanguageID:   "rust",
+		Extensions:   []string{".rs"},
+		RulePacks:    "rust-safety",
+		Chunker:      ChunkerLines,
+		LineComment:  "//",
+		BlockComment: []string{"/*", "*/"},
+	},
+	{
+		LanguageID:   "go",
+		Extensions:   []string{".go"},
+		RulePacks:    "go-style",
+		Chunker:      ChunkerBlocks,
+		LineComment:  "//",
+		BlockComment: []string{"/*", "*/"},
+	},
+}
+
+/*
+ * LoadLanguageProfiles reads additional profiles from a JSON array. A profile
+ * with the language_id of a built-in one replaces it.
+ * @param fileName The profiles file
+ * @return error Any error that occurred while reading or decoding
+ */
+func LoadLanguageProfiles(fileName string) error {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return err
+	}
+	var profiles []*LanguageProfile
+	if err := json.Unmarshal(data, &profiles); err != nil {
+		return fmt.Errorf("language profiles %s: %w", fileName, err)
+	}
+
+	for _, profile := range profiles {
+		if profile.LanguageID == "" {
+			return fmt.Errorf("language profiles %s: profile without language_id", fileName)
+		}
+		replaced := false
+		for i, existing := range languageProfiles {
+			if existing.LanguageID == profile.LanguageID {
+				languageProfiles[i] = profile
+				replaced = true
+			}
+		}
+		if !replaced {
+			languageProfiles = append(languageProfiles, profile)
+		}
+		logs.Printf("[+] Loaded language profile %s", profile.LanguageID)
+	}
+	return nil
+}
+
+/*
+ * ProfileFor finds the profile of a document, by LSP languageId first and by
+ * file extension if the client didn't send one.
+ * @param languageID The languageId from textDocument/didOpen, may be empty
+ * @param uri The document URI
+ * @return profile The profile
+ * @return ok False if the language is not supported
+ */
+func ProfileFor(languageID string, uri string) (*LanguageProfile, bool) {
+	if languageID != "" {
+		for _, profile := range languageProfiles {
+			if profile.LanguageID == languageID || containsString(profile.Aliases, languageID) {
+				return profile, true
+			}
+		}
+	}
+	ext := strings.ToLower(filepath.Ext(uri))
+	for _, profile := range languageProfiles {
+		if containsString(profile.Extensions, ext) {
+			return profile, true
+		}
+	}
+	return nil, false
+}
+
+/*
+ * Comment turns text into a comment of the profile's language. Block
+ * comments are preferred unless the text would terminate them early.
+ * @param text The comment text, may span lines
+ * @return comment The comment, without a trailing newline
+ */
+func (p *LanguageProfile) Comment(text string) string {
+	if len(p.BlockComment) == 2 && !strings.Contains(text, p.BlockComment[1]) {
+		return p.BlockComment[0] + " " + text + " " + p.BlockComment[1]
+	}
+	marker := p.LineComment
+	if marker == "" {
+		marker = "//"
+	}
+	lines := strings.Split(text, "\n")
+	for i := range lines {
+		lines[i] = strings.TrimRight(marker+" "+lines[i], " ")
+	}
+	return strings.Join(lines, "\n")
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
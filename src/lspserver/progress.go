@@ -0,0 +1,134 @@
+package lspserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/TobiasYin/go-lsp/jsonrpc"
+	"github.com/TobiasYin/go-lsp/logs"
+	"github.com/TobiasYin/go-lsp/lsp/defines"
+)
+
+// AnalysisProgress is called by AnalyseDocument before every backend request.
+// Step counts from 0 to total-1 over all rules and chunks, chunk is 1-based.
+type AnalysisProgress func(step int, total int, rule Rule, chunk int, chunks int)
+
+/*
+ * workDoneProgress reports a long running operation to the client with
+ * window/workDoneProgress/create and $/progress begin, report and end. The
+ * user can cancel it, which cancels its context. If the client doesn't
+ * support work done progress nothing is sent, but the context still works.
+ */
+type workDoneProgress struct {
+	server     *lspServer
+	state      *sessionState
+	token      string
+	ctx        context.Context
+	cancel     context.CancelFunc
+	percentage uint
+}
+
+/*
+ * beginProgress starts reporting an operation.
+ * @param ctx The context of the operation
+ * @param title The title shown by the client, e.g. "FuzzLSP"
+ * @param message The first message, e.g. the file being analysed
+ * @return progress The progress, End must be called when the operation is done
+ */
+func (l *lspServer) beginProgress(ctx context.Context, title string, message string) *workDoneProgress {
+	progressCtx, cancel := context.WithCancel(ctx)
+	p := &workDoneProgress{server: l, state: l.state(ctx), ctx: progressCtx, cancel: cancel}
+	if !p.state.supportsWorkDoneProgress() {
+		return p
+	}
+
+	token := fmt.Sprintf("fuzzlsp/%d", atomic.AddInt64(&l.progressTokens, 1))
+	if err := l.createProgress(ctx, token); err != nil {
+		logs.Printf("Error creating progress: %v", err)
+		return p
+	}
+	p.token = token
+	p.state.progress.Store(token, p)
+
+	p.notify(defines.WorkDoneProgressBegin{
+		Kind:        "begin",
+		Title:       title,
+		Cancellable: &[]bool{true}[0],
+		Message:     &message,
+		Percentage:  &p.percentage,
+	})
+	return p
+}
+
+// Context is cancelled when the user cancels the operation.
+func (p *workDoneProgress) Context() context.Context {
+	return p.ctx
+}
+
+// Report updates the message and percentage, percentages below the last one
+// are raised to it.
+func (p *workDoneProgress) Report(message string, percentage uint) {
+	p.percentage = max(p.percentage, min(percentage, 100))
+	percent := p.percentage
+	p.notify(defines.WorkDoneProgressReport{
+		Kind:       "report",
+		Message:    &message,
+		Percentage: &percent,
+	})
+}
+
+// Analysis reports the rule and chunk AnalyseDocument is working on.
+func (p *workDoneProgress) Analysis(step int, total int, rule Rule, chunk int, chunks int) {
+	if total <= 0 {
+		return
+	}
+	p.Report(fmt.Sprintf("%s, chunk %d/%d", rule.ID, chunk, chunks), uint(step*100/total))
+}
+
+// End finishes the operation with a message telling how it went.
+func (p *workDoneProgress) End(err error) {
+	defer p.cancel()
+
+	message := "Done"
+	switch {
+	case err == nil:
+	case errors.Is(err, context.Canceled):
+		message = "Cancelled"
+	default:
+		message = "Failed: " + err.Error()
+	}
+	p.notify(defines.WorkDoneProgressEnd{Kind: "end", Message: &message})
+	if p.token != "" {
+		p.state.progress.Delete(p.token)
+		p.token = ""
+	}
+}
+
+func (p *workDoneProgress) notify(value interface{}) {
+	if p.token == "" {
+		return
+	}
+	params := jsonrpc.ProgressParams{Token: p.token, Value: value}
+	if err := p.server.SendNotification(p.ctx, "$/progress", params); err != nil {
+		logs.Printf("Error reporting progress: %v", err)
+	}
+}
+
+/*
+ * OnWorkDoneProgressCancel cancels an operation the user stopped in the
+ * client's progress UI. Tokens are looked up in the client's own session, so
+ * a client can't cancel the operations of another one.
+ * @param ctx The context of the notification
+ * @param req The token of the progress
+ * @return error Any error that occurred while cancelling
+ */
+func (l *lspServer) OnWorkDoneProgressCancel(ctx context.Context, req *defines.WorkDoneProgressCancelParams) error {
+	token := fmt.Sprint(req.Token)
+	logs.Printf("OnWorkDoneProgressCancel: %s", token)
+	if value, ok := l.state(ctx).progress.Load(token); ok {
+		value.(*workDoneProgress).cancel()
+	}
+	return nil
+}
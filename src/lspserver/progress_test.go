@@ -0,0 +1,134 @@
+package lspserver
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// blockingBackend is the mock backend with analyses that run until they
+// are cancelled.
+type blockingBackend struct {
+	LspBackend
+	started chan context.Context
+}
+
+func (b *blockingBackend) AnalyseDocument(ctx context.Context, uri string, document string, profile *LanguageProfile, rules []Rule, progress AnalysisProgress) (string, error) {
+	b.started <- ctx
+	<-ctx.Done()
+	return "", ctx.Err()
+}
+
+type progressValue struct {
+	Kind       string `json:"kind"`
+	Title      string `json:"title"`
+	Message    string `json:"message"`
+	Percentage *uint  `json:"percentage"`
+}
+
+// nextProgress returns the token and value of the next $/progress.
+func nextProgress(t *testing.T, c *testClient) (string, progressValue) {
+	t.Helper()
+	var params struct {
+		Token string        `json:"token"`
+		Value progressValue `json:"value"`
+	}
+	if err := json.Unmarshal(c.next("$/progress").Params, &params); err != nil {
+		t.Fatal(err)
+	}
+	return params.Token, params.Value
+}
+
+var progressHandlers = map[string]func(json.RawMessage) (interface{}, error){
+	"window/workDoneProgress/create": func(json.RawMessage) (interface{}, error) { return nil, nil },
+}
+
+const progressCapabilities = `{"window": {"workDoneProgress": true}}`
+
+func TestProgressSequence(t *testing.T) {
+	l := newTestServer(t)
+	c := connectTestClient(t, l, progressHandlers)
+	root := t.TempDir()
+	c.initialize(root, progressCapabilities)
+	c.open("file://"+root+"/a.c", "int a;\n")
+
+	var created struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(c.next("window/workDoneProgress/create").Params, &created); err != nil {
+		t.Fatal(err)
+	}
+	token, begin := nextProgress(t, c)
+	if token != created.Token || begin.Kind != "begin" || begin.Title != "FuzzLSP" || begin.Message != "Analysing a.c" {
+		t.Fatalf("first progress %s %+v, want begin of %s", token, begin, created.Token)
+	}
+
+	// A report for every rule, the percentages don't go down
+	reports := 0
+	last := uint(0)
+	for {
+		token, value := nextProgress(t, c)
+		if token != created.Token {
+			t.Fatalf("progress of %s, want %s", token, created.Token)
+		}
+		if value.Kind == "end" {
+			if value.Message != "Done" {
+				t.Errorf("end message = %q, want Done", value.Message)
+			}
+			break
+		}
+		if value.Kind != "report" || value.Percentage == nil || *value.Percentage < last || *value.Percentage > 100 {
+			t.Fatalf("unexpected progress %+v after %d%%", value, last)
+		}
+		last = *value.Percentage
+		reports++
+	}
+	if reports == 0 {
+		t.Error("no progress reports")
+	}
+}
+
+func TestProgressCancel(t *testing.T) {
+	l := newTestServer(t)
+	backend := &blockingBackend{LspBackend: l.backend, started: make(chan context.Context, 1)}
+	l.backend = backend
+	c := connectTestClient(t, l, progressHandlers)
+	other := connectTestClient(t, l, progressHandlers)
+	root := t.TempDir()
+	c.initialize(root, progressCapabilities)
+	other.initialize(root, progressCapabilities)
+	c.open("file://"+root+"/a.c", "int a;\n")
+
+	token, _ := nextProgress(t, c)
+	analysis := <-backend.started
+
+	// Tokens are looked up in the own session only
+	other.notify("window/workDoneProgress/cancel", map[string]string{"token": token})
+	time.Sleep(50 * time.Millisecond)
+	if analysis.Err() != nil {
+		t.Fatal("another client cancelled the analysis")
+	}
+
+	c.notify("window/workDoneProgress/cancel", map[string]string{"token": token})
+	_, end := nextProgress(t, c)
+	if end.Kind != "end" || end.Message != "Cancelled" {
+		t.Errorf("progress after cancelling = %+v, want the end", end)
+	}
+}
+
+func TestProgressWithoutSupport(t *testing.T) {
+	l := newTestServer(t)
+	c := connectTestClient(t, l, progressHandlers)
+	root := t.TempDir()
+	c.initialize(root, `{}`)
+	uri := "file://" + root + "/a.c"
+	c.open(uri, "int a;\n")
+	waitFor(t, "the analysis", func() bool { return analysedSessions(l, uri) == 1 })
+
+	for len(c.received) > 0 {
+		if msg := <-c.received; msg.Method == "window/workDoneProgress/create" || msg.Method == "$/progress" {
+			t.Errorf("sent %s to a client without work done progress", msg.Method)
+		}
+	}
+}
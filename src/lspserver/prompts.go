@@ -0,0 +1,227 @@
+package lspserver
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/TobiasYin/go-lsp/logs"
+)
+
+// Names of the templates used by the backends. Each backend method renders a
+// "<method>.system" and a "<method>.user" template; any of them can be
+// overridden by dropping "<name>.tmpl" into the prompt directory.
+const (
+	PromptAnalyseSystem  = "analyse.system"
+	PromptAnalyseUser    = "analyse.user"
+	PromptCompleteSystem = "complete.system"
+	PromptCompleteUser   = "complete.user"
+	PromptGenerateSystem = "generate.system"
+	PromptGenerateUser   = "generate.user"
+	PromptRefactorSystem = "refactor.system"
+	PromptRefactorUser   = "refactor.user"
+	PromptExplainSystem  = "explain.system"
+	PromptExplainUser    = "explain.user"
+	PromptTriageSystem   = "triage.system"
+	PromptTriageUser     = "triage.user"
+	PromptFixSystem      = "fix.system"
+	PromptFixUser        = "fix.user"
+)
+
+// promptFileTemplate holds the contents of -prompt-file, analyse.system
+// includes it by default.
+const promptFileTemplate = "prompt_file"
+
+// defaultStandard is reported to the templates of the connection test.
+const defaultStandard = "MISRA C:2012"
+
+// maxIncludeDepth stops fragments that (indirectly) include themselves.
+const maxIncludeDepth = 8
+
+var defaultPromptTemplates = map[string]string{
+	promptFileTemplate:   "",
+	PromptAnalyseSystem:  `{{template "prompt_file" .}}{{if .Rule}}` + "\n" + `Rule: {{.Rule}}{{end}}`,
+	PromptAnalyseUser:    "FileName: {{.FileName}}\nSource Code (Chunk {{.ChunkIndex}}):\n{{.Code}}",
+	PromptCompleteSystem: "You are a coding assistant. Provide the best possible code completions based on the given context.",
+	PromptCompleteUser:   "Complete the code following this prefix:\n{{.Prefix}}<PROVIDE_SUGGESTION_HERE>",
+	PromptGenerateSystem: "You are a coding assistant. Provide the best possible code completions based on the given context.",
+	PromptGenerateUser:   "Complete the code following this prefix:\n{{.Prefix}}<generate></generate>{{.Suffix}}",
+	PromptRefactorSystem: "You are a coding assistant that refactors {{.Language}} code to fix the listed findings and improve clarity, performance, and maintainability. " +
+		"Keep lines you don't need to change exactly as they are, including indentation. " +
+		"Return the complete code you were given, refactored, in a single fenced code block and nothing else.",
+	PromptRefactorUser: "FileName: {{.FileName}}\nFindings:\n{{.Finding}}\nSource Code (lines {{.StartLine}}-{{.EndLine}}):\n{{.Code}}",
+	PromptExplainSystem: "You are a coding assistant that explains findings in {{.Language}} code.{{if .Rule}}\nRule: {{.Rule}}{{end}}\n" +
+		"Explain in a few sentences of markdown why the code violates the rule, what can go wrong at run time and how to fix it. Don't repeat the code.",
+	PromptExplainUser: "FileName: {{.FileName}}\nFinding: {{.Finding}}\nSource Code (lines {{.StartLine}}-{{.EndLine}}):\n{{.Code}}",
+	PromptTriageSystem: "You triage the findings of a static analyzer, many of which are false positives. " +
+		"Decide from the {{.Language}} code whether the finding is a real issue. Answer with a single JSON object " +
+		`{"verdict": "confirm" or "dismiss", "explanation": "why", "recommendation": "how to fix it"} and nothing else.`,
+	PromptTriageUser: "FileName: {{.FileName}}\nFinding: {{.Finding}}\nSource Code (lines {{.StartLine}}-{{.EndLine}}):\n{{.Code}}",
+	PromptFixSystem: "You fix {{.Language}} code so it no longer violates {{.RuleID}}.{{if .Rule}}\nRules:\n{{.Rule}}{{end}}\n" +
+		"Change only what is needed to fix the findings and keep every other line exactly as it is, including indentation. " +
+		"Return the complete code you were given, with the fix applied, in a single fenced code block and nothing else.",
+	PromptFixUser: "FileName: {{.FileName}}\nFindings:\n{{.Finding}}\nSource Code (lines {{.StartLine}}-{{.EndLine}}):\n{{.Code}}",
+}
+
+// PromptVars are the variables every prompt template can reference.
+type PromptVars struct {
+	FileName   string
+	Language   string
+	Standard   string
+	Rule       string
+	RuleID     string
+	ChunkIndex int
+	StartLine  int
+	EndLine    int
+	Code       string
+	Prefix     string
+	Suffix     string
+	Finding    string
+}
+
+type PromptTemplates struct {
+	dirs []string
+	tmpl *template.Template
+}
+
+/*
+ * LoadPromptTemplates builds the prompt templates used by the backends.
+ * The built-in defaults are parsed first, then promptFile becomes the body of
+ * the "prompt_file" template and finally every "<name>.tmpl" in promptDir
+ * replaces the template of the same name. Fragments referenced with
+ * {{include "file" .}} are looked up in promptDir and next to promptFile.
+ * @param promptFile The analysis prompt, may be empty
+ * @param promptDir Directory holding template overrides, may be empty
+ * @return templates The parsed templates
+ * @return error Any error that occurred while reading or parsing
+ */
+func LoadPromptTemplates(promptFile string, promptDir string) (*PromptTemplates, error) {
+	p := &PromptTemplates{}
+	if promptDir != "" {
+		p.dirs = append(p.dirs, promptDir)
+	}
+	if promptFile != "" {
+		p.dirs = append(p.dirs, filepath.Dir(promptFile))
+	}
+
+	p.tmpl = template.New("prompts").Funcs(p.funcs(0))
+	for name, text := range defaultPromptTemplates {
+		if _, err := p.tmpl.New(name).Parse(text); err != nil {
+			return nil, fmt.Errorf("default prompt %s: %w", name, err)
+		}
+	}
+
+	if promptFile != "" {
+		text, err := LoadPrompt(promptFile)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.tmpl.New(promptFileTemplate).Parse(string(text)); err != nil {
+			return nil, fmt.Errorf("prompt file %s: %w", promptFile, err)
+		}
+	}
+
+	if promptDir != "" {
+		overrides, err := filepath.Glob(filepath.Join(promptDir, "*.tmpl"))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range overrides {
+			text, err := os.ReadFile(file)
+			if err != nil {
+				return nil, err
+			}
+			name := strings.TrimSuffix(filepath.Base(file), ".tmpl")
+			if _, err := p.tmpl.New(name).Parse(string(text)); err != nil {
+				return nil, fmt.Errorf("prompt template %s: %w", file, err)
+			}
+			logs.Printf("[+] Prompt template %s overridden by %s", name, file)
+		}
+	}
+
+	return p, nil
+}
+
+// Render executes the named template with vars. A "<language>.<name>"
+// template for vars.Language takes precedence over the shared one.
+func (p *PromptTemplates) Render(name string, vars PromptVars) (string, error) {
+	t := p.tmpl.Lookup(vars.Language + "." + name)
+	if t == nil || vars.Language == "" {
+		t = p.tmpl.Lookup(name)
+	}
+	if t == nil {
+		return "", fmt.Errorf("prompt template %s not found", name)
+	}
+	var out bytes.Buffer
+	if err := t.Execute(&out, vars); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// RenderPair renders "<method>.system" and "<method>.user" in one go.
+func (p *PromptTemplates) RenderPair(system string, user string, vars PromptVars) (string, string, error) {
+	systemPrompt, err := p.Render(system, vars)
+	if err != nil {
+		return "", "", err
+	}
+	query, err := p.Render(user, vars)
+	if err != nil {
+		return "", "", err
+	}
+	return systemPrompt, query, nil
+}
+
+func (p *PromptTemplates) funcs(depth int) template.FuncMap {
+	return template.FuncMap{
+		"include": func(name string, data ...interface{}) (string, error) {
+			return p.include(name, depth+1, data...)
+		},
+	}
+}
+
+// include renders a fragment file with the caller's variables.
+func (p *PromptTemplates) include(name string, depth int, data ...interface{}) (string, error) {
+	if depth > maxIncludeDepth {
+		return "", fmt.Errorf("include %s: nested too deeply", name)
+	}
+
+	path, err := p.resolve(name)
+	if err != nil {
+		return "", err
+	}
+	text, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	t, err := template.New(name).Funcs(p.funcs(depth)).Parse(string(text))
+	if err != nil {
+		return "", fmt.Errorf("include %s: %w", name, err)
+	}
+	var vars interface{}
+	if len(data) > 0 {
+		vars = data[0]
+	}
+	var out bytes.Buffer
+	if err := t.Execute(&out, vars); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+func (p *PromptTemplates) resolve(name string) (string, error) {
+	if filepath.IsAbs(name) {
+		return name, nil
+	}
+	for _, dir := range p.dirs {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("prompt fragment %s not found in %v", name, p.dirs)
+}
@@ -0,0 +1,159 @@
+package lspserver
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writePrompts writes the files to a new prompt directory.
+func writePrompts(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, text := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(text), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// includeChain writes n fragments, each including the next one.
+func includeChain(n int) map[string]string {
+	files := map[string]string{"analyse.system.tmpl": `{{include "f1" .}}`}
+	for i := 1; i < n; i++ {
+		files[fmt.Sprintf("f%d", i)] = fmt.Sprintf(`%d {{include "f%d" .}}`, i, i+1)
+	}
+	files[fmt.Sprintf("f%d", n)] = "{{.Standard}}"
+	return files
+}
+
+func TestPromptInclude(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		want  string
+		err   string
+	}{
+		{
+			name: "fragment with the caller's variables",
+			files: map[string]string{
+				"analyse.system.tmpl": `Check {{.Language}}: {{include "rules.txt" .}}`,
+				"rules.txt":           "{{.Standard}} rules",
+			},
+			want: "Check c: MISRA C:2012 rules",
+		},
+		{
+			name:  "nested up to the limit",
+			files: includeChain(maxIncludeDepth),
+			want:  "1 2 3 4 5 6 7 MISRA C:2012",
+		},
+		{
+			name:  "nested too deeply",
+			files: includeChain(maxIncludeDepth + 1),
+			err:   "nested too deeply",
+		},
+		{
+			name: "including itself",
+			files: map[string]string{
+				"analyse.system.tmpl": `{{include "loop.txt" .}}`,
+				"loop.txt":            `x{{include "loop.txt" .}}`,
+			},
+			err: "include loop.txt: nested too deeply",
+		},
+		{
+			name:  "missing fragment",
+			files: map[string]string{"analyse.system.tmpl": `{{include "missing.txt" .}}`},
+			err:   "prompt fragment missing.txt not found",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := LoadPromptTemplates("", writePrompts(t, tt.files))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := p.Render(PromptAnalyseSystem, PromptVars{Language: "c", Standard: "MISRA C:2012"})
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("Render = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPromptFileInclude(t *testing.T) {
+	// Fragments are found next to the prompt file, the prompt directory first
+	fileDir := writePrompts(t, map[string]string{
+		"prompt.txt":   `Follow {{include "standard.txt" .}}`,
+		"standard.txt": "{{.Standard}} from the prompt file",
+	})
+	promptDir := writePrompts(t, map[string]string{"other.txt": "unused"})
+	p, err := LoadPromptTemplates(filepath.Join(fileDir, "prompt.txt"), promptDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := p.Render(promptFileTemplate, PromptVars{Standard: "CERT C"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "Follow CERT C from the prompt file" {
+		t.Errorf("Render = %q", got)
+	}
+
+	overridden := writePrompts(t, map[string]string{"standard.txt": "{{.Standard}} from the prompt directory"})
+	p, err = LoadPromptTemplates(filepath.Join(fileDir, "prompt.txt"), overridden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := p.Render(promptFileTemplate, PromptVars{Standard: "CERT C"}); got != "Follow CERT C from the prompt directory" {
+		t.Errorf("Render = %q, want the fragment of the prompt directory", got)
+	}
+}
+
+func TestPromptLanguageOverride(t *testing.T) {
+	p, err := LoadPromptTemplates("", writePrompts(t, map[string]string{
+		"fix.user.tmpl":           "shared {{.Language}}",
+		"python.fix.user.tmpl":    "python only",
+		"python.triage.user.tmpl": "python triage",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		template string
+		language string
+		want     string
+	}{
+		{PromptFixUser, "python", "python only"},
+		{PromptFixUser, "c", "shared c"},
+		{PromptFixUser, "", "shared "},
+		{PromptTriageUser, "python", "python triage"},
+		{PromptTriageUser, "c", "FileName: a.c"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.template+"/"+tt.language, func(t *testing.T) {
+			got, err := p.Render(tt.template, PromptVars{Language: tt.language, FileName: "a.c"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(got, tt.want) {
+				t.Errorf("Render = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := p.Render("unknown", PromptVars{Language: "python"}); err == nil {
+		t.Error("rendered an unknown template")
+	}
+}
@@ -0,0 +1,239 @@
+package lspserver
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/TobiasYin/go-lsp/logs"
+	"github.com/TobiasYin/go-lsp/lsp/defines"
+)
+
+// fixContextLines around a finding are sent when no enclosing function is
+// found.
+const fixContextLines = 10
+
+// maxActionTitle keeps code action titles readable in the editor menu.
+const maxActionTitle = 60
+
+/*
+ * relevantDiagnostics picks the stored findings a code action request is
+ * about: the diagnostics the client sent in the context or, if it sent none,
+ * every finding on the selected lines.
+ * @param req The code action request
+ * @param diagnostics The stored findings of the document
+ * @return diagnostics The findings to offer fixes for
+ */
+func relevantDiagnostics(req *defines.CodeActionParams, diagnostics []LspDiagnostic) []LspDiagnostic {
+	var relevant []LspDiagnostic
+	if len(req.Context.Diagnostics) > 0 {
+		for _, d := range diagnostics {
+			for _, c := range req.Context.Diagnostics {
+				if fmt.Sprint(c.Code) == d.Rule && int(c.Range.Start.Line)+1 == d.LineNumber {
+					relevant = append(relevant, d)
+					break
+				}
+			}
+		}
+		return relevant
+	}
+
+	first, last := int(req.Range.Start.Line)+1, int(req.Range.End.Line)+1
+	for _, d := range diagnostics {
+		if d.LineNumber >= first && d.LineNumber <= last {
+			relevant = append(relevant, d)
+		}
+	}
+	return relevant
+}
+
+// fixAction is the quick fix offered for one finding. The edit is computed
+// when the client resolves it.
+func (l *lspServer) fixAction(uri defines.DocumentUri, d LspDiagnostic, rules *RuleSet) defines.CodeAction {
+	kind := defines.CodeActionKindQuickFix
+	preferred := true
+	diagnostics := []defines.Diagnostic{l.toDiagnostic(uri, d, rules)}
+
+	title := fmt.Sprintf("Fix %s: %s", d.Rule, d.Description)
+	if runes := []rune(title); len(runes) > maxActionTitle {
+		title = strings.TrimSpace(string(runes[:maxActionTitle-3])) + "..."
+	}
+
+	return defines.CodeAction{
+		Title:       title + " [FuzzLSP]",
+		Kind:        &kind,
+		Diagnostics: &diagnostics,
+		IsPreferred: &preferred,
+		Data: map[string]interface{}{
+			"uri":         uri,
+			"range":       diagnosticRange(d),
+			"rule":        d.Rule,
+			"line":        d.LineNumber,
+			"description": d.Description,
+		},
+	}
+}
+
+/*
+ * resolveFix asks the backend to fix one finding in the function around it
+ * and turns the answer into edits of the changed lines only.
+ * @param ctx The context of the request
+ * @param state The state of the session
+ * @param req The code action to resolve
+ * @param uri The document URI
+ * @param data The action data set by fixAction
+ * @return action The action with its edit
+ * @return error Any error that occurred while fixing
+ */
+func (l *lspServer) resolveFix(ctx context.Context, state *sessionState, req *defines.CodeAction, uri string, data map[string]interface{}) (*defines.CodeAction, error) {
+	rule, _ := data["rule"].(string)
+	line, _ := data["line"].(float64)
+	description, _ := data["description"].(string)
+
+	finding, ok := l.findDiagnostic(state, uri, rule, int(line), description)
+	if !ok {
+		return nil, fmt.Errorf("finding %s on line %d is gone", rule, int(line))
+	}
+
+	text, err := l.documentText(state, uri)
+	if err != nil {
+		logs.Printf("Error loading document content: %s", err)
+		return nil, err
+	}
+
+	start, end := l.fixRegion(state, uri, text, finding.LineNumber)
+	code := lineRange(text, start, end)
+
+	findings := []LspDiagnostic{finding}
+	profile, standard := l.promptTarget(state, uri, findings)
+	response, err := l.backend.FixFindings(state.backendContext(ctx), uri, profile, standard, code, start, findings, l.rulesPromptText(state, uri, findings))
+	if err != nil {
+		logs.Printf("LLM error for fix: %v", err)
+		return nil, err
+	}
+
+	refactoring, err := BuildRefactoring(uri, profile, code, start, response)
+	if err != nil {
+		logs.Printf("Unusable fix for %s on line %d: %v", rule, finding.LineNumber, err)
+		return nil, err
+	}
+	if len(refactoring.Edits) == 0 {
+		return nil, fmt.Errorf("no change suggested for %s on line %d", rule, finding.LineNumber)
+	}
+	logs.Printf("[+] Fix for %s on line %d:\n%s", rule, finding.LineNumber, refactoring.Diff)
+
+	verification, err := l.checkFix(ctx, state, uri, text, refactoring, findings)
+	if err != nil {
+		logs.Printf("%v", err)
+		return nil, err
+	}
+	l.showNote(ctx, req, verification)
+
+	changes := map[string][]defines.TextEdit{uri: refactoring.Edits}
+	req.Edit = &defines.WorkspaceEdit{Changes: &changes}
+	return req, nil
+}
+
+/*
+ * resolveRefactor asks the backend to rewrite the function around a line
+ * together with the findings in it and turns the answer into edits of the
+ * changed lines only.
+ * @param ctx The context of the request
+ * @param state The state of the session
+ * @param req The code action to resolve
+ * @param uri The document URI
+ * @param text The document content
+ * @param line The 1-based line the action was requested on
+ * @return action The action with its edit
+ * @return error Any error that occurred while refactoring
+ */
+func (l *lspServer) resolveRefactor(ctx context.Context, state *sessionState, req *defines.CodeAction, uri string, text string, line int) (*defines.CodeAction, error) {
+	start, end := l.fixRegion(state, uri, text, line)
+	code := lineRange(text, start, end)
+
+	diagnostics, _ := state.documents.GetDiagnostics(uri)
+	findings := diagnosticsIn(diagnostics, start, end)
+
+	profile, standard := l.promptTarget(state, uri, findings)
+	response, err := l.backend.RefactorCode(state.backendContext(ctx), uri, profile, standard, code, start, findings)
+	if err != nil {
+		logs.Printf("LLM error for refactor: %v", err)
+		return nil, err
+	}
+
+	refactoring, err := BuildRefactoring(uri, profile, code, start, response)
+	if err != nil {
+		logs.Printf("Unusable refactoring of lines %d-%d: %v", start, end, err)
+		return nil, err
+	}
+	if len(refactoring.Edits) == 0 {
+		return nil, fmt.Errorf("no change suggested for lines %d-%d", start, end)
+	}
+	logs.Printf("[+] Refactoring of lines %d-%d:\n%s", start, end, refactoring.Diff)
+
+	// without findings in the region there is nothing to verify against
+	if len(findings) > 0 {
+		verification, err := l.checkFix(ctx, state, uri, text, refactoring, findings)
+		if err != nil {
+			logs.Printf("%v", err)
+			return nil, err
+		}
+		l.showNote(ctx, req, verification)
+	}
+
+	changes := map[string][]defines.TextEdit{uri: refactoring.Edits}
+	req.Edit = &defines.WorkspaceEdit{Changes: &changes}
+	return req, nil
+}
+
+// rulesPromptText is the title and text of the rules of findings, one per
+// line, for the fix prompt.
+func (l *lspServer) rulesPromptText(state *sessionState, uri string, findings []LspDiagnostic) string {
+	rules := l.documentRules(state, uri)
+	var lines []string
+	for _, id := range strings.Split(FindingRuleIDs(findings), ", ") {
+		if r, ok := rules.Lookup(id); ok {
+			lines = append(lines, r.ID+" "+r.Title+": "+r.Description)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// findDiagnostic looks up a stored finding by rule, line and description.
+func (l *lspServer) findDiagnostic(state *sessionState, uri string, rule string, line int, description string) (LspDiagnostic, bool) {
+	diagnostics, err := state.documents.GetDiagnostics(uri)
+	if err != nil {
+		return LspDiagnostic{}, false
+	}
+	for _, d := range diagnostics {
+		if d.Rule == rule && d.LineNumber == line && (description == "" || d.Description == description) {
+			return d, true
+		}
+	}
+	return LspDiagnostic{}, false
+}
+
+// fixRegion is the function enclosing a line or, for languages without brace
+// blocks or code outside of functions, the lines around it.
+func (l *lspServer) fixRegion(state *sessionState, uri string, text string, line int) (int, int) {
+	if profile, ok := state.profile(uri); ok && (profile.CLike || profile.Chunker == ChunkerBlocks) {
+		if f, ok := FunctionAt(FindFunctions(text), line); ok {
+			return f.StartLine, f.EndLine
+		}
+	}
+	_, start, end := codeAround(text, line, fixContextLines)
+	return start, end
+}
+
+// documentText returns the text the session has of the document, with the
+// unsaved changes, and reads it from disk if the document isn't open.
+func (l *lspServer) documentText(state *sessionState, uri string) (string, error) {
+	if text, err := state.documents.Load(uri); err == nil {
+		return text, nil
+	}
+	filePath, err := ConvertFileURIToPath(uri)
+	if err != nil {
+		return "", err
+	}
+	return ReadFileContent(filePath)
+}
@@ -0,0 +1,213 @@
+package lspserver
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/TobiasYin/go-lsp/lsp/defines"
+)
+
+// diffContext is the number of unchanged lines around each unified diff hunk.
+const diffContext = 3
+
+// Refactoring is a model's rewrite of a region of a document. Lines are
+// 1-based and inclusive.
+type Refactoring struct {
+	StartLine   int
+	EndLine     int
+	Original    string
+	Replacement string
+	Diff        string
+	Edits       []defines.TextEdit
+}
+
+/*
+ * BuildRefactoring turns a model response for a region into edits. The code
+ * is taken from the fenced block of the response and, for languages with
+ * brace blocks, must still tokenize with balanced brackets.
+ * @param uri The document URI, used as the file name of the diff
+ * @param profile The language profile of the document, may be nil
+ * @param original The region as sent to the model
+ * @param startLine The 1-based line the region starts on
+ * @param response The raw model response
+ * @return refactoring The validated rewrite with its diff and edits
+ * @return error The reason the response can't be used
+ */
+func BuildRefactoring(uri string, profile *LanguageProfile, original string, startLine int, response string) (*Refactoring, error) {
+	replacement := ExtractCode(response)
+	if strings.TrimSpace(replacement) == "" {
+		return nil, errors.New("the response contains no code")
+	}
+	if profile != nil && (profile.CLike || profile.Chunker == ChunkerBlocks) {
+		// a region that was unbalanced to begin with can't be checked
+		if CheckBalanced(original) == nil {
+			if err := CheckBalanced(replacement); err != nil {
+				return nil, fmt.Errorf("the suggested code is incomplete: %w", err)
+			}
+		}
+	}
+
+	return &Refactoring{
+		StartLine:   startLine,
+		EndLine:     startLine + strings.Count(strings.TrimSuffix(original, "\n"), "\n"),
+		Original:    original,
+		Replacement: replacement,
+		Diff:        UnifiedDiff(uri, original, replacement, startLine),
+		Edits:       MinimalEdits(original, replacement, startLine),
+	}, nil
+}
+
+/*
+ * CheckBalanced tokenizes C-like code and checks that every bracket is
+ * closed by the matching one and that no literal or comment is left open.
+ * @param text The code
+ * @return error The first mismatch, nil if the code is balanced
+ */
+func CheckBalanced(text string) error {
+	closing := map[string]string{")": "(", "]": "[", "}": "{"}
+	var open []CToken
+	for _, t := range TokenizeC(text) {
+		if t.Kind == CTokenComment || t.Kind == CTokenDirective {
+			if strings.HasPrefix(t.Text, "/*") && (len(t.Text) < 4 || !strings.HasSuffix(t.Text, "*/")) {
+				return fmt.Errorf("unterminated comment on line %d", t.Line)
+			}
+			continue
+		}
+		switch t.Text {
+		case "(", "[", "{":
+			open = append(open, t)
+		case ")", "]", "}":
+			if len(open) == 0 || open[len(open)-1].Text != closing[t.Text] {
+				return fmt.Errorf("unexpected `%s` on line %d", t.Text, t.Line)
+			}
+			open = open[:len(open)-1]
+		default:
+			if unterminatedLiteral(t) {
+				return fmt.Errorf("unterminated literal on line %d", t.Line)
+			}
+		}
+	}
+	if len(open) > 0 {
+		t := open[len(open)-1]
+		return fmt.Errorf("`%s` on line %d is never closed", t.Text, t.Line)
+	}
+	return nil
+}
+
+func unterminatedLiteral(t CToken) bool {
+	switch t.Kind {
+	case CTokenString:
+		return len(t.Text) < 2 || !strings.HasSuffix(t.Text, "\"")
+	case CTokenChar:
+		return len(t.Text) < 2 || !strings.HasSuffix(t.Text, "'")
+	}
+	return false
+}
+
+/*
+ * UnifiedDiff renders the changes between two versions of a region in the
+ * unified format, with line numbers relative to the document.
+ * @param name The file name in the diff header
+ * @param original The original region
+ * @param replacement The new region
+ * @param startLine The 1-based line the region starts on
+ * @return diff The diff, empty if nothing changed
+ */
+func UnifiedDiff(name string, original string, replacement string, startLine int) string {
+	a := splitRegion(original)
+	hunks := diffLines(a, splitRegion(replacement))
+	if len(hunks) == 0 {
+		return ""
+	}
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- a/%s\n+++ b/%s\n", name, name)
+	delta := 0
+	for i := 0; i < len(hunks); {
+		// hunks whose context overlaps are printed together
+		j := i
+		for j+1 < len(hunks) && hunks[j+1].OldStart-(hunks[j].OldStart+len(hunks[j].Removed)) <= 2*diffContext {
+			j++
+		}
+		from := max(hunks[i].OldStart-diffContext, 0)
+		to := min(hunks[j].OldStart+len(hunks[j].Removed)+diffContext, len(a))
+
+		var body strings.Builder
+		oldCount, newCount := 0, 0
+		k := from
+		for h := i; h <= j; h++ {
+			for ; k < hunks[h].OldStart; k++ {
+				body.WriteString(" " + a[k] + "\n")
+				oldCount++
+				newCount++
+			}
+			for _, line := range hunks[h].Removed {
+				body.WriteString("-" + line + "\n")
+				oldCount++
+			}
+			for _, line := range hunks[h].Added {
+				body.WriteString("+" + line + "\n")
+				newCount++
+			}
+			k += len(hunks[h].Removed)
+		}
+		for ; k < to; k++ {
+			body.WriteString(" " + a[k] + "\n")
+			oldCount++
+			newCount++
+		}
+
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n", hunkRange(from+startLine, oldCount), hunkRange(from+delta+startLine, newCount))
+		out.WriteString(body.String())
+		delta += newCount - oldCount
+		i = j + 1
+	}
+	return out.String()
+}
+
+// hunkRange formats one side of a hunk header, an empty side refers to the
+// line before it.
+func hunkRange(line int, count int) string {
+	if count == 0 {
+		line--
+	}
+	return fmt.Sprintf("%d,%d", line, count)
+}
+
+/*
+ * diagnosticsIn returns the findings on the 1-based lines start..end.
+ * @param diagnostics The findings of a document
+ * @param start The first line
+ * @param end The last line
+ * @return diagnostics The findings in the region
+ */
+func diagnosticsIn(diagnostics []LspDiagnostic, start int, end int) []LspDiagnostic {
+	var in []LspDiagnostic
+	for _, d := range diagnostics {
+		if d.LineNumber >= start && d.LineNumber <= end {
+			in = append(in, d)
+		}
+	}
+	return in
+}
+
+// FindingRuleIDs lists the distinct rules of findings, separated by commas.
+func FindingRuleIDs(diagnostics []LspDiagnostic) string {
+	var ids []string
+	for _, d := range diagnostics {
+		if !containsString(ids, d.Rule) {
+			ids = append(ids, d.Rule)
+		}
+	}
+	return strings.Join(ids, ", ")
+}
+
+// FindingsPromptText lists findings for a prompt, one per line.
+func FindingsPromptText(diagnostics []LspDiagnostic) string {
+	var lines []string
+	for _, d := range diagnostics {
+		lines = append(lines, FindingPromptText(d))
+	}
+	return strings.Join(lines, "\n")
+}
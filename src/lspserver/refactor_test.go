@@ -0,0 +1,125 @@
+package lspserver
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// numberedLines returns the lines l1..ln.
+func numberedLines(n int) string {
+	lines := make([]string, n)
+	for i := range lines {
+		lines[i] = fmt.Sprintf("l%d", i+1)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		name        string
+		original    string
+		replacement string
+		startLine   int
+		want        string
+	}{
+		{"unchanged", numberedLines(5), numberedLines(5) + "\n", 1, ""},
+		{"crlf only", "a\r\nb", "a\nb", 1, ""},
+		{
+			name:        "one line",
+			original:    numberedLines(10),
+			replacement: strings.Replace(numberedLines(10), "l5", "L5", 1),
+			startLine:   1,
+			want:        "--- a/a.c\n+++ b/a.c\n@@ -2,7 +2,7 @@\n l2\n l3\n l4\n-l5\n+L5\n l6\n l7\n l8\n",
+		},
+		{
+			name:        "document line numbers",
+			original:    numberedLines(10),
+			replacement: strings.Replace(numberedLines(10), "l5", "L5", 1),
+			startLine:   101,
+			want:        "--- a/a.c\n+++ b/a.c\n@@ -102,7 +102,7 @@\n l2\n l3\n l4\n-l5\n+L5\n l6\n l7\n l8\n",
+		},
+		{
+			name:        "separate hunks",
+			original:    numberedLines(20),
+			replacement: strings.Replace(strings.Replace(numberedLines(20), "l2\n", "L2\nextra\n", 1), "l18", "L18", 1),
+			startLine:   1,
+			want: "--- a/a.c\n+++ b/a.c\n" +
+				"@@ -1,5 +1,6 @@\n l1\n-l2\n+L2\n+extra\n l3\n l4\n l5\n" +
+				"@@ -15,6 +16,6 @@\n l15\n l16\n l17\n-l18\n+L18\n l19\n l20\n",
+		},
+		{
+			name:        "overlapping context",
+			original:    numberedLines(12),
+			replacement: strings.Replace(strings.Replace(numberedLines(12), "l3\n", "L3\n", 1), "l9\n", "L9\n", 1),
+			startLine:   1,
+			want:        "--- a/a.c\n+++ b/a.c\n@@ -1,12 +1,12 @@\n l1\n l2\n-l3\n+L3\n l4\n l5\n l6\n l7\n l8\n-l9\n+L9\n l10\n l11\n l12\n",
+		},
+		{
+			name:        "insertion",
+			original:    numberedLines(5),
+			replacement: strings.Replace(numberedLines(5), "l3\n", "l3\nx\ny\n", 1),
+			startLine:   1,
+			want:        "--- a/a.c\n+++ b/a.c\n@@ -1,5 +1,7 @@\n l1\n l2\n l3\n+x\n+y\n l4\n l5\n",
+		},
+		{
+			name:        "deletion",
+			original:    numberedLines(5),
+			replacement: strings.TrimPrefix(numberedLines(5), "l1\n"),
+			startLine:   1,
+			want:        "--- a/a.c\n+++ b/a.c\n@@ -1,4 +1,3 @@\n-l1\n l2\n l3\n l4\n",
+		},
+		{
+			name:        "replaced region",
+			original:    "a\nb",
+			replacement: "c",
+			startLine:   7,
+			want:        "--- a/a.c\n+++ b/a.c\n@@ -7,2 +7,1 @@\n-a\n-b\n+c\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := UnifiedDiff("a.c", tt.original, tt.replacement, tt.startLine); got != tt.want {
+				t.Errorf("UnifiedDiff =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildRefactoring(t *testing.T) {
+	c, _ := ProfileFor("c", "")
+	python, _ := ProfileFor("python", "")
+	original := "int f(void)\n{\n    return 1;\n}\n"
+	tests := []struct {
+		name     string
+		profile  *LanguageProfile
+		original string
+		response string
+		err      string
+	}{
+		{"fenced", c, original, "Here:\n```c\nint f(void)\n{\n    return 2;\n}\n```", ""},
+		{"no code", c, original, "```\n\n```", "contains no code"},
+		{"unbalanced", c, original, "```c\nint f(void)\n{\n    return 2;\n```", "never closed"},
+		{"unterminated string", c, original, "```c\nint f(void)\n{\n    s = \"x;\n}\n```", "unterminated literal"},
+		{"unbalanced original", c, "    return 1;\n}\n", "```c\n    return 2;\n}\n```", ""},
+		{"not checked for python", python, "def f():\n    return 1\n", "```python\ndef f():\n    return (2\n```", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := BuildRefactoring("a.c", tt.profile, tt.original, 10, tt.response)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines := strings.Count(strings.TrimSuffix(tt.original, "\n"), "\n") + 1
+			if r.StartLine != 10 || r.EndLine != 9+lines || r.Diff == "" || len(r.Edits) == 0 {
+				t.Errorf("refactoring %+v", r)
+			}
+		})
+	}
+}
@@ -0,0 +1,301 @@
+package lspserver
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/TobiasYin/go-lsp/jsonrpc"
+	"github.com/TobiasYin/go-lsp/logs"
+)
+
+// ReplayTimeout is how long the replay waits for a recorded message.
+const ReplayTimeout = 5 * time.Second
+
+// replayMessage is what the replay needs to know to match two messages.
+type replayMessage struct {
+	ID     json.RawMessage `json:"id"`
+	Method string          `json:"method"`
+}
+
+/*
+ * replayKey names a message so that the recorded and the replayed one can be
+ * matched: responses by their ID, requests and notifications by their method,
+ * all counted in case they repeat. Batches are told apart by their order.
+ * @param content The message
+ * @param seen How often each name was sent so far, updated
+ * @return key The key of the message
+ */
+func replayKey(content []byte, seen map[string]int) string {
+	name := "batch"
+	var msg replayMessage
+	if err := json.Unmarshal(content, &msg); err == nil {
+		name = msg.Method
+		if name == "" {
+			name = "response " + string(msg.ID)
+		}
+	}
+	seen[name]++
+	return fmt.Sprintf("%s #%d", name, seen[name])
+}
+
+// normalizeMessage formats a message with sorted keys so that equal messages
+// compare equal.
+func normalizeMessage(content []byte) string {
+	var v interface{}
+	if err := json.Unmarshal(content, &v); err != nil {
+		return string(content)
+	}
+	normalized, err := json.Marshal(v)
+	if err != nil {
+		return string(content)
+	}
+	return string(normalized)
+}
+
+// firstDifference returns the path of the first value in which two decoded
+// JSON messages differ, e.g. "result.items[2].range".
+func firstDifference(path string, want interface{}, got interface{}) (string, bool) {
+	switch w := want.(type) {
+	case map[string]interface{}:
+		g, ok := got.(map[string]interface{})
+		if !ok {
+			return path, true
+		}
+		keys := make([]string, 0, len(w)+len(g))
+		for key := range w {
+			keys = append(keys, key)
+		}
+		for key := range g {
+			if _, ok := w[key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			sub := key
+			if path != "" {
+				sub = path + "." + key
+			}
+			if p, differs := firstDifference(sub, w[key], g[key]); differs {
+				return p, true
+			}
+		}
+		return "", false
+	case []interface{}:
+		g, ok := got.([]interface{})
+		if !ok {
+			return path, true
+		}
+		for i := 0; i < len(w) && i < len(g); i++ {
+			if p, differs := firstDifference(fmt.Sprintf("%s[%d]", path, i), w[i], g[i]); differs {
+				return p, true
+			}
+		}
+		if len(w) != len(g) {
+			return fmt.Sprintf("%s (%d instead of %d elements)", path, len(g), len(w)), true
+		}
+		return "", false
+	default:
+		if want != got {
+			return path, true
+		}
+		return "", false
+	}
+}
+
+// replaySession replays the messages of one recorded session.
+type replaySession struct {
+	id       int
+	conn     net.Conn
+	received chan []byte
+	got      map[string][]byte // replayed messages not matched yet
+	gotSeen  map[string]int
+	wantSeen map[string]int
+	diffs    int
+}
+
+func (r *replaySession) report(format string, args ...interface{}) {
+	r.diffs++
+	fmt.Printf("session %d: %s\n", r.id, fmt.Sprintf(format, args...))
+}
+
+/*
+ * expect waits for the replayed counterpart of a recorded message and
+ * compares the two.
+ * @param entry The recorded outbound message
+ */
+func (r *replaySession) expect(entry jsonrpc.TraceEntry) {
+	if entry.Message == nil {
+		r.expectRaw(entry)
+		return
+	}
+	key := replayKey(entry.Message, r.wantSeen)
+	timeout := time.After(ReplayTimeout)
+	for {
+		if content, ok := r.got[key]; ok {
+			delete(r.got, key)
+			var want, got interface{}
+			json.Unmarshal(entry.Message, &want)
+			json.Unmarshal(content, &got)
+			if path, differs := firstDifference("", want, got); differs {
+				r.report("%s differs in %s\n  recorded: %s\n  replayed: %s", key, path,
+					normalizeMessage(entry.Message), normalizeMessage(content))
+			}
+			return
+		}
+		select {
+		case content, ok := <-r.received:
+			if !ok {
+				r.report("%s missing, the server closed the session", key)
+				return
+			}
+			r.got[replayKey(content, r.gotSeen)] = content
+		case <-timeout:
+			r.report("%s missing after %v\n  recorded: %s", key, ReplayTimeout, normalizeMessage(entry.Message))
+			return
+		}
+	}
+}
+
+// expectRaw reports a recorded outbound message that wasn't JSON, the
+// server never sends one.
+func (r *replaySession) expectRaw(entry jsonrpc.TraceEntry) {
+	r.report("recorded a message that is not JSON: %q", entry.Raw)
+}
+
+// send writes a recorded inbound message to the server.
+func (r *replaySession) send(entry jsonrpc.TraceEntry) error {
+	content := []byte(entry.Message)
+	if content == nil {
+		content = []byte(entry.Raw)
+	}
+	_, err := fmt.Fprintf(r.conn, "Content-Length: %d\r\n\r\n%s", len(content), content)
+	return err
+}
+
+/*
+ * run feeds the inbound messages of the session to the server. Before every
+ * inbound message it waits for the outbound messages recorded before it, so
+ * the server answers its own requests in the recorded order.
+ * @param l The server with the mock backend
+ * @param entries The messages of the session in recorded order
+ */
+func (r *replaySession) run(l *lspServer, entries []jsonrpc.TraceEntry) {
+	serverConn, conn := net.Pipe()
+	r.conn = conn
+	go l.server.ServeConn(serverConn)
+	go func() {
+		defer close(r.received)
+		reader := bufio.NewReader(conn)
+		for {
+			content, err := jsonrpc.ReadMessage(reader)
+			if err != nil {
+				return
+			}
+			r.received <- content
+		}
+	}()
+
+	var expected []jsonrpc.TraceEntry
+	for _, entry := range entries {
+		if entry.Direction == jsonrpc.TraceOut {
+			expected = append(expected, entry)
+			continue
+		}
+		for _, e := range expected {
+			r.expect(e)
+		}
+		expected = nil
+		if err := r.send(entry); err != nil {
+			r.report("the server closed the session: %v", err)
+			break
+		}
+	}
+	for _, e := range expected {
+		r.expect(e)
+	}
+
+	conn.Close()
+	for content := range r.received {
+		r.got[replayKey(content, r.gotSeen)] = content
+	}
+	keys := make([]string, 0, len(r.got))
+	for key := range r.got {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		r.report("%s unexpected\n  replayed: %s", key, normalizeMessage(r.got[key]))
+	}
+}
+
+/*
+ * Replay feeds a trace recorded with -trace into a server with the mock
+ * backend and prints where the responses differ from the recording.
+ * @param name The name of the server
+ * @param path The trace file
+ * @return diffs The number of differences, -1 if the trace couldn't be read
+ */
+func Replay(name string, path string) int {
+	f, err := os.Open(path)
+	if err != nil {
+		fmt.Printf("replay: %v\n", err)
+		return -1
+	}
+	entries, err := jsonrpc.ReadTrace(f)
+	f.Close()
+	if err != nil {
+		fmt.Printf("replay: %s: %v\n", path, err)
+		return -1
+	}
+
+	*ParamBackend = "mock"
+	l, err := newServer(name, Listen{}, nil)
+	if err != nil {
+		fmt.Printf("replay: %v\n", err)
+		return -1
+	}
+
+	sessions := map[int][]jsonrpc.TraceEntry{}
+	var ids []int
+	for _, entry := range entries {
+		if _, ok := sessions[entry.Session]; !ok {
+			ids = append(ids, entry.Session)
+		}
+		sessions[entry.Session] = append(sessions[entry.Session], entry)
+	}
+
+	diffs := 0
+	for _, id := range ids {
+		logs.Printf("Replaying session %d with %d messages", id, len(sessions[id]))
+		r := &replaySession{
+			id:       id,
+			received: make(chan []byte, 16),
+			got:      map[string][]byte{},
+			gotSeen:  map[string]int{},
+			wantSeen: map[string]int{},
+		}
+		r.run(l, sessions[id])
+		diffs += r.diffs
+	}
+	fmt.Printf("replayed %d messages of %d sessions, %d differences\n", len(entries), len(ids), diffs)
+	return diffs
+}
+
+// openTrace opens the trace file of -trace, appending to an existing trace.
+func openTrace(path string) (*jsonrpc.Tracer, error) {
+	if path == "" {
+		return nil, nil
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("trace: %w", err)
+	}
+	logs.Printf("Tracing messages to %s", path)
+	return jsonrpc.NewTracer(f), nil
+}
@@ -0,0 +1,321 @@
+package lspserver
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/TobiasYin/go-lsp/logs"
+	"github.com/TobiasYin/go-lsp/lsp/defines"
+	"gopkg.in/yaml.v3"
+)
+
+//go:embed rulepacks/*.json
+var builtinRulePacks embed.FS
+
+// DefaultRulePacks is used when -rule-packs is not given.
+const DefaultRulePacks = "misra-c-2012,fuzzlsp-style"
+
+type RuleExample struct {
+	NonCompliant string `json:"non_compliant" yaml:"non_compliant"`
+	Compliant    string `json:"compliant" yaml:"compliant"`
+}
+
+// Rule is a single guideline the code is checked against. ID is the
+// canonical identifier reported in diagnostics (e.g. MISRA-15.6).
+type Rule struct {
+	ID          string        `json:"id" yaml:"id"`
+	Standard    string        `json:"standard" yaml:"standard"`
+	Category    string        `json:"category" yaml:"category"`
+	Severity    string        `json:"severity,omitempty" yaml:"severity,omitempty"`
+	Title       string        `json:"title" yaml:"title"`
+	Description string        `json:"description" yaml:"description"`
+	Rationale   string        `json:"rationale,omitempty" yaml:"rationale,omitempty"`
+	Examples    []RuleExample `json:"examples,omitempty" yaml:"examples,omitempty"`
+
+	// Check names a built-in check (see static_checks.go) that evaluates the
+	// rule without the LLM, Identifiers and Limit parameterize it.
+	Check       string   `json:"check,omitempty" yaml:"check,omitempty"`
+	Identifiers []string `json:"identifiers,omitempty" yaml:"identifiers,omitempty"`
+	Limit       int      `json:"limit,omitempty" yaml:"limit,omitempty"`
+}
+
+// RulePack groups the rules of one standard. Severities maps a rule
+// category (mandatory, required, advisory, ...) to an LSP severity name.
+type RulePack struct {
+	Name       string            `json:"name" yaml:"name"`
+	Standard   string            `json:"standard" yaml:"standard"`
+	Version    string            `json:"version" yaml:"version"`
+	Severities map[string]string `json:"severities" yaml:"severities"`
+	Rules      []Rule            `json:"rules" yaml:"rules"`
+}
+
+// RuleSet is the collection of rule packs selected for a run.
+type RuleSet struct {
+	Packs []*RulePack
+	byID  map[string]ruleRef
+}
+
+type ruleRef struct {
+	pack *RulePack
+	rule *Rule
+}
+
+/*
+ * LoadRulePack reads a rule pack from a YAML (.yaml/.yml) or JSON file.
+ * @param path The rule pack file
+ * @return pack The rule pack
+ * @return error Any error that occurred while reading or decoding
+ */
+func LoadRulePack(path string) (*RulePack, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return decodeRulePack(path, data)
+}
+
+func decodeRulePack(path string, data []byte) (*RulePack, error) {
+	var pack RulePack
+	var err error
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &pack)
+	default:
+		err = json.Unmarshal(data, &pack)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("rule pack %s: %w", path, err)
+	}
+
+	if pack.Name == "" {
+		pack.Name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+	for i := range pack.Rules {
+		if pack.Rules[i].ID == "" {
+			return nil, fmt.Errorf("rule pack %s: rule %d has no id", path, i+1)
+		}
+		if pack.Rules[i].Standard == "" {
+			pack.Rules[i].Standard = pack.Standard
+		}
+	}
+	return &pack, nil
+}
+
+// loadBuiltinRulePack returns one of the packs shipped in ./rulepacks.
+func loadBuiltinRulePack(name string) (*RulePack, error) {
+	path := "rulepacks/" + name + ".json"
+	data, err := builtinRulePacks.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unknown rule pack %s", name)
+	}
+	return decodeRulePack(path, data)
+}
+
+/*
+ * LoadRuleSet loads a comma separated list of rule packs. Each entry is
+ * either the name of a built-in pack (misra-c-2012, autosar-cpp14, cert-c,
+ * kernel-style, fuzzlsp-style, python-pep8, rust-safety, go-style) or the
+ * path to a pack file.
+ * @param spec The rule pack list
+ * @return rules The loaded rule set
+ * @return error Any error that occurred while loading a pack
+ */
+func LoadRuleSet(spec string) (*RuleSet, error) {
+	if strings.TrimSpace(spec) == "" {
+		spec = DefaultRulePacks
+	}
+
+	set := &RuleSet{byID: make(map[string]ruleRef)}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		var pack *RulePack
+		var err error
+		if _, statErr := os.Stat(entry); statErr == nil {
+			pack, err = LoadRulePack(entry)
+		} else {
+			pack, err = loadBuiltinRulePack(entry)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		set.add(pack)
+		logs.Printf("[+] Loaded rule pack %s (%s, %d rules)", pack.Name, pack.Standard, len(pack.Rules))
+	}
+	return set, nil
+}
+
+func (s *RuleSet) add(pack *RulePack) {
+	s.Packs = append(s.Packs, pack)
+	for i := range pack.Rules {
+		s.byID[pack.Rules[i].ID] = ruleRef{pack: pack, rule: &pack.Rules[i]}
+	}
+}
+
+// Rules returns every rule of every pack in load order.
+func (s *RuleSet) Rules() []Rule {
+	var rules []Rule
+	for _, pack := range s.Packs {
+		rules = append(rules, pack.Rules...)
+	}
+	return rules
+}
+
+// Lookup finds a rule by its canonical ID.
+func (s *RuleSet) Lookup(id string) (Rule, bool) {
+	ref, ok := s.lookup(id)
+	if !ok {
+		return Rule{}, false
+	}
+	return *ref.rule, true
+}
+
+/*
+ * Standards names the standards of the rules with the given IDs, e.g.
+ * "MISRA C:2012" or "CERT C, MISRA C:2012". Without IDs, or if none of them
+ * is a rule of the set, it names the standards of all packs.
+ * @param ids The rule IDs
+ * @return standards The standards, empty if the set is empty
+ */
+func (s *RuleSet) Standards(ids ...string) string {
+	var standards []string
+	add := func(standard string) {
+		if standard != "" && !slices.Contains(standards, standard) {
+			standards = append(standards, standard)
+		}
+	}
+	for _, id := range ids {
+		if ref, ok := s.lookup(id); ok {
+			if ref.rule.Standard != "" {
+				add(ref.rule.Standard)
+			} else {
+				add(ref.pack.Standard)
+			}
+		}
+	}
+	if len(standards) == 0 && s != nil {
+		for _, pack := range s.Packs {
+			add(pack.Standard)
+		}
+	}
+	return strings.Join(standards, ", ")
+}
+
+func (s *RuleSet) lookup(id string) (ruleRef, bool) {
+	if s == nil {
+		return ruleRef{}, false
+	}
+	ref, ok := s.byID[id]
+	return ref, ok
+}
+
+/*
+ * LspSeverity maps a diagnostic to an LSP severity. An explicit LSP severity
+ * name (e.g. set by a policy override) wins, then the rule's own severity,
+ * then the pack's mapping for the category and finally the severity string
+ * reported by the model.
+ * @param d The diagnostic to map
+ * @return severity The LSP severity
+ */
+func (s *RuleSet) LspSeverity(d LspDiagnostic) defines.DiagnosticSeverity {
+	if severity, ok := lspSeverityName(d.Severity); ok {
+		return severity
+	}
+	if ref, ok := s.lookup(d.Rule); ok {
+		if severity, ok := parseLspSeverity(ref.rule.Severity); ok {
+			return severity
+		}
+		if severity, ok := parseLspSeverity(ref.pack.Severities[strings.ToLower(d.Severity)]); ok {
+			return severity
+		}
+		if severity, ok := parseLspSeverity(ref.pack.Severities[ref.rule.Category]); ok {
+			return severity
+		}
+	}
+	if severity, ok := parseLspSeverity(d.Severity); ok {
+		return severity
+	}
+	return defines.DiagnosticSeverityHint
+}
+
+// lspSeverityName parses the LSP severity names error, warning, information
+// and hint.
+func lspSeverityName(name string) (defines.DiagnosticSeverity, bool) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "error":
+		return defines.DiagnosticSeverityError, true
+	case "warning":
+		return defines.DiagnosticSeverityWarning, true
+	case "information", "info":
+		return defines.DiagnosticSeverityInformation, true
+	case "hint":
+		return defines.DiagnosticSeverityHint, true
+	}
+	return 0, false
+}
+
+// parseLspSeverity understands both LSP severity names and MISRA categories.
+func parseLspSeverity(name string) (defines.DiagnosticSeverity, bool) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "mandatory", "required":
+		return defines.DiagnosticSeverityError, true
+	case "advisory":
+		return defines.DiagnosticSeverityWarning, true
+	}
+	return lspSeverityName(name)
+}
+
+// PromptText is the rule as inserted into the analysis prompt ({{.Rule}}).
+func (r Rule) PromptText() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s (%s, %s): %s", r.ID, r.Standard, r.Category, r.Description)
+	for _, ex := range r.Examples {
+		if ex.NonCompliant != "" {
+			fmt.Fprintf(&b, "\nNon-compliant example:\n%s", ex.NonCompliant)
+		}
+		if ex.Compliant != "" {
+			fmt.Fprintf(&b, "\nCompliant example:\n%s", ex.Compliant)
+		}
+	}
+	fmt.Fprintf(&b, "\nUse \"%s\" as the \"rule\" field of every finding for this rule.", r.ID)
+	return b.String()
+}
+
+/*
+ * TagRuleResponse parses a model response for a single rule and rewrites
+ * every finding so it carries the canonical rule ID, standard and category.
+ * Responses that can't be parsed are returned unchanged so the caller's
+ * retry handling still sees them.
+ * @param uri The document the response belongs to
+ * @param response The raw model response
+ * @param rule The rule the model was asked about
+ * @return tagged The JSON array of tagged findings
+ */
+func TagRuleResponse(uri string, response string, rule Rule) string {
+	diagnostics, err := DiagnosticsUnmarshal(uri, response)
+	if err != nil {
+		return response
+	}
+
+	for i := range diagnostics {
+		diagnostics[i].Rule = rule.ID
+		diagnostics[i].Source = rule.Standard
+		diagnostics[i].Severity = rule.Category
+	}
+
+	tagged, err := JSONStringify(diagnostics)
+	if err != nil {
+		return response
+	}
+	return tagged
+}
@@ -0,0 +1,198 @@
+package lspserver
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/TobiasYin/go-lsp/lsp/defines"
+)
+
+const yamlRulePack = `
+standard: CERT C
+severities:
+  rule: error
+  recommendation: warning
+rules:
+  - id: CERT-EXP34
+    category: rule
+    title: Do not dereference null pointers
+    description: Check pointers before use
+    examples:
+      - non_compliant: "*p = 1;"
+        compliant: "if (p) *p = 1;"
+  - id: CERT-API00
+    standard: CERT C 2016
+    category: recommendation
+    check: banned_identifiers
+    identifiers: [gets]
+`
+
+const jsonRulePack = `{
+	"name": "team",
+	"standard": "Team C",
+	"severities": {"advisory": "information"},
+	"rules": [{"id": "TEAM-1", "category": "advisory", "severity": "hint", "limit": 3}]
+}`
+
+func writeRulePack(t *testing.T, name string, text string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(text), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadRulePack(t *testing.T) {
+	for _, name := range []string{"cert.yaml", "cert.YML"} {
+		pack, err := LoadRulePack(writeRulePack(t, name, yamlRulePack))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if pack.Name != "cert" || pack.Standard != "CERT C" || len(pack.Rules) != 2 || pack.Severities["recommendation"] != "warning" {
+			t.Fatalf("%s: pack %+v", name, pack)
+		}
+		exp, api := pack.Rules[0], pack.Rules[1]
+		if exp.Standard != "CERT C" || len(exp.Examples) != 1 || exp.Examples[0].Compliant != "if (p) *p = 1;" {
+			t.Errorf("%s: rule %+v, want the pack's standard and the example", name, exp)
+		}
+		if api.Standard != "CERT C 2016" || api.Check != "banned_identifiers" || len(api.Identifiers) != 1 || api.Identifiers[0] != "gets" {
+			t.Errorf("%s: rule %+v, want its own standard and the check", name, api)
+		}
+	}
+
+	pack, err := LoadRulePack(writeRulePack(t, "team.json", jsonRulePack))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pack.Name != "team" || len(pack.Rules) != 1 || pack.Rules[0].Standard != "Team C" || pack.Rules[0].Limit != 3 {
+		t.Errorf("pack %+v", pack)
+	}
+}
+
+func TestLoadRulePackErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		text string
+		want string
+	}{
+		{"invalid yaml", "bad.yaml", "rules: [id: x", "rule pack"},
+		{"invalid json", "bad.json", `{"rules": [}`, "rule pack"},
+		{"yaml read as json", "bad.txt", yamlRulePack, "rule pack"},
+		{"rule without id", "bad.json", `{"rules": [{"id": "A"}, {"title": "no id"}]}`, "rule 2 has no id"},
+		{"wrong type", "bad.yaml", "rules: {id: x}", "rule pack"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadRulePack(writeRulePack(t, tt.file, tt.text))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+
+	if _, err := LoadRulePack(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("loaded a missing file")
+	}
+}
+
+func TestLoadRuleSet(t *testing.T) {
+	// Every built-in pack loads and has rules
+	for _, name := range []string{"misra-c-2012", "autosar-cpp14", "cert-c", "kernel-style", "fuzzlsp-style", "python-pep8", "rust-safety", "go-style"} {
+		set, err := LoadRuleSet(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(set.Packs) != 1 || len(set.Rules()) == 0 {
+			t.Errorf("%s: %d packs with %d rules", name, len(set.Packs), len(set.Rules()))
+		}
+	}
+
+	set, err := LoadRuleSet("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(set.Packs) != len(strings.Split(DefaultRulePacks, ",")) {
+		t.Errorf("default rule set has %d packs, want %s", len(set.Packs), DefaultRulePacks)
+	}
+
+	// Files and built-in packs can be mixed, later packs win on the same ID
+	path := writeRulePack(t, "team.json", jsonRulePack)
+	override := writeRulePack(t, "override.json", `{"standard": "Other", "rules": [{"id": "TEAM-1", "title": "replaced"}]}`)
+	set, err = LoadRuleSet(" fuzzlsp-style, " + path + ",," + override)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(set.Packs) != 3 {
+		t.Fatalf("%d packs, want 3", len(set.Packs))
+	}
+	if rule, ok := set.Lookup("TEAM-1"); !ok || rule.Title != "replaced" {
+		t.Errorf("TEAM-1 = %+v, want the rule of the last pack", rule)
+	}
+	if got := set.Standards("TEAM-1", "unknown"); got != "Other" {
+		t.Errorf("Standards = %q, want Other", got)
+	}
+
+	for _, spec := range []string{"no-such-pack", "misra-c-2012," + writeRulePack(t, "bad.json", "{")} {
+		if _, err := LoadRuleSet(spec); err == nil {
+			t.Errorf("loaded %s", spec)
+		}
+	}
+}
+
+func TestLspSeverity(t *testing.T) {
+	set := &RuleSet{byID: make(map[string]ruleRef)}
+	set.add(&RulePack{
+		Severities: map[string]string{"required": "warning", "advisory": "hint", "rule": "information", "major": "error"},
+		Rules: []Rule{
+			{ID: "REQ", Category: "required"},
+			{ID: "ADV", Category: "advisory"},
+			{ID: "OWN", Category: "advisory", Severity: "error"},
+			{ID: "NONE", Category: "unmapped"},
+		},
+	})
+	tests := []struct {
+		name string
+		d    LspDiagnostic
+		want defines.DiagnosticSeverity
+	}{
+		{"explicit lsp name wins", LspDiagnostic{Rule: "OWN", Severity: "Information"}, defines.DiagnosticSeverityInformation},
+		{"rule severity", LspDiagnostic{Rule: "OWN", Severity: "advisory"}, defines.DiagnosticSeverityError},
+		{"pack mapping of the reported severity", LspDiagnostic{Rule: "ADV", Severity: "Major"}, defines.DiagnosticSeverityError},
+		{"pack mapping of the category", LspDiagnostic{Rule: "REQ", Severity: "required"}, defines.DiagnosticSeverityWarning},
+		{"category overrides the model", LspDiagnostic{Rule: "ADV", Severity: "critical"}, defines.DiagnosticSeverityHint},
+		{"reported misra category", LspDiagnostic{Rule: "NONE", Severity: "mandatory"}, defines.DiagnosticSeverityError},
+		{"unknown rule", LspDiagnostic{Rule: "X", Severity: "advisory"}, defines.DiagnosticSeverityWarning},
+		{"nothing known", LspDiagnostic{Rule: "X", Severity: "critical"}, defines.DiagnosticSeverityHint},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := set.LspSeverity(tt.d); got != tt.want {
+				t.Errorf("LspSeverity = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	var empty *RuleSet
+	if got := empty.LspSeverity(LspDiagnostic{Severity: "warning"}); got != defines.DiagnosticSeverityWarning {
+		t.Errorf("LspSeverity without rules = %v", got)
+	}
+}
+
+func TestTagRuleResponse(t *testing.T) {
+	rule := Rule{ID: "MISRA-15.6", Standard: "MISRA C:2012", Category: "required"}
+	tagged := TagRuleResponse("file:///a.c", `[{"line_number": 3, "rule": "15.6", "description": "no braces"}]`, rule)
+	diagnostics, err := DiagnosticsUnmarshal("file:///a.c", tagged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diagnostics) != 1 || diagnostics[0].Rule != "MISRA-15.6" || diagnostics[0].Source != "MISRA C:2012" || diagnostics[0].Severity != "required" {
+		t.Errorf("tagged %+v", diagnostics)
+	}
+	if got := TagRuleResponse("file:///a.c", "no json", rule); got != "no json" {
+		t.Errorf("unparsable response = %q, want it unchanged", got)
+	}
+}
@@ -11,8 +11,10 @@ import (
 	"io/ioutil"
 	"net/url"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/TobiasYin/go-lsp/jsonrpc"
 	"github.com/TobiasYin/go-lsp/logs"
@@ -20,21 +22,13 @@ import (
 	"github.com/TobiasYin/go-lsp/lsp/defines"
 )
 
-func (s *lspServer) Handle(ctx context.Context, conn *jsonrpc.Conn, req *jsonrpc.RequestMessage) {
-	logs.Printf("Handling Method...\n")
-	if req.Method == "window/showGeneratedCode" {
-		fmt.Println("Received a request for someMethod")
-	} else if req.Method == "analysisStarted" {
-		fmt.Println("Analysis Started")
-	} else if req.Method == "analysisDone" {
-		fmt.Println("Analysis Done")
-	}
-}
-
 // Keep the lsp protocol implementation separate from the rest of the application
 type LspServer interface {
 	Start(ctx context.Context) error
+	OnInitialize(ctx context.Context, req *defines.InitializeParams) (*defines.InitializeResult, *defines.InitializeError)
 	OnInitialized(ctx context.Context, req *defines.InitializeParams) error
+	OnShutdown(ctx context.Context, req *interface{}) error
+	OnExit(ctx context.Context, req *interface{}) error
 	OnDidOpenTextDocument(ctx context.Context, req *defines.DidOpenTextDocumentParams) error
 	OnDidChangeTextDocument(ctx context.Context, req *defines.DidChangeTextDocumentParams) error
 	OnDidSaveTextDocument(ctx context.Context, req *defines.DidSaveTextDocumentParams) error
@@ -43,28 +37,47 @@ type LspServer interface {
 	OnCompletion(ctx context.Context, req *defines.CompletionParams) (result *[]defines.CompletionItem, err error)
 	OnCodeActionWithSliceCodeAction(ctx context.Context, req *defines.CodeActionParams) (*[]defines.CodeAction, error)
 	OnCodeActionResolve(ctx context.Context, req *defines.CodeAction) (result *defines.CodeAction, err error)
+	OnExecuteCommand(ctx context.Context, req *defines.ExecuteCommandParams) error
+	OnWorkDoneProgressCancel(ctx context.Context, req *defines.WorkDoneProgressCancelParams) error
+	OnDidChangeConfiguration(ctx context.Context, req *defines.DidChangeConfigurationParams) error
 }
 
 type lspServer struct {
-	name      string
-	server    *lsp.Server
-	backend   LspBackend
-	documents LspDocuments
-	conn      *jsonrpc.Conn
-	mutex     sync.Mutex // Ensure thread safety when sending messages
+	name              string
+	server            *lsp.Server
+	backend           LspBackend
+	rules             *RuleSet
+	profileRules      map[string]*RuleSet
+	profileRulesLock  sync.Mutex
+	sessions          sync.Map  // state of every client by *jsonrpc.Session, see session.go
+	analyses          *lruCache // backend analyses shared by the sessions, see session.go
+	explanations      *lruCache // model explanations shown by the hover, see explain.go
+	triages           *lruCache // verdicts on analyzer findings, see triageFindings
+	progressTokens    int64
+	tracer            *jsonrpc.Tracer
+	stdio             bool // the only client is on stdin/stdout, see lifecycle.go
+	watchParents      bool // clients run on this machine, see watchdog.go
+	shutdownRequested atomic.Bool
+	shutdownOnce      sync.Once
+	exitProcess       func(code int) // os.Exit, replaced by the tests
 }
 
+/*
+ * SendNotification sends a notification to the client of the session the
+ * context belongs to. It shares the session's writer with the responses.
+ * @param ctx The context of the handler the notification is sent from
+ * @param method The method of the notification
+ * @param params The params of the notification
+ * @return error Any error that occurred while sending
+ */
 func (l *lspServer) SendNotification(ctx context.Context, method string, params interface{}) error {
-	l.mutex.Lock()
-	defer l.mutex.Unlock()
-
-	if l.conn == nil {
-		logs.Println("Connection is nil, cannot send notification")
-		return fmt.Errorf("connection is nil")
+	session := jsonrpc.SessionFromContext(ctx)
+	if session == nil {
+		logs.Println("No session, cannot send notification")
+		return fmt.Errorf("no client session to send %s to", method)
 	}
 
-	// Use the Notify function to send the notification
-	if err := l.conn.Notify(ctx, method, params); err != nil {
+	if err := session.Notify(ctx, method, params); err != nil {
 		logs.Printf("Failed to send notification: %v\n", err)
 		return fmt.Errorf("failed to send notification: %w", err)
 	}
@@ -87,29 +100,331 @@ func (l *lspServer) Start(ctx context.Context) error {
 		l.backend = NewOpenAiBackend()
 	case "ollama":
 		l.backend = NewOllamaBackend()
+	case "mock":
+		l.backend = NewMockBackend()
 	default:
 		logs.Printf("Invalid backend: %s", *ParamBackend)
 		os.Exit(1)
 	}
 
-	l.documents = NewLspDocuments()
+	l.profileRules = make(map[string]*RuleSet)
+
+	if *ParamProfilesFile != "" {
+		if err := LoadLanguageProfiles(*ParamProfilesFile); err != nil {
+			return err
+		}
+	}
 
-	cr := jsonrpc.NewFakeCloserReader(os.Stdin)
-	cw := jsonrpc.NewFakeCloserWriter(os.Stdout)
+	// Without -rule-packs every language uses the packs of its profile
+	if *ParamRulePacks != "" {
+		rules, err := LoadRuleSet(*ParamRulePacks)
+		if err != nil {
+			return err
+		}
+		l.rules = rules
+	}
 
-	l.conn = jsonrpc.NewConn(cr, cw) // Server is the handler
-	logs.Printf("[+] New LSP Document [ %s ] ", l.documents)
 	return l.backend.Start()
 }
 
-func (l *lspServer) Shutdown() {
-	l.mutex.Lock()
-	defer l.mutex.Unlock()
-	if l.conn != nil {
-		logs.Println("Closing connection")
-		l.conn.Close()
-		l.conn = nil
+/*
+* OnInitialize is called with the client's initialize request. It records the
+* workspace folders and capabilities of the session, watches the client
+* process and loads the workspace policy, the capabilities are built from the
+* server options as before.
+*
+* @param ctx The context of the request.
+* @param req The initialize params.
+* @return result The server capabilities
+* @return error Any error that occurred during the request
+ */
+func (l *lspServer) OnInitialize(ctx context.Context, req *defines.InitializeParams) (*defines.InitializeResult, *defines.InitializeError) {
+	state := l.state(ctx)
+	state.folders = workspaceFolders(req)
+	if len(state.folders) > 0 {
+		state.root = state.folders[0]
+	}
+	logs.Printf("OnInitialize: workspace root [%s]", state.root)
+	state.capabilities = req.Capabilities
+	l.watchParent(ctx, req.ProcessId)
+
+	if err := l.loadPolicy(state); err != nil {
+		logs.Printf("Error loading policy: %v", err)
+	}
+	if err := l.loadBaseline(state); err != nil {
+		logs.Printf("Error loading baseline: %v", err)
+	}
+
+	result, err := l.server.DefaultInitialize(ctx, req)
+	if err != nil {
+		logs.Printf("Error building initialize result: %v", err)
+		return nil, &defines.InitializeError{Retry: false}
+	}
+	return &result, nil
+}
+
+// workspaceFolders are the paths of the workspace folders, falling back to
+// rootUri and rootPath.
+func workspaceFolders(req *defines.InitializeParams) []string {
+	var paths []string
+	if folders, ok := req.WorkspaceFolders.([]interface{}); ok {
+		for _, f := range folders {
+			if folder, ok := f.(map[string]interface{}); ok {
+				if uri, ok := folder["uri"].(string); ok {
+					if path, err := ConvertFileURIToPath(uri); err == nil {
+						paths = append(paths, path)
+					}
+				}
+			}
+		}
+	}
+	if len(paths) > 0 {
+		return paths
+	}
+	if uri, ok := req.RootUri.(string); ok && uri != "" {
+		if path, err := ConvertFileURIToPath(uri); err == nil {
+			return []string{path}
+		}
+	}
+	if path, ok := req.RootPath.(string); ok && path != "" {
+		return []string{path}
+	}
+	return nil
+}
+
+// loadPolicy reads the workspace policy of a session and loads the rule packs
+// it selects.
+func (l *lspServer) loadPolicy(state *sessionState) error {
+	policy, err := LoadPolicy(state.root, *ParamPolicyFile)
+	if err != nil {
+		return err
+	}
+	state.policy = policy
+
+	if spec := policy.RulePackSpec(); spec != "" {
+		rules, err := LoadRuleSet(spec)
+		if err != nil {
+			return err
+		}
+		state.rules = rules
+	}
+	return nil
+}
+
+// baselineFile is -baseline or the default location below the workspace root.
+func (state *sessionState) baselineFile() string {
+	if *ParamBaselineFile != "" || state.root == "" {
+		return *ParamBaselineFile
+	}
+	return filepath.Join(state.root, DefaultBaselineFile)
+}
+
+func (l *lspServer) loadBaseline(state *sessionState) error {
+	fileName := state.baselineFile()
+	if fileName == "" {
+		return nil
+	}
+	baseline, err := LoadBaseline(fileName)
+	if err != nil {
+		return err
+	}
+	if baseline != nil {
+		logs.Printf("[+] Loaded baseline %s with %d findings", fileName, len(baseline.Findings))
+	}
+	state.baseline = baseline
+	return nil
+}
+
+// deviationRegisterFile is -deviation-register, a relative path is below the
+// workspace root so that every workspace has its own register.
+func (state *sessionState) deviationRegisterFile() string {
+	fileName := *ParamDeviationRegister
+	if fileName == "" || filepath.IsAbs(fileName) || state.root == "" {
+		return fileName
+	}
+	return filepath.Join(state.root, fileName)
+}
+
+// exportDeviations writes the deviation register of the session if
+// -deviation-register is set.
+func (state *sessionState) exportDeviations() {
+	fileName := state.deviationRegisterFile()
+	if fileName == "" {
+		return
+	}
+	if err := state.deviations.Export(fileName); err != nil {
+		logs.Printf("Failed to export deviation register: %v\n", err)
+	}
+}
+
+// relativePath is the document path relative to the workspace root, as
+// stored in the baseline.
+func (state *sessionState) relativePath(uri string) string {
+	path, err := ConvertFileURIToPath(uri)
+	if err != nil {
+		return uri
+	}
+	if state.root != "" {
+		if rel, err := filepath.Rel(state.root, path); err == nil {
+			return rel
+		}
+	}
+	return path
+}
+
+// profile is the language profile of a document.
+func (state *sessionState) profile(uri string) (*LanguageProfile, bool) {
+	return ProfileFor(state.documents.LoadLanguage(uri), uri)
+}
+
+// ruleSet returns the rule packs selected by the policy or -rule-packs and
+// falls back to the packs of the language profile.
+func (l *lspServer) ruleSet(state *sessionState, profile *LanguageProfile) *RuleSet {
+	if state.rules != nil {
+		return state.rules
 	}
+	if l.rules != nil {
+		return l.rules
+	}
+	l.profileRulesLock.Lock()
+	defer l.profileRulesLock.Unlock()
+	if rules, ok := l.profileRules[profile.RulePacks]; ok {
+		return rules
+	}
+	rules, err := LoadRuleSet(profile.RulePacks)
+	if err != nil {
+		logs.Printf("Error loading rule packs of %s: %v", profile.LanguageID, err)
+		rules, _ = LoadRuleSet(DefaultRulePacks)
+	}
+	l.profileRules[profile.RulePacks] = rules
+	return rules
+}
+
+// plaintextProfile is used for the prompts about documents of no known
+// language.
+var plaintextProfile = &LanguageProfile{LanguageID: "plaintext"}
+
+/*
+ * promptTarget returns the language and standards a prompt about findings in
+ * a document names: the standards of the findings' rules or, for findings of
+ * other tools and prompts without findings, those of the document's packs.
+ * @param state The state of the session
+ * @param uri The document URI
+ * @param findings The findings the prompt is about
+ * @return profile The language profile of the document
+ * @return standard The standards, e.g. "MISRA C:2012"
+ */
+func (l *lspServer) promptTarget(state *sessionState, uri string, findings []LspDiagnostic) (*LanguageProfile, string) {
+	profile, ok := state.profile(uri)
+	if !ok {
+		profile = plaintextProfile
+	}
+	ids := make([]string, 0, len(findings))
+	for _, finding := range findings {
+		ids = append(ids, finding.Rule)
+	}
+	return profile, l.documentRules(state, uri).Standards(ids...)
+}
+
+// enabledRules are the rules of the loaded packs the policy leaves enabled.
+func (l *lspServer) enabledRules(state *sessionState, profile *LanguageProfile) []Rule {
+	return state.policy.SelectRules(l.ruleSet(state, profile).Rules())
+}
+
+// promptRules are the enabled rules without a built-in check.
+func (l *lspServer) promptRules(state *sessionState, profile *LanguageProfile) []Rule {
+	return LlmRules(profile, l.enabledRules(state, profile))
+}
+
+/*
+* runAnalyzer runs the external analyzer (-analyzer) or reads its report
+* (-analyzer-output), lets the backend triage the findings of the document and
+* stores the ones that weren't dismissed.
+*
+* @param ctx The context of the request.
+* @param state The state of the session.
+* @param uri The document URI.
+* @param text The document content.
+* @return error Any error that occurred while running the analyzer
+ */
+func (l *lspServer) runAnalyzer(ctx context.Context, state *sessionState, uri string, text string) error {
+	if *ParamAnalyzerCommand == "" && *ParamAnalyzerOutput == "" {
+		return nil
+	}
+
+	path, err := ConvertFileURIToPath(uri)
+	if err != nil {
+		return err
+	}
+
+	var output []byte
+	if *ParamAnalyzerOutput != "" {
+		output, err = os.ReadFile(*ParamAnalyzerOutput)
+	} else {
+		output, err = RunAnalyzer(*ParamAnalyzerCommand, path)
+	}
+	if err != nil {
+		return err
+	}
+
+	findings, err := ParseAnalyzerOutput(output)
+	if err != nil {
+		return err
+	}
+	findings = AnalyzerFindingsFor(findings, uri, path)
+	logs.Printf("[+] Analyzer reported %d findings for %s", len(findings), uri)
+
+	if !*ParamAnalyzerNoTriage {
+		findings = l.triageFindings(ctx, state, uri, text, findings)
+	}
+	return l.storeDiagnostics(state, uri, text, DiagnosticProviderAnalyzer, findings)
+}
+
+// triageFindings asks the backend about every finding and drops the ones it
+// dismisses. Findings are kept as reported if the backend fails to answer.
+// Verdicts are cached by the finding's rule and line content, so saving a
+// document doesn't triage its unchanged findings again.
+func (l *lspServer) triageFindings(ctx context.Context, state *sessionState, uri string, text string, findings []LspDiagnostic) []LspDiagnostic {
+	lines := strings.Split(text, "\n")
+	var kept []LspDiagnostic
+	for _, finding := range findings {
+		key := triageKey(state.model(), uri, lines, finding)
+		cached, ok := l.triages.Load(key)
+		verdict, _ := cached.(TriageVerdict)
+		if ok {
+			logs.Printf("[+] Using the cached verdict on %s on line %d", finding.Rule, finding.LineNumber)
+		} else {
+			code, startLine, _ := codeAround(text, finding.LineNumber, triageContextLines)
+			profile, standard := l.promptTarget(state, uri, []LspDiagnostic{finding})
+			response, err := l.backend.TriageFinding(state.backendContext(ctx), uri, profile, standard, code, startLine, finding)
+			if err != nil {
+				logs.Printf("Error triaging %s on line %d: %v", finding.Rule, finding.LineNumber, err)
+				kept = append(kept, finding)
+				continue
+			}
+			verdict, err = ParseTriage(response)
+			if err != nil {
+				logs.Printf("Error parsing triage of %s on line %d: %v", finding.Rule, finding.LineNumber, err)
+				kept = append(kept, finding)
+				continue
+			}
+			l.triages.Store(key, verdict)
+		}
+		if verdict.Dismissed() {
+			logs.Printf("[+] Dismissed %s %s on line %d: %s", finding.Source, finding.Rule, finding.LineNumber, verdict.Explanation)
+			continue
+		}
+		finding.Recommendation = strings.TrimSpace(verdict.Explanation + " " + verdict.Recommendation)
+		kept = append(kept, finding)
+	}
+	return kept
+}
+
+// runStaticChecks evaluates the built-in checks and stores their findings.
+func (l *lspServer) runStaticChecks(state *sessionState, uri string, text string, profile *LanguageProfile) error {
+	diagnostics := RunStaticChecks(uri, text, profile, l.enabledRules(state, profile))
+	logs.Printf("[+] Static checks found %d issues in %s", len(diagnostics), uri)
+	return l.storeDiagnostics(state, uri, text, DiagnosticProviderStatic, diagnostics)
 }
 
 /*
@@ -122,45 +437,73 @@ func (l *lspServer) Shutdown() {
 * @return error Any error that occurred during the request
  */
 func (l *lspServer) OnInitialized(ctx context.Context, req *defines.InitializeParams) error {
-	logs.Printf("OnInitialized: %s", req)
-	l.server.OnDidOpenTextDocument(l.OnDidOpenTextDocument)
-	notificationMethod := "analysisDone"
-	// Notification handle code can come here
-	if err := l.NotifyGeneratedCode(ctx, "AnalysisDone", notificationMethod); err != nil {
-		fmt.Println("Error sending notification: \n", err)
+	logs.Printf("OnInitialized: %v", req)
+	if err := l.loadSettings(ctx); err != nil {
+		logs.Printf("Error loading settings: %v", err)
 	}
-	logs.Printf("[+] Notification Sent!\n")
 	return nil
 }
 
 /*
 * updateDocumentStore is helper for updating internal state whenever the document is opened
-* or saved by the client.
+* or saved by the client. The analysis is reported with $/progress.
 *
 * @param ctx The context of the request.
-* @param req The open text document params.
+* @param uri The document URI.
+* @param text The document content.
 * @return error Any error that occurred during the request
  */
 
-func (l *lspServer) updateDocumentStore(uri string, text string) error {
-	var analysis string
-	var diagnostics []LspDiagnostic
+func (l *lspServer) updateDocumentStore(ctx context.Context, uri string, text string) (err error) {
 	logs.Printf("=> URI: [%s] TEXT: [%s]", uri, text)
-	err := l.documents.Store(uri, text)
+	state := l.state(ctx)
+	profile, ok := state.profile(uri)
+	if !ok {
+		logs.Printf("No language profile for %s, not analysing it", uri)
+		return nil
+	}
+	err = state.documents.Store(uri, text)
 	if err != nil {
 		// This is ok, the document may already be stored
 		return nil
 	}
 
+	if err := l.runStaticChecks(state, uri, text, profile); err != nil {
+		logs.Printf("Failed to store static check results: %v\n", err)
+	}
+	if err := l.runAnalyzer(ctx, state, uri, text); err != nil {
+		logs.Printf("Failed to run analyzer: %v\n", err)
+	}
+	return l.analyseDocument(ctx, state, uri, text, profile)
+}
+
+/*
+* analyseDocument lets the backend analyse the text of a document, retrying
+* when its response can't be parsed, and stores the findings of the model.
+*
+* @param ctx The context of the request.
+* @param state The state of the session.
+* @param uri The document URI.
+* @param text The document content.
+* @param profile The language profile of the document.
+* @return error Any error that occurred during the analysis
+ */
+func (l *lspServer) analyseDocument(ctx context.Context, state *sessionState, uri string, text string, profile *LanguageProfile) (err error) {
+	var analysis string
+	var diagnostics []LspDiagnostic
+
+	progress := l.beginProgress(ctx, "FuzzLSP", "Analysing "+state.relativePath(uri))
+	defer func() { progress.End(err) }()
+
 	const maxRetries = 5
 	instruction := ""
 
 	for attempts := 1; attempts <= maxRetries; attempts++ {
-		analysis, err = l.backend.AnalyseDocument(uri, instruction+text)
+		analysis, err = l.analyse(state, progress, uri, instruction+text, profile, l.promptRules(state, profile))
 		if err != nil {
 			return err
 		}
-		err = l.documents.StoreAnalysis(uri, analysis)
+		err = state.documents.StoreAnalysis(uri, analysis)
 		if err != nil {
 			return err
 		}
@@ -185,7 +528,7 @@ func (l *lspServer) updateDocumentStore(uri string, text string) error {
 		return err
 	}
 
-	err = l.documents.UpdateDiagnostics(uri, diagnostics)
+	err = l.storeDiagnostics(state, uri, text, DiagnosticProviderLLM, diagnostics)
 	if err != nil {
 		logs.Printf("Failed to update diagnostics: %v\n", err)
 		return err
@@ -195,6 +538,31 @@ func (l *lspServer) updateDocumentStore(uri string, text string) error {
 	return nil
 }
 
+/*
+* storeDiagnostics replaces the findings of one provider, then applies the
+* workspace policy, the deviation comments in the document and the baseline
+* to the findings of all providers before storing them.
+*
+* @param state The state of the session.
+* @param uri The document URI.
+* @param text The analysed document content.
+* @param provider The provider of the diagnostics, e.g. DiagnosticProviderLLM.
+* @param diagnostics The diagnostics found by the provider.
+* @return error Any error that occurred while storing
+ */
+func (l *lspServer) storeDiagnostics(state *sessionState, uri string, text string, provider string, diagnostics []LspDiagnostic) error {
+	diagnostics = state.documents.UpdateProviderDiagnostics(uri, provider, diagnostics)
+	diagnostics = state.policy.FilterDiagnostics(diagnostics)
+	profile, _ := state.profile(uri)
+	diagnostics, deviations := ApplyDeviations(uri, text, profile, diagnostics)
+	diagnostics = state.baseline.Filter(state.relativePath(uri), text, diagnostics)
+
+	state.deviations.Update(uri, deviations)
+	state.exportDeviations()
+
+	return state.documents.UpdateDiagnostics(uri, diagnostics)
+}
+
 /*
 * OnDidOpenTextDocument is called when a text document is opened in a client.
 *
@@ -204,14 +572,9 @@ func (l *lspServer) updateDocumentStore(uri string, text string) error {
  */
 
 func (l *lspServer) OnDidOpenTextDocument(ctx context.Context, req *defines.DidOpenTextDocumentParams) error {
-	logs.Printf("OnDidOpenTextDocument:\n%s", req)
-	notificationMethod := "analysisStarted"
-	// Notification handle code can come here
-	if err := l.NotifyGeneratedCode(ctx, "AnalysisStarted", notificationMethod); err != nil {
-		fmt.Println("Error sending notification: \n", err)
-	}
-	logs.Printf("[+] Notification Sent!\n")
-	return l.updateDocumentStore(string(req.TextDocument.Uri), req.TextDocument.Text)
+	logs.Printf("OnDidOpenTextDocument:\n%v", req)
+	l.state(ctx).documents.StoreLanguage(string(req.TextDocument.Uri), req.TextDocument.LanguageId)
+	return l.updateDocumentStore(ctx, string(req.TextDocument.Uri), req.TextDocument.Text)
 }
 
 // ConvertFileURIToPath converts a file URI to a system-specific file path
@@ -240,68 +603,45 @@ func ReadFileContent(filePath string) (string, error) {
 	return string(content), nil
 }
 
+/*
+* OnDidChangeTextDocument runs the built-in checks on the unsaved text right
+* away and then lets the model analyse it. The external analyzer only runs
+* when the document is opened or saved since it reads the file on disk.
+*
+* @param ctx The context of the request.
+* @param req The change params from the client.
+* @return error Any error that occurred during the request
+ */
 func (l *lspServer) OnDidChangeTextDocument(ctx context.Context, req *defines.DidChangeTextDocumentParams) error {
-	uri := req.TextDocument.TextDocumentIdentifier.Uri
-
-	logs.Printf("[+] OnDidChangeTextDocument: %s", string(uri))
+	uri := string(req.TextDocument.TextDocumentIdentifier.Uri)
 
-	filePath, err := ConvertFileURIToPath(string(uri))
+	logs.Printf("[+] OnDidChangeTextDocument: %s", uri)
 
-	if err != nil {
-		logs.Printf("Error converting URI to file path: %v\n", err)
-		return err
-	}
-	// var content string
-	// var err error
-	documentContent, err := ReadFileContent(filePath)
-	// Fetch the latest content of the document
-	// content, err := os.ReadFile(string(uri))
-	if err != nil {
-		logs.Printf("Error loading document content: %s", err)
-		return err
-	}
-	notificationMethod := "analysisStarted"
-	// Notification handle code can come here
-	if err := l.NotifyGeneratedCode(ctx, "AnalysisStarted", notificationMethod); err != nil {
-		fmt.Println("Error sending notification: \n", err)
-	}
-	logs.Printf("[+] Notification Sent!\n")
-	// Analyze the document content
-	analysis, err := l.backend.AnalyseDocument(string(uri), string(documentContent))
-	if err != nil {
-		logs.Printf("Error analyzing document: %s", err)
-		return err
+	state := l.state(ctx)
+	profile, ok := state.profile(uri)
+	if !ok {
+		logs.Printf("No language profile for %s, not analysing it", uri)
+		return nil
 	}
 
-	// Update the analysis in the document store
-	if err = l.documents.StoreAnalysis(string(uri), analysis); err != nil {
-		logs.Printf("Error storing document analysis: %s", err)
-		return err
+	// The server asks for full document sync so the last change is the text
+	n := len(req.ContentChanges)
+	if n == 0 {
+		return nil
 	}
-
-	// Unmarshal diagnostics from the analysis
-	diagnostics, err := DiagnosticsUnmarshal(string(uri), analysis)
-	if err != nil {
-		logs.Printf("Error unmarshalling diagnostics: %s", err)
-		return err
+	text, ok := req.ContentChanges[n-1].Text.(string)
+	if !ok {
+		return nil
 	}
-
-	err = l.documents.UpdateDiagnostics(string(uri), diagnostics)
-
-	// Update diagnostics in the document store
-	if err != nil {
-		logs.Printf("Error updating diagnostics: %s", err)
+	state.documents.StoreText(uri, text)
+	if err := l.runStaticChecks(state, uri, text, profile); err != nil {
+		logs.Printf("Error storing static check results: %s", err)
 		return err
 	}
-	// l.documents.UpdateDiagnostics(uri, diagnostics)
-	// Send diagnostics to the client
-	l.updateDocumentStore(string(uri), string(documentContent))
-	notificationMethod = "analysisDone"
-	// Notification handle code can come here
-	if err := l.NotifyGeneratedCode(ctx, "AnalysisDone", notificationMethod); err != nil {
-		fmt.Println("Error sending notification: \n", err)
+	if err := l.analyseDocument(ctx, state, uri, text, profile); err != nil {
+		logs.Printf("Error analysing document: %s", err)
+		return err
 	}
-	logs.Printf("[+] Notification Sent!\n")
 	return nil
 }
 
@@ -309,28 +649,32 @@ func (l *lspServer) OnCodeActionWithSliceCodeAction(ctx context.Context, req *de
 	logs.Printf("onCodeActionWithSliceCodeAction")
 
 	// Get diagnostics for the document
-	diagnostics, err := l.documents.GetDiagnostics(string(req.TextDocument.Uri))
+	state := l.state(ctx)
+	diagnostics, err := state.documents.GetDiagnostics(string(req.TextDocument.Uri))
 	if err != nil {
 		logs.Printf("Error getting diagnostics: %v\n", err)
 		return nil, err
 	}
 
-	// Filter diagnostics to find those affecting the current cursor line
-	var relevantDiagnostics []LspDiagnostic
-	cursorLine := req.Range.Start.Line + 1
-	for _, diag := range diagnostics {
-		if diag.LineNumber == int(cursorLine) {
-			relevantDiagnostics = append(relevantDiagnostics, diag)
-		}
-	}
+	// The diagnostics the client sent along, or those on the selected lines
+	relevantDiagnostics := relevantDiagnostics(req, diagnostics)
+
+	// Fixing the whole file doesn't depend on the cursor
+	actions := fixAllActions(req.TextDocument.Uri, relevantDiagnostics, diagnostics)
 
-	// Only create code actions if there are relevant diagnostics
+	// Only create the other code actions if there are relevant diagnostics
 	if len(relevantDiagnostics) == 0 {
-		logs.Printf("No relevant diagnostics on this line, no code action created")
-		return nil, nil
+		logs.Printf("No relevant diagnostics on this line, only fix-all actions created")
+		actions = filterActions(actions, req.Context.Only)
+		return &actions, nil
+	}
+
+	// One preferred quick fix per finding
+	rules := l.documentRules(state, string(req.TextDocument.Uri))
+	for _, d := range relevantDiagnostics {
+		actions = append(actions, l.fixAction(req.TextDocument.Uri, d, rules))
 	}
 
-	var actions []defines.CodeAction
 	// Create a variable for the kind to take its address
 	refactorKind := defines.CodeActionKindRefactorRewrite
 	// Create a refactor action
@@ -346,21 +690,41 @@ func (l *lspServer) OnCodeActionWithSliceCodeAction(ctx context.Context, req *de
 	// Add the action to the list
 	actions = append(actions, refactorAction)
 
+	// The explanation is requested when the action is run, not when it is
+	// resolved, clients resolve actions before showing them
 	quickKind := defines.CodeActionKindQuickFix
-	refactorAction = defines.CodeAction{
-		Title: "Explain issue [FuzzLSP]",
-		Kind:  &quickKind,
-		Data:  actionData,
+	actions = append(actions, defines.CodeAction{
+		Title:   "Explain issue [FuzzLSP]",
+		Kind:    &quickKind,
+		Command: l.explainCommand(req.TextDocument.Uri, req.Range),
+	})
+
+	// Inserting the explanation into the source is opt-in
+	if ParamExplainComments != nil && *ParamExplainComments {
+		inlineKind := defines.CodeActionKindRefactorInline
+		actions = append(actions, defines.CodeAction{
+			Title: "Insert explanation as comment [FuzzLSP]",
+			Kind:  &inlineKind,
+			Data: map[string]interface{}{
+				"uri":     req.TextDocument.Uri,
+				"range":   req.Range,
+				"comment": true,
+			},
+		})
 	}
-	// Add the action to the list
-	actions = append(actions, refactorAction)
 
+	actions = filterActions(actions, req.Context.Only)
 	return &actions, nil
 }
 
 func (l *lspServer) OnCodeActionResolve(ctx context.Context, req *defines.CodeAction) (*defines.CodeAction, error) {
 	logs.Printf("OnCodeActionResolve")
 
+	// Actions running a command, e.g. "Explain issue", need no resolving
+	if req.Data == nil && req.Command != nil {
+		return req, nil
+	}
+
 	// Cast Data to map[string]interface{}
 	actionData, ok := req.Data.(map[string]interface{})
 	if !ok {
@@ -370,6 +734,18 @@ func (l *lspServer) OnCodeActionResolve(ctx context.Context, req *defines.CodeAc
 
 	// Extract URI
 	documentURI := actionData["uri"].(string)
+	state := l.state(ctx)
+
+	// Fix all findings of the file, or of one rule
+	if fixAll, _ := actionData["fixAll"].(bool); fixAll {
+		rule, _ := actionData["rule"].(string)
+		return l.resolveFixAll(ctx, req, documentURI, rule)
+	}
+
+	// Quick fixes for a single finding
+	if _, ok := actionData["rule"].(string); ok {
+		return l.resolveFix(ctx, state, req, documentURI, actionData)
+	}
 
 	// Extract Range from map
 	rangeMap, ok := actionData["range"].(map[string]interface{})
@@ -390,15 +766,8 @@ func (l *lspServer) OnCodeActionResolve(ctx context.Context, req *defines.CodeAc
 		},
 	}
 
-	// Convert URI to file path
-	filePath, err := ConvertFileURIToPath(documentURI)
-	if err != nil {
-		logs.Printf("Error converting URI to file path: %v\n", err)
-		return nil, err
-	}
-
-	// Load document content
-	documentContent, err := ReadFileContent(filePath)
+	// Load document content, with the unsaved changes
+	documentContent, err := l.documentText(state, documentURI)
 	if err != nil {
 		logs.Printf("Error loading document content: %s", err)
 		return nil, err
@@ -412,63 +781,24 @@ func (l *lspServer) OnCodeActionResolve(ctx context.Context, req *defines.CodeAc
 		return nil, fmt.Errorf("invalid cursor line: %d", cursorLine)
 	}
 
-	lineText := lines[cursorLine]
-
-	// Handle the specific action (refactor or explain)
-	if req.Kind != nil && *req.Kind == defines.CodeActionKindRefactorRewrite {
-		refactoredText, err := l.backend.RefactorCodeLine(lineText)
-		if err != nil {
-			logs.Printf("LLM error for refactor: %v", err)
-			return nil, err
-		}
-
-		// Apply the refactored text to the current line
-		changes := map[string][]defines.TextEdit{
-			documentURI: {
-				{
-					Range:   actionRange,
-					NewText: refactoredText,
-				},
-			},
-		}
-		req.Edit = &defines.WorkspaceEdit{
-			Changes: &changes,
-		}
+	// Handle the opt-in "Insert explanation as comment" action
+	if asComment, _ := actionData["comment"].(bool); asComment {
+		return l.resolveExplanation(ctx, state, req, documentURI, documentContent, actionRange)
 	}
 
-	// Handle "Explain issue" action
-	if req.Kind != nil && *req.Kind == defines.CodeActionKindQuickFix {
-		explanation, err := l.backend.ExplainCodeIssue(lineText)
-		if err != nil {
-			logs.Printf("LLM error for explanation: %v", err)
-			return nil, err
-		}
-
-		// Insert explanation as a comment above the line
-		changes := map[string][]defines.TextEdit{
-			documentURI: {
-				{
-					Range:   actionRange,
-					NewText: "/* " + explanation + " */\n" + lineText,
-				},
-			},
-		}
-		req.Edit = &defines.WorkspaceEdit{
-			Changes: &changes,
-		}
+	// Handle the refactor action, "Explain issue" runs a command instead
+	if req.Kind != nil && *req.Kind == defines.CodeActionKindRefactorRewrite {
+		return l.resolveRefactor(ctx, state, req, documentURI, documentContent, cursorLine+1)
 	}
 
 	return req, nil
 }
 
-
-
-
 func (l *lspServer) OnDidSaveTextDocument(ctx context.Context, req *defines.DidSaveTextDocumentParams) error {
 
-	logs.Printf("OnDidSaveTextDocument:\n%s", req)
+	logs.Printf("OnDidSaveTextDocument:\n%v", req)
 
-	logs.Printf("URI: %s | Text: %s ", string(req.TextDocument.Uri), req.Text)
+	logs.Printf("URI: %s | Text: %v ", string(req.TextDocument.Uri), req.Text)
 	filePath, err := ConvertFileURIToPath(string(req.TextDocument.Uri))
 
 	if err != nil {
@@ -484,7 +814,7 @@ func (l *lspServer) OnDidSaveTextDocument(ctx context.Context, req *defines.DidS
 	}
 	// TODO: Add IncludeText to server capabilities
 	if documentContent != "" {
-		return l.updateDocumentStore(string(req.TextDocument.Uri), documentContent)
+		return l.updateDocumentStore(ctx, string(req.TextDocument.Uri), documentContent)
 	}
 
 	return nil
@@ -506,53 +836,16 @@ func (l *lspServer) OnDiagnostic(ctx context.Context, req *defines.DocumentDiagn
 	diagnostics := []defines.Diagnostic{}
 	report := defines.FullDocumentDiagnosticReport{}
 
-	docDiagnostics, err := l.documents.GetDiagnostics(string(req.TextDocument.Uri))
+	state := l.state(ctx)
+	docDiagnostics, err := state.documents.GetDiagnostics(string(req.TextDocument.Uri))
 	if err != nil {
 		logs.Printf("Error getting diagnostics for URI %s: %v\n", req.TextDocument.Uri, err)
 		return &report, nil
 	}
 
+	rules := l.documentRules(state, string(req.TextDocument.Uri))
 	for _, d := range docDiagnostics {
-		var diagnostic defines.Diagnostic
-		var severity defines.DiagnosticSeverity
-		message := DiagnosticToPrettyText(d)
-
-		switch d.Severity {
-		case "advisory":
-			severity = defines.DiagnosticSeverityWarning
-		case "mandatory":
-			severity = defines.DiagnosticSeverityError
-		default:
-			severity = defines.DiagnosticSeverityHint
-		}
-
-		diagRange := defines.Range{
-			Start: defines.Position{Line: uint(d.LineNumber - 1), Character: 0},
-			End:   defines.Position{Line: uint(d.LineNumber - 1), Character: 5},
-		}
-
-		relatedInfo := []defines.DiagnosticRelatedInformation{
-			{
-				Location: defines.Location{
-					Uri:   req.TextDocument.Uri,
-					Range: diagRange,
-				},
-				Message: message,
-			},
-		}
-
-		searchUrl := fmt.Sprintf("https://bing.com/search?=\"%s\"", d.Source)
-		diagnostic = defines.Diagnostic{
-			Range:              diagRange,
-			Severity:           &severity,
-			Code:               d.Source + " " + d.Rule,
-			Source:             &l.name,
-			Message:            d.Description,
-			CodeDescription:    &defines.CodeDescription{Href: defines.URI(searchUrl)},
-			RelatedInformation: &relatedInfo,
-		}
-
-		diagnostics = append(diagnostics, diagnostic)
+		diagnostics = append(diagnostics, l.toDiagnostic(req.TextDocument.Uri, d, rules))
 	}
 
 	var items []interface{}
@@ -568,6 +861,68 @@ func (l *lspServer) OnDiagnostic(ctx context.Context, req *defines.DocumentDiagn
 	return &report, nil
 }
 
+// documentRules is the rule set used to map the severities of a document.
+func (l *lspServer) documentRules(state *sessionState, uri string) *RuleSet {
+	if profile, ok := state.profile(uri); ok {
+		return l.ruleSet(state, profile)
+	}
+	if state.rules != nil {
+		return state.rules
+	}
+	return l.rules
+}
+
+// diagnosticRange is the exact range of a finding if known, otherwise the
+// start of its line.
+func diagnosticRange(d LspDiagnostic) defines.Range {
+	if d.EndLine > 0 {
+		return defines.Range{
+			Start: defines.Position{Line: uint(d.LineNumber - 1), Character: uint(d.Column)},
+			End:   defines.Position{Line: uint(d.EndLine - 1), Character: uint(d.EndColumn)},
+		}
+	}
+	return defines.Range{
+		Start: defines.Position{Line: uint(d.LineNumber - 1), Character: 0},
+		End:   defines.Position{Line: uint(d.LineNumber - 1), Character: 5},
+	}
+}
+
+// toDiagnostic converts a stored finding into the LSP diagnostic reported to
+// the client.
+func (l *lspServer) toDiagnostic(uri defines.DocumentUri, d LspDiagnostic, rules *RuleSet) defines.Diagnostic {
+	severity := rules.LspSeverity(d)
+	message := DiagnosticToPrettyText(d)
+	diagRange := diagnosticRange(d)
+
+	// Built-in and analyzer findings keep their own source so their
+	// provenance is visible
+	source := &l.name
+	if d.Provider != "" && d.Provider != DiagnosticProviderLLM && d.Source != "" {
+		source = &d.Source
+	}
+
+	relatedInfo := []defines.DiagnosticRelatedInformation{
+		{
+			Location: defines.Location{
+				Uri:   uri,
+				Range: diagRange,
+			},
+			Message: message,
+		},
+	}
+
+	searchUrl := fmt.Sprintf("https://bing.com/search?q=\"%s %s\"", d.Source, d.Rule)
+	return defines.Diagnostic{
+		Range:              diagRange,
+		Severity:           &severity,
+		Code:               d.Rule,
+		Source:             source,
+		Message:            d.Description,
+		CodeDescription:    &defines.CodeDescription{Href: defines.URI(searchUrl)},
+		RelatedInformation: &relatedInfo,
+	}
+}
+
 /*
 * OnHover is called when a user hovers over a token in the editor. This method is then sent to the server
 * which will return a Hover object to the client.
@@ -579,24 +934,18 @@ func (l *lspServer) OnDiagnostic(ctx context.Context, req *defines.DocumentDiagn
  */
 
 func (l *lspServer) OnHover(ctx context.Context, req *defines.HoverParams) (result *defines.Hover, err error) {
-	logs.Printf("OnHover: %s", req)
-	var value string
+	logs.Printf("OnHover: %v", req)
 
-	diagnostics, err := l.documents.GetDiagnostics(string(req.TextDocument.Uri))
+	uri := string(req.TextDocument.Uri)
+	state := l.state(ctx)
+	diagnostics, err := state.documents.GetDiagnostics(uri)
 	if err != nil {
 		return nil, err
 	}
 
-	for _, d := range diagnostics {
-		if d.LineNumber-1 != int(req.Position.Line) {
-			continue
-		}
-
-		value, err = DiagnosticToJsonMarkup(d)
-		if err != nil {
-			break
-		}
-	}
+	text, _ := state.documents.Load(uri)
+	line := int(req.Position.Line) + 1
+	value := l.hoverMarkdown(state, uri, text, diagnosticsIn(diagnostics, line, line))
 
 	return &defines.Hover{
 		Contents: defines.MarkupContent{
@@ -615,12 +964,9 @@ func kindPtr(kind defines.CompletionItemKind) *defines.CompletionItemKind {
 }
 
 func (s *lspServer) NotifyGeneratedCode(ctx context.Context, generatedCode string, notificationMethod string) error {
-	if s.conn == nil {
-		return fmt.Errorf("connection is nil, cannot send notification")
-	}
 	logs.Printf("NotifyGeneratedCode")
 	// Send notification to the client
-	err := s.conn.Notify(ctx, notificationMethod, generatedCode)
+	err := s.SendNotification(ctx, notificationMethod, generatedCode)
 	if err != nil {
 		return fmt.Errorf("failed to send generated code notification: %v", err)
 	}
@@ -631,17 +977,9 @@ func (s *lspServer) NotifyGeneratedCode(ctx context.Context, generatedCode strin
 func (l *lspServer) OnCompletion(ctx context.Context, req *defines.CompletionParams) (result *[]defines.CompletionItem, err error) {
 	logs.Printf("Code Completion n Suggestion: %v", req)
 
-	// Define the system prompt for code completion
-	systemPrompt := "You are a coding assistant. Provide the best possible code completions based on the given context."
-
-	// Fetch the document content
-	filePath, err := ConvertFileURIToPath(string(req.TextDocument.Uri))
-	if err != nil {
-		logs.Printf("Error converting URI to file path: %v\n", err)
-		return nil, err
-	}
-
-	documentContent, err := ReadFileContent(filePath)
+	// Fetch the document content, with the unsaved changes
+	state := l.state(ctx)
+	documentContent, err := l.documentText(state, string(req.TextDocument.Uri))
 	if err != nil {
 		logs.Printf("Error reading file content: %v\n", err)
 		return nil, err
@@ -694,15 +1032,16 @@ func (l *lspServer) OnCompletion(ctx context.Context, req *defines.CompletionPar
 		suffix = currentLineSuffix + "\n" + suffix
 	}
 
-	// Call the backend to get completions with the custom system prompt
-	completions, err := l.backend.CompleteCode(string(req.TextDocument.Uri), prefix, systemPrompt)
+	// Call the backend to get completions, the prompts come from the complete.* templates
+	profile, standard := l.promptTarget(state, string(req.TextDocument.Uri), nil)
+	completions, err := l.backend.CompleteCode(state.backendContext(ctx), string(req.TextDocument.Uri), profile, standard, prefix)
 	if err != nil {
 		logs.Printf("Error getting code completions: %v\n", err)
 		return nil, err
 	}
 	logs.Println("Completion Done:", completions)
 	// Generate additional code using the backend
-	generatedCode, err := l.backend.GenerateCode(string(req.TextDocument.Uri), prefix, suffix, systemPrompt)
+	generatedCode, err := l.backend.GenerateCode(state.backendContext(ctx), string(req.TextDocument.Uri), profile, standard, prefix, suffix)
 	if err != nil {
 		logs.Printf("Error generating code: %v\n", err)
 		return nil, err
@@ -717,7 +1056,7 @@ func (l *lspServer) OnCompletion(ctx context.Context, req *defines.CompletionPar
 	notificationMethod := "window/showGeneratedCode"
 	// Notification handle code can come here
 	if err := l.NotifyGeneratedCode(ctx, escapedGeneratedCode, notificationMethod); err != nil {
-		fmt.Println("Error sending notification: \n", err)
+		logs.Printf("Error sending notification: %v", err)
 	}
 
 	logs.Printf("[+] Notification Sent!\n")
@@ -746,29 +1085,58 @@ func (l *lspServer) OnCompletion(ctx context.Context, req *defines.CompletionPar
 	return &completionItems, nil
 }
 
-func Serve(name string) {
-	lspserver := lspServer{name: name}
+/*
+ * newServer creates the server with its options and handlers and starts the
+ * backend.
+ * @param name The name of the server
+ * @param listen Where clients connect, see ParseListen
+ * @param tracer Traces every message if not nil
+ * @return server The server, not serving yet
+ * @return error Any error that occurred while starting the backend
+ */
+func newServer(name string, listen Listen, tracer *jsonrpc.Tracer) (*lspServer, error) {
+	lspserver := &lspServer{
+		name:         name,
+		tracer:       tracer,
+		analyses:     newLRUCache(maxCachedAnalyses),
+		explanations: newLRUCache(maxCachedExplanations),
+		triages:      newLRUCache(maxCachedTriages),
+		exitProcess:  os.Exit,
+	}
 	lspserver.server = lsp.NewServer(&lsp.Options{
+		Network:   listen.Network,
+		Address:   listen.Address,
+		WebSocket: webSocketOptions(listen),
+		Tracer:    tracer,
 		CompletionProvider: &defines.CompletionOptions{
 			TriggerCharacters: &[]string{"."},
 		},
 		CodeActionProvider: &defines.CodeActionOptions{
+			CodeActionKinds: &[]defines.CodeActionKind{
+				defines.CodeActionKindQuickFix,
+				defines.CodeActionKindRefactorRewrite,
+				defines.CodeActionKindRefactorInline,
+				CodeActionKindFixAll,
+			},
 			ResolveProvider: &[]bool{true}[0],
 		},
+		ExecuteCommandProvider: &defines.ExecuteCommandOptions{
+			Commands: Commands,
+		},
 	})
 
 	if lspserver.server == nil {
 		panic("Error creating LspServer")
 	}
 	ctx := context.Background()
-	err := lspserver.Start(ctx)
-	if err != nil {
-		logs.Printf("start failed: %v", err)
-		os.Exit(1)
-		// TODO: handle retrying
+	if err := lspserver.Start(ctx); err != nil {
+		return nil, err
 	}
 	logs.Printf("Initializing!")
+	lspserver.server.OnInitialize(lspserver.OnInitialize)
 	lspserver.server.OnInitialized(lspserver.OnInitialized)
+	lspserver.server.OnShutdown(lspserver.OnShutdown)
+	lspserver.server.OnExit(lspserver.OnExit)
 	lspserver.server.OnDidOpenTextDocument(lspserver.OnDidOpenTextDocument)
 	lspserver.server.OnDidChangeTextDocument(lspserver.OnDidChangeTextDocument)
 	lspserver.server.OnDidSaveTextDocument(lspserver.OnDidSaveTextDocument)
@@ -778,5 +1146,38 @@ func Serve(name string) {
 	lspserver.server.OnCompletion(lspserver.OnCompletion)
 	lspserver.server.OnCodeActionWithSliceCodeAction(lspserver.OnCodeActionWithSliceCodeAction)
 	lspserver.server.OnCodeActionResolve(lspserver.OnCodeActionResolve)
-	lspserver.server.Run()
+	lspserver.server.OnExecuteCommand(lspserver.OnExecuteCommand)
+	lspserver.server.OnWorkDoneProgressCancel(lspserver.OnWorkDoneProgressCancel)
+	lspserver.server.OnDidChangeConfiguration(lspserver.OnDidChangeConfiguration)
+	return lspserver, nil
+}
+
+func Serve(name string) {
+	listen, err := ParseListen(*ParamListen)
+	if err != nil {
+		logs.Printf("%v", err)
+		os.Exit(1)
+	}
+	tracer, err := openTrace(*ParamTraceFile)
+	if err != nil {
+		logs.Printf("%v", err)
+		os.Exit(1)
+	}
+
+	lspserver, err := newServer(name, listen, tracer)
+	if err != nil {
+		logs.Printf("start failed: %v", err)
+		os.Exit(1)
+		// TODO: handle retrying
+	}
+	lspserver.stdio = listen.Network == ""
+	lspserver.watchParents = listen.Network == "" || listen.Network == "unix"
+	lspserver.exitOnSignal()
+	if err := lspserver.server.Run(); err != nil {
+		logs.Printf("Serving failed: %v", err)
+		lspserver.Shutdown()
+		os.Exit(1)
+	}
+	// stdin was closed, with or without exit notification
+	lspserver.exit()
 }
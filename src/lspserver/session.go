@@ -0,0 +1,112 @@
+package lspserver
+
+import (
+	"context"
+	"crypto/sha256"
+	"sync"
+
+	"github.com/TobiasYin/go-lsp/jsonrpc"
+	"github.com/TobiasYin/go-lsp/logs"
+	"github.com/TobiasYin/go-lsp/lsp/defines"
+)
+
+/*
+ * sessionState is the state of one client. With -listen every connection is
+ * a session of its own, so clients don't see each other's documents or
+ * deviations. The backend, the rule packs and the analysis, explanation and
+ * triage caches are shared by all sessions.
+ */
+type sessionState struct {
+	documents    LspDocuments
+	capabilities defines.ClientCapabilities
+	folders      []string // workspace folders, the first one is the root
+	root         string
+	policy       *Policy
+	rules        *RuleSet // rule packs selected by the policy
+	baseline     *Baseline
+	settingsLock sync.Mutex
+	settings     clientSettings
+	progress     sync.Map // running operations by progress token, see progress.go
+	deviations   *DeviationRegister
+}
+
+func newSessionState() *sessionState {
+	return &sessionState{documents: NewLspDocuments(), deviations: NewDeviationRegister()}
+}
+
+/*
+ * state returns the state of the session the context belongs to. It is
+ * created with the first message of the session and released when the
+ * session ends.
+ * @param ctx The context of a handler
+ * @return state The state of the handler's session
+ */
+func (l *lspServer) state(ctx context.Context) *sessionState {
+	session := jsonrpc.SessionFromContext(ctx)
+	if session == nil {
+		logs.Printf("No session, using a state of its own")
+		return newSessionState()
+	}
+	if state, ok := l.sessions.Load(session); ok {
+		return state.(*sessionState)
+	}
+
+	state, loaded := l.sessions.LoadOrStore(session, newSessionState())
+	if !loaded {
+		go func() {
+			<-session.Done()
+			l.sessions.Delete(session)
+			logs.Printf("Session ended, released its documents")
+		}()
+	}
+	return state.(*sessionState)
+}
+
+// analysisKey identifies an analysis by everything the backend is asked
+// with, sessions analysing the same document with the same model and rules
+// share it.
+func analysisKey(model string, uri string, text string, profile *LanguageProfile, rules []Rule) [sha256.Size]byte {
+	h := sha256.New()
+	for _, s := range []string{model, uri, profile.LanguageID} {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+	for _, rule := range rules {
+		h.Write([]byte(rule.ID))
+		h.Write([]byte{0})
+	}
+	h.Write([]byte(text))
+	var key [sha256.Size]byte
+	copy(key[:], h.Sum(nil))
+	return key
+}
+
+/*
+ * analyse returns the backend's analysis of a document. Analyses that could
+ * be parsed are cached for all sessions, so a document open in several
+ * editors is sent to the model once. The cache keeps the most recently used
+ * maxCachedAnalyses analyses.
+ * @param state The state of the session, its model analyses the document
+ * @param progress The progress of the analysis
+ * @param uri The document URI
+ * @param text The text to analyse
+ * @param profile The language profile of the document
+ * @param rules The rules the backend checks
+ * @return analysis The backend's analysis
+ * @return error Any error of the backend
+ */
+func (l *lspServer) analyse(state *sessionState, progress *workDoneProgress, uri string, text string, profile *LanguageProfile, rules []Rule) (string, error) {
+	key := analysisKey(state.model(), uri, text, profile, rules)
+	if analysis, ok := l.analyses.Load(key); ok {
+		logs.Printf("[+] Using the cached analysis of %s", uri)
+		return analysis.(string), nil
+	}
+	analysis, err := l.backend.AnalyseDocument(state.backendContext(progress.Context()), uri, text, profile, rules, progress.Analysis)
+	if err != nil {
+		return "", err
+	}
+	if _, err := DiagnosticsUnmarshal(uri, analysis); err == nil {
+		l.analyses.Store(key, analysis)
+	}
+	return analysis, nil
+}
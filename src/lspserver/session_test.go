@@ -0,0 +1,128 @@
+package lspserver
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+)
+
+// modelRecorder is the mock backend recording the model of every analysis.
+type modelRecorder struct {
+	LspBackend
+	lock   sync.Mutex
+	models map[string][]string // models by document URI
+}
+
+func (b *modelRecorder) AnalyseDocument(ctx context.Context, uri string, document string, profile *LanguageProfile, rules []Rule, progress AnalysisProgress) (string, error) {
+	b.lock.Lock()
+	b.models[uri] = append(b.models[uri], modelFor(ctx, "default"))
+	b.lock.Unlock()
+	return b.LspBackend.AnalyseDocument(ctx, uri, document, profile, rules, progress)
+}
+
+func (b *modelRecorder) analysed(uri string) []string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return append([]string(nil), b.models[uri]...)
+}
+
+// settingsClient connects a client answering workspace/configuration with
+// the model returned by model.
+func settingsClient(t *testing.T, l *lspServer, model func() string) *testClient {
+	return connectTestClient(t, l, map[string]func(json.RawMessage) (interface{}, error){
+		"workspace/configuration": func(json.RawMessage) (interface{}, error) {
+			return []clientSettings{{Model: model()}}, nil
+		},
+	})
+}
+
+func sessionCount(l *lspServer) int {
+	n := 0
+	l.sessions.Range(func(_, _ interface{}) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+// analysedSessions counts the sessions with an analysis of the document.
+func analysedSessions(l *lspServer, uri string) int {
+	n := 0
+	l.sessions.Range(func(_, state interface{}) bool {
+		if _, err := state.(*sessionState).documents.LoadAnalysis(uri); err == nil {
+			n++
+		}
+		return true
+	})
+	return n
+}
+
+// sessionModel returns the model of the only session with the root.
+func sessionModel(l *lspServer, root string) string {
+	model := ""
+	l.sessions.Range(func(_, state interface{}) bool {
+		if s := state.(*sessionState); s.root == root {
+			model = s.model()
+		}
+		return true
+	})
+	return model
+}
+
+func TestSessionSettings(t *testing.T) {
+	l := newTestServer(t)
+	backend := &modelRecorder{LspBackend: l.backend, models: make(map[string][]string)}
+	l.backend = backend
+
+	const capabilities = `{"workspace": {"configuration": true}}`
+	rootA, rootB := t.TempDir(), t.TempDir()
+	var modelLock sync.Mutex
+	modelB := "model-b"
+	a := settingsClient(t, l, func() string { return "model-a" })
+	b := settingsClient(t, l, func() string {
+		modelLock.Lock()
+		defer modelLock.Unlock()
+		return modelB
+	})
+	a.initialize(rootA, capabilities)
+	b.initialize(rootB, capabilities)
+	waitFor(t, "the settings", func() bool {
+		return sessionModel(l, rootA) == "model-a" && sessionModel(l, rootB) == "model-b"
+	})
+
+	uriA, uriB := "file://"+rootA+"/a.c", "file://"+rootB+"/b.c"
+	a.open(uriA, "int a;\n")
+	b.open(uriB, "int b;\n")
+	waitFor(t, "the analyses", func() bool {
+		return len(backend.analysed(uriA)) == 1 && len(backend.analysed(uriB)) == 1
+	})
+	if got := backend.analysed(uriA)[0]; got != "model-a" {
+		t.Errorf("session A analysed with %s, want model-a", got)
+	}
+	if got := backend.analysed(uriB)[0]; got != "model-b" {
+		t.Errorf("session B analysed with %s, want model-b", got)
+	}
+
+	// Changing the settings of B leaves A alone
+	modelLock.Lock()
+	modelB = "model-c"
+	modelLock.Unlock()
+	b.notify("workspace/didChangeConfiguration", map[string]interface{}{"settings": nil})
+	waitFor(t, "the new settings", func() bool { return sessionModel(l, rootB) == "model-c" })
+	if got := sessionModel(l, rootA); got != "model-a" {
+		t.Errorf("session A uses %s after B changed its settings, want model-a", got)
+	}
+
+	// The state of a session is released when it ends
+	if n := sessionCount(l); n != 2 {
+		t.Fatalf("%d sessions, want 2", n)
+	}
+	a.close()
+	waitFor(t, "session A to be released", func() bool { return sessionCount(l) == 1 })
+	if sessionModel(l, rootB) != "model-c" {
+		t.Errorf("session B was released with A")
+	}
+	b.close()
+	waitFor(t, "session B to be released", func() bool { return sessionCount(l) == 0 })
+}
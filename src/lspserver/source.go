@@ -0,0 +1,155 @@
+package lspserver
+
+import (
+	"regexp"
+	"strings"
+)
+
+// SourceFunction is a function definition found in a document. Lines are
+// 1-based and inclusive, StartLine is the first line of the declarator
+// (return type and specifiers included).
+type SourceFunction struct {
+	Name      string
+	StartLine int
+	EndLine   int
+}
+
+var functionNameRe = regexp.MustCompile(`([A-Za-z_][A-Za-z0-9_]*)\s*\([^;{}]*\)\s*(const\s*)?$`)
+
+var controlKeywords = map[string]bool{
+	"if": true, "for": true, "while": true, "switch": true, "do": true,
+	"else": true, "return": true, "sizeof": true,
+}
+
+/*
+ * FindFunctions locates the top level function definitions of a C-like
+ * document by matching braces outside of comments and string literals.
+ * @param text The document content
+ * @return functions The functions in document order
+ */
+func FindFunctions(text string) []SourceFunction {
+	var functions []SourceFunction
+	code := stripCommentsAndStrings(text)
+
+	depth := 0
+	headerStart := 0
+	current := -1
+
+	for i := 0; i < len(code); i++ {
+		switch code[i] {
+		case '{':
+			if depth == 0 {
+				header := strings.TrimRight(code[headerStart:i], " \t\r\n")
+				m := functionNameRe.FindStringSubmatchIndex(header)
+				if m != nil && !controlKeywords[header[m[2]:m[3]]] {
+					leading := len(header) - len(strings.TrimLeft(header, " \t\r\n"))
+					functions = append(functions, SourceFunction{
+						Name:      header[m[2]:m[3]],
+						StartLine: lineAtOffset(code, headerStart+leading),
+					})
+					current = len(functions) - 1
+				}
+			}
+			depth++
+		case '}':
+			if depth > 0 {
+				depth--
+			}
+			if depth == 0 {
+				if current != -1 {
+					functions[current].EndLine = lineAtOffset(code, i)
+					current = -1
+				}
+				headerStart = i + 1
+			}
+		case ';':
+			if depth == 0 {
+				headerStart = i + 1
+			}
+		}
+	}
+
+	if current != -1 {
+		functions[current].EndLine = lineAtOffset(code, len(code))
+	}
+	return functions
+}
+
+// lineAtOffset returns the 1-based line of a byte offset.
+func lineAtOffset(text string, offset int) int {
+	if offset > len(text) {
+		offset = len(text)
+	}
+	return strings.Count(text[:offset], "\n") + 1
+}
+
+// FunctionAt returns the function enclosing the 1-based line.
+func FunctionAt(functions []SourceFunction, line int) (SourceFunction, bool) {
+	for _, f := range functions {
+		if line >= f.StartLine && line <= f.EndLine {
+			return f, true
+		}
+	}
+	return SourceFunction{}, false
+}
+
+/*
+ * stripCommentsAndStrings blanks out comments, string and character literals
+ * and preprocessor lines while keeping every newline, so offsets into the
+ * result map to the same lines as the original text.
+ */
+func stripCommentsAndStrings(text string) string {
+	out := []byte(text)
+	lineStart := true
+
+	for i := 0; i < len(out); i++ {
+		c := out[i]
+		switch {
+		case c == '\n':
+			lineStart = true
+			continue
+		case c == ' ' || c == '\t' || c == '\r':
+			continue
+		case lineStart && c == '#':
+			for ; i < len(out) && out[i] != '\n'; i++ {
+				// a backslash continues the directive on the next line
+				if out[i] == '\\' && i+1 < len(out) && out[i+1] == '\n' {
+					out[i] = ' '
+					i++
+					continue
+				}
+				out[i] = ' '
+			}
+			i--
+			continue
+		case c == '/' && i+1 < len(out) && out[i+1] == '/':
+			for ; i < len(out) && out[i] != '\n'; i++ {
+				out[i] = ' '
+			}
+			i--
+		case c == '/' && i+1 < len(out) && out[i+1] == '*':
+			out[i], out[i+1] = ' ', ' '
+			for i += 2; i < len(out); i++ {
+				if out[i] == '*' && i+1 < len(out) && out[i+1] == '/' {
+					out[i], out[i+1] = ' ', ' '
+					i++
+					break
+				}
+				if out[i] != '\n' {
+					out[i] = ' '
+				}
+			}
+		case c == '"' || c == '\'':
+			quote := c
+			for i++; i < len(out) && out[i] != quote && out[i] != '\n'; i++ {
+				if out[i] == '\\' && i+1 < len(out) && out[i+1] != '\n' {
+					out[i] = ' '
+					i++
+				}
+				out[i] = ' '
+			}
+		}
+		lineStart = false
+	}
+	return string(out)
+}
@@ -0,0 +1,349 @@
+package lspserver
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/TobiasYin/go-lsp/logs"
+)
+
+// StaticSource is the diagnostic source of the built-in checks.
+const StaticSource = "fuzzlsp-static"
+
+const (
+	defaultLineLimit = 76
+	indentWidth      = 4
+)
+
+// staticCheck evaluates one rule on a tokenized document.
+type staticCheck func(c *checkContext, rule Rule) []LspDiagnostic
+
+// staticChecks are the checks a rule can select with its "check" field.
+var staticChecks = map[string]staticCheck{
+	"indent":            checkIndent,
+	"line-length":       checkLineLength,
+	"banned-identifier": checkBannedIdentifier,
+	"banned-call":       checkBannedCall,
+	"compound-body":     checkCompoundBody,
+}
+
+// textChecks don't need the C tokenizer and run for every language.
+var textChecks = map[string]bool{
+	"line-length": true,
+}
+
+type checkContext struct {
+	uri    string
+	lines  []string
+	tokens []CToken
+	code   []CToken
+}
+
+// Static reports whether the rule is evaluated by a built-in check instead
+// of the LLM for documents of the profile's language.
+func (r Rule) Static(profile *LanguageProfile) bool {
+	if _, ok := staticChecks[r.Check]; !ok {
+		return false
+	}
+	return profile.CLike || textChecks[r.Check]
+}
+
+// LlmRules drops the rules covered by a built-in check, they don't need to
+// be in the prompt.
+func LlmRules(profile *LanguageProfile, rules []Rule) []Rule {
+	var llm []Rule
+	for _, rule := range rules {
+		if !rule.Static(profile) {
+			llm = append(llm, rule)
+		}
+	}
+	return llm
+}
+
+/*
+ * RunStaticChecks evaluates the rules that have a built-in check. Token based
+ * checks only run for C-like languages.
+ * @param uri The document URI
+ * @param text The document content
+ * @param profile The language profile of the document
+ * @param rules The enabled rules, rules without a check are skipped
+ * @return diagnostics The findings with exact ranges
+ */
+func RunStaticChecks(uri string, text string, profile *LanguageProfile, rules []Rule) []LspDiagnostic {
+	tokens := TokenizeC(text)
+	c := &checkContext{
+		uri:    uri,
+		lines:  strings.Split(text, "\n"),
+		tokens: tokens,
+		code:   CodeTokens(tokens),
+	}
+
+	diagnostics := []LspDiagnostic{}
+	for _, rule := range rules {
+		if rule.Check == "" {
+			continue
+		}
+		check, ok := staticChecks[rule.Check]
+		if !ok {
+			logs.Printf("Unknown check %s for rule %s, leaving it to the LLM", rule.Check, rule.ID)
+			continue
+		}
+		if !rule.Static(profile) {
+			continue
+		}
+		diagnostics = append(diagnostics, check(c, rule)...)
+	}
+	return diagnostics
+}
+
+func (c *checkContext) diagnostic(rule Rule, line int, column int, endColumn int, description string) LspDiagnostic {
+	return LspDiagnostic{
+		Uri:            c.uri,
+		LineNumber:     line,
+		Column:         column,
+		EndLine:        line,
+		EndColumn:      endColumn,
+		Source:         StaticSource,
+		Rule:           rule.ID,
+		Severity:       rule.Category,
+		Description:    description,
+		Recommendation: rule.Description,
+	}
+}
+
+func (c *checkContext) tokenDiagnostic(rule Rule, t CToken, description string) LspDiagnostic {
+	d := c.diagnostic(rule, t.Line, t.Column, t.EndColumn, description)
+	d.EndLine = t.EndLine
+	return d
+}
+
+// checkLineLength reports lines wider than the rule's limit (76 by default),
+// tabs count as indentWidth columns.
+func checkLineLength(c *checkContext, rule Rule) []LspDiagnostic {
+	limit := rule.Limit
+	if limit <= 0 {
+		limit = defaultLineLimit
+	}
+
+	var diagnostics []LspDiagnostic
+	for i, line := range c.lines {
+		line = strings.TrimRight(line, "\r")
+		width, column, start := 0, 0, -1
+		for _, r := range line {
+			if r == '\t' {
+				width += indentWidth - width%indentWidth
+			} else {
+				width++
+			}
+			if width > limit && start == -1 {
+				start = column
+			}
+			column += utf16Len(string(r))
+		}
+		if start != -1 {
+			diagnostics = append(diagnostics, c.diagnostic(rule, i+1, start, column,
+				fmt.Sprintf("Line is %d columns long, the limit is %d", width, limit)))
+		}
+	}
+	return diagnostics
+}
+
+// checkIndent reports tabs in the indentation and statements that are not
+// indented by a multiple of indentWidth spaces. Continuation lines (inside
+// parentheses or comments) are only checked for tabs.
+func checkIndent(c *checkContext, rule Rule) []LspDiagnostic {
+	// the first token on each line and whether it starts a statement
+	firstToken := make(map[int]CToken)
+	statement := make(map[int]bool)
+	depth := 0
+	var prev *CToken
+	for i := range c.tokens {
+		t := c.tokens[i]
+		if _, seen := firstToken[t.Line]; !seen {
+			firstToken[t.Line] = t
+			statement[t.Line] = depth == 0 && (prev == nil || startsStatement(prev.Text))
+		}
+		if t.Kind == CTokenComment || t.Kind == CTokenDirective {
+			continue
+		}
+		switch t.Text {
+		case "(", "[":
+			depth++
+		case ")", "]":
+			if depth > 0 {
+				depth--
+			}
+		}
+		prev = &c.tokens[i]
+	}
+
+	var diagnostics []LspDiagnostic
+	for i, line := range c.lines {
+		lineNumber := i + 1
+		indent := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+		if indent == "" || strings.TrimSpace(line) == "" {
+			continue
+		}
+		t, ok := firstToken[lineNumber]
+		if !ok || t.Column != utf16Len(indent) {
+			// the line continues a comment or literal
+			continue
+		}
+		if strings.Contains(indent, "\t") {
+			diagnostics = append(diagnostics, c.diagnostic(rule, lineNumber, 0, len(indent),
+				"Tab used for indentation"))
+			continue
+		}
+		if t.Kind == CTokenComment || t.Kind == CTokenDirective || !statement[lineNumber] {
+			continue
+		}
+		if len(indent)%indentWidth != 0 {
+			diagnostics = append(diagnostics, c.diagnostic(rule, lineNumber, 0, len(indent),
+				fmt.Sprintf("Indentation of %d spaces is not a multiple of %d", len(indent), indentWidth)))
+		}
+	}
+	return diagnostics
+}
+
+func startsStatement(prev string) bool {
+	switch prev {
+	case ";", "{", "}", ")", ":", "else", "do":
+		return true
+	}
+	return false
+}
+
+// checkBannedIdentifier reports every use of the rule's identifiers.
+func checkBannedIdentifier(c *checkContext, rule Rule) []LspDiagnostic {
+	banned := identifierSet(rule)
+	var diagnostics []LspDiagnostic
+	for _, t := range c.code {
+		if (t.Kind == CTokenIdent || t.Kind == CTokenKeyword) && banned[t.Text] {
+			diagnostics = append(diagnostics, c.tokenDiagnostic(rule, t,
+				fmt.Sprintf("`%s` must not be used", t.Text)))
+		}
+	}
+	return diagnostics
+}
+
+// checkBannedCall reports calls to the rule's functions. Members with the
+// same name (s.free(), p->free()) are not calls to the library function.
+func checkBannedCall(c *checkContext, rule Rule) []LspDiagnostic {
+	banned := identifierSet(rule)
+	var diagnostics []LspDiagnostic
+	for i, t := range c.code {
+		if t.Kind != CTokenIdent || !banned[t.Text] {
+			continue
+		}
+		if i+1 >= len(c.code) || c.code[i+1].Text != "(" {
+			continue
+		}
+		if i > 0 && (c.code[i-1].Text == "." || c.code[i-1].Text == "->") {
+			continue
+		}
+		diagnostics = append(diagnostics, c.tokenDiagnostic(rule, t,
+			fmt.Sprintf("Call to `%s` is not allowed", t.Text)))
+	}
+	return diagnostics
+}
+
+func identifierSet(rule Rule) map[string]bool {
+	set := make(map[string]bool)
+	for _, id := range rule.Identifiers {
+		set[id] = true
+	}
+	return set
+}
+
+// checkCompoundBody reports if, else, for, while, do and switch statements
+// whose body is not enclosed in braces.
+func checkCompoundBody(c *checkContext, rule Rule) []LspDiagnostic {
+	var diagnostics []LspDiagnostic
+	code := c.code
+
+	// doBlocks tracks for every open brace whether it is the body of a do
+	// statement, so the while of "do { } while (x);" is not a loop.
+	var doBlocks []bool
+	closedDo := false
+	// openDo counts the do statements without braces whose while is still
+	// to come, as in "do x++; while (x);".
+	openDo := 0
+
+	report := func(t CToken) {
+		diagnostics = append(diagnostics, c.tokenDiagnostic(rule, t,
+			fmt.Sprintf("The body of `%s` is not enclosed in braces", t.Text)))
+	}
+	next := func(i int) string {
+		if i < len(code) {
+			return code[i].Text
+		}
+		return ""
+	}
+
+	for i, t := range code {
+		switch t.Text {
+		case "{":
+			doBlocks = append(doBlocks, i > 0 && code[i-1].Text == "do")
+			continue
+		case "}":
+			closedDo = false
+			if n := len(doBlocks); n > 0 {
+				closedDo = doBlocks[n-1]
+				doBlocks = doBlocks[:n-1]
+			}
+			continue
+		}
+		if t.Kind != CTokenKeyword {
+			continue
+		}
+
+		switch t.Text {
+		case "if", "for", "switch", "while":
+			if t.Text == "while" && i > 0 && code[i-1].Text == "}" && closedDo {
+				continue
+			}
+			if t.Text == "while" && i > 0 && code[i-1].Text == ";" && openDo > 0 {
+				openDo--
+				continue
+			}
+			end := matchParen(code, i+1)
+			if end == -1 {
+				continue
+			}
+			if next(end+1) != "{" {
+				report(t)
+			}
+		case "else":
+			if n := next(i + 1); n != "{" && n != "if" {
+				report(t)
+			}
+		case "do":
+			if next(i+1) != "{" {
+				report(t)
+				openDo++
+			}
+		}
+	}
+	return diagnostics
+}
+
+// matchParen returns the index of the parenthesis closing the one at i, or
+// -1 if code[i] is not an opening parenthesis or it is never closed.
+func matchParen(code []CToken, i int) int {
+	if i >= len(code) || code[i].Text != "(" {
+		return -1
+	}
+	depth := 0
+	for j := i; j < len(code); j++ {
+		switch code[j].Text {
+		case "(":
+			depth++
+		case ")":
+			depth--
+			if depth == 0 {
+				return j
+			}
+		}
+	}
+	return -1
+}
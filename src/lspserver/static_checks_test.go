@@ -0,0 +1,98 @@
+package lspserver
+
+import "testing"
+
+func TestRunStaticChecks(t *testing.T) {
+	c, _ := ProfileFor("c", "file:///a.c")
+	python, _ := ProfileFor("python", "file:///a.py")
+
+	indent := Rule{ID: "STYLE-INDENT", Category: "advisory", Check: "indent"}
+	lineLength := Rule{ID: "STYLE-LINE", Category: "advisory", Check: "line-length", Limit: 10}
+	goTo := Rule{ID: "MISRA-15.1", Category: "advisory", Check: "banned-identifier", Identifiers: []string{"goto"}}
+	malloc := Rule{ID: "MISRA-21.3", Category: "required", Check: "banned-call", Identifiers: []string{"malloc", "free"}}
+	compound := Rule{ID: "MISRA-15.6", Category: "required", Check: "compound-body"}
+
+	type finding struct {
+		rule   string
+		line   int
+		column int
+	}
+	tests := []struct {
+		name     string
+		profile  *LanguageProfile
+		rules    []Rule
+		text     string
+		findings []finding
+	}{
+		{"tab indentation", c, []Rule{indent}, "int f(void)\n{\n\treturn 0;\n}", []finding{{"STYLE-INDENT", 3, 0}}},
+		{"odd indentation", c, []Rule{indent}, "int f(void)\n{\n   return 0;\n}", []finding{{"STYLE-INDENT", 3, 0}}},
+		{"continuation line", c, []Rule{indent}, "int f(void)\n{\n    g(1,\n      2);\n}", nil},
+		{"long line", c, []Rule{lineLength}, "int x;\nint longer = 1;", []finding{{"STYLE-LINE", 2, 10}}},
+		{"tab counts as indent width", c, []Rule{lineLength}, "\t\tx = 1;", []finding{{"STYLE-LINE", 1, 4}}},
+		{"line length for any language", python, []Rule{lineLength}, "value = 12345", []finding{{"STYLE-LINE", 1, 10}}},
+		{"token checks only for c-like", python, []Rule{goTo}, "goto = 1", nil},
+		{"banned identifier", c, []Rule{goTo}, "goto out; /* goto */", []finding{{"MISRA-15.1", 1, 0}}},
+		{"banned call", c, []Rule{malloc}, "p = malloc(4);\nfree(p);", []finding{{"MISRA-21.3", 1, 4}, {"MISRA-21.3", 2, 0}}},
+		{"member is no banned call", c, []Rule{malloc}, "pool.free(p);\npool->malloc(4);\nint malloc;", nil},
+		{"if without braces", c, []Rule{compound}, "if (x)\n    y();", []finding{{"MISRA-15.6", 1, 0}}},
+		{"else if is fine", c, []Rule{compound}, "if (x) {\n} else if (y) {\n} else\n    z();", []finding{{"MISRA-15.6", 3, 2}}},
+		{"do while", c, []Rule{compound}, "do {\n    x++;\n} while (x < 3);", nil},
+		{"do without braces", c, []Rule{compound}, "do x++; while (x < 3);", []finding{{"MISRA-15.6", 1, 0}}},
+		{"nested do without braces", c, []Rule{compound}, "do do x++; while (x < 3); while (y);\nwhile (z);", []finding{{"MISRA-15.6", 1, 0}, {"MISRA-15.6", 1, 3}, {"MISRA-15.6", 2, 0}}},
+		{"while without braces", c, []Rule{compound}, "while (x)\n    x--;", []finding{{"MISRA-15.6", 1, 0}}},
+		{"rule without a check", c, []Rule{{ID: "MISRA-17.7"}}, "f();", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			diagnostics := RunStaticChecks("file:///a", tt.text, tt.profile, tt.rules)
+			if len(diagnostics) != len(tt.findings) {
+				t.Fatalf("got %d findings, want %d: %+v", len(diagnostics), len(tt.findings), diagnostics)
+			}
+			for i, want := range tt.findings {
+				got := diagnostics[i]
+				if got.Rule != want.rule || got.LineNumber != want.line || got.Column != want.column {
+					t.Errorf("finding %d = %s at %d:%d, want %s at %d:%d", i,
+						got.Rule, got.LineNumber, got.Column, want.rule, want.line, want.column)
+				}
+				if got.Source != StaticSource {
+					t.Errorf("source = %q, want %q", got.Source, StaticSource)
+				}
+			}
+		})
+	}
+}
+
+func TestLlmRulesDropsStaticRules(t *testing.T) {
+	c, _ := ProfileFor("c", "file:///a.c")
+	python, _ := ProfileFor("python", "file:///a.py")
+	rules := []Rule{
+		{ID: "STYLE-INDENT", Check: "indent"},
+		{ID: "STYLE-LINE", Check: "line-length"},
+		{ID: "MISRA-17.7"},
+		{ID: "CUSTOM", Check: "unknown"},
+	}
+
+	tests := []struct {
+		profile *LanguageProfile
+		want    []string
+	}{
+		{c, []string{"MISRA-17.7", "CUSTOM"}},
+		{python, []string{"STYLE-INDENT", "MISRA-17.7", "CUSTOM"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.profile.LanguageID, func(t *testing.T) {
+			var ids []string
+			for _, rule := range LlmRules(tt.profile, rules) {
+				ids = append(ids, rule.ID)
+			}
+			if len(ids) != len(tt.want) {
+				t.Fatalf("LlmRules = %v, want %v", ids, tt.want)
+			}
+			for i := range ids {
+				if ids[i] != tt.want[i] {
+					t.Fatalf("LlmRules = %v, want %v", ids, tt.want)
+				}
+			}
+		})
+	}
+}
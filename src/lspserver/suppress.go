@@ -0,0 +1,351 @@
+package lspserver
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/TobiasYin/go-lsp/logs"
+)
+
+// Rule IDs of the diagnostics reported for the deviation comments themselves.
+const (
+	RuleDeviationMalformed = "FUZZLSP-DEVIATION-MALFORMED"
+	RuleDeviationUnused    = "FUZZLSP-DEVIATION-UNUSED"
+)
+
+// deviationSource is the diagnostic source of deviation findings.
+const deviationSource = "fuzzlsp"
+
+var (
+	deviationRe     = regexp.MustCompile(`fuzzlsp-deviation(-begin|-end)?\b(.*)$`)
+	deviationBodyRe = regexp.MustCompile(`^([A-Za-z0-9_.*\-]+)\s*:\s*(\S.*)$`)
+	deviationEndRe  = regexp.MustCompile(`^([A-Za-z0-9_.*\-]+)?$`)
+	commentCloseRe  = regexp.MustCompile(`\s*(\*/|-->).*$`)
+)
+
+// Deviation is a reviewed finding recorded in the source, e.g.
+//
+//	return; /* fuzzlsp-deviation MISRA-15.5: early return keeps it readable, JIRA-42 */
+//
+//	/* fuzzlsp-deviation-begin MISRA-21.3: pool allocator, SAFE-7 */
+//	...
+//	/* fuzzlsp-deviation-end MISRA-21.3 */
+//
+// A single line deviation covers the line it is on and the line below it,
+// a block deviation covers every line between begin and end. Only comments
+// count, a string or identifier that happens to contain the marker doesn't.
+type Deviation struct {
+	Uri       string `json:"uri"`
+	Rule      string `json:"rule"`
+	Reason    string `json:"reason"`
+	Ticket    string `json:"ticket,omitempty"`
+	Line      int    `json:"line"`
+	StartLine int    `json:"start_line"`
+	EndLine   int    `json:"end_line"`
+	Block     bool   `json:"block"`
+	Used      int    `json:"suppressed"`
+}
+
+func (d *Deviation) covers(diag LspDiagnostic) bool {
+	if diag.LineNumber < d.StartLine || diag.LineNumber > d.EndLine {
+		return false
+	}
+	if strings.EqualFold(d.Rule, diag.Rule) {
+		return true
+	}
+	matched, _ := path.Match(d.Rule, diag.Rule)
+	return matched
+}
+
+// commentLine is the text of the comments on one line.
+type commentLine struct {
+	line int // 1-based
+	text string
+}
+
+/*
+ * commentLines returns the comments of a document line by line. C-like
+ * documents are tokenized, others are scanned with the comment syntax of
+ * their profile. Without a profile or comment syntax every line counts.
+ * @param text The document content
+ * @param profile The language profile of the document, may be nil
+ * @return comments The comment text of every line with a comment
+ */
+func commentLines(text string, profile *LanguageProfile) []commentLine {
+	var comments []commentLine
+	if profile != nil && profile.CLike {
+		for _, token := range TokenizeC(text) {
+			if token.Kind != CTokenComment {
+				continue
+			}
+			for i, part := range strings.Split(token.Text, "\n") {
+				comments = append(comments, commentLine{line: token.Line + i, text: part})
+			}
+		}
+		return comments
+	}
+
+	lines := strings.Split(text, "\n")
+	if profile == nil || (profile.LineComment == "" && len(profile.BlockComment) != 2) {
+		for i, line := range lines {
+			comments = append(comments, commentLine{line: i + 1, text: line})
+		}
+		return comments
+	}
+	inBlock := false
+	for i, line := range lines {
+		var comment string
+		comment, inBlock = lineComments(line, profile, inBlock)
+		if comment != "" {
+			comments = append(comments, commentLine{line: i + 1, text: comment})
+		}
+	}
+	return comments
+}
+
+/*
+ * lineComments returns the comments on a line, skipping string literals.
+ * @param line The line
+ * @param profile The language profile with the comment syntax
+ * @param inBlock Whether the line starts inside a block comment
+ * @return comment The comments on the line, separated by spaces
+ * @return inBlock Whether the next line starts inside a block comment
+ */
+func lineComments(line string, profile *LanguageProfile, inBlock bool) (string, bool) {
+	var comments []string
+	start := 0 // of the block comment being scanned
+	for i := 0; i < len(line); {
+		if inBlock {
+			closing := profile.BlockComment[1]
+			end := strings.Index(line[i:], closing)
+			if end == -1 {
+				return strings.Join(append(comments, line[start:]), " "), true
+			}
+			i += end + len(closing)
+			comments = append(comments, line[start:i])
+			inBlock = false
+			continue
+		}
+		rest := line[i:]
+		switch {
+		case profile.LineComment != "" && strings.HasPrefix(rest, profile.LineComment):
+			return strings.Join(append(comments, rest), " "), false
+		case len(profile.BlockComment) == 2 && strings.HasPrefix(rest, profile.BlockComment[0]):
+			start = i
+			i += len(profile.BlockComment[0])
+			inBlock = true
+		case line[i] == '"' || line[i] == '\'':
+			i = skipQuoted(line, i)
+		default:
+			i++
+		}
+	}
+	if inBlock {
+		comments = append(comments, line[start:])
+	}
+	return strings.Join(comments, " "), inBlock
+}
+
+// skipQuoted returns the offset after the literal quoted at i. A quote that
+// isn't closed on the line, e.g. of a Rust lifetime, is skipped alone.
+func skipQuoted(line string, i int) int {
+	for j := i + 1; j < len(line); j++ {
+		switch line[j] {
+		case '\\':
+			j++
+		case line[i]:
+			return j + 1
+		}
+	}
+	return i + 1
+}
+
+/*
+ * ParseDeviations scans the comments of a document for deviations.
+ * @param uri The document URI
+ * @param text The document content
+ * @param profile The language profile of the document, may be nil
+ * @return deviations The well formed deviations
+ * @return malformed Diagnostics for comments that couldn't be understood
+ */
+func ParseDeviations(uri string, text string, profile *LanguageProfile) ([]Deviation, []LspDiagnostic) {
+	var deviations []Deviation
+	var malformed []LspDiagnostic
+	var open []Deviation
+
+	report := func(line int, description string) {
+		malformed = append(malformed, LspDiagnostic{
+			Uri:            uri,
+			LineNumber:     line,
+			Source:         deviationSource,
+			Rule:           RuleDeviationMalformed,
+			Severity:       "warning",
+			Description:    description,
+			Recommendation: "Use \"fuzzlsp-deviation <RULE>: <reason>, <ticket>\" or the -begin/-end block form.",
+		})
+	}
+
+	for _, comment := range commentLines(text, profile) {
+		lineNumber := comment.line
+		m := deviationRe.FindStringSubmatch(comment.text)
+		if m == nil {
+			continue
+		}
+		kind := m[1]
+		body := strings.TrimSpace(commentCloseRe.ReplaceAllString(m[2], ""))
+
+		if kind == "-end" {
+			em := deviationEndRe.FindStringSubmatch(body)
+			if em == nil {
+				report(lineNumber, "Malformed deviation end: "+body)
+				continue
+			}
+			idx := -1
+			for j := len(open) - 1; j >= 0; j-- {
+				if em[1] == "" || strings.EqualFold(open[j].Rule, em[1]) {
+					idx = j
+					break
+				}
+			}
+			if idx == -1 {
+				report(lineNumber, "Deviation end without a matching begin")
+				continue
+			}
+			dev := open[idx]
+			dev.EndLine = lineNumber
+			deviations = append(deviations, dev)
+			open = append(open[:idx], open[idx+1:]...)
+			continue
+		}
+
+		bm := deviationBodyRe.FindStringSubmatch(body)
+		if bm == nil {
+			report(lineNumber, "Deviation must name a rule and give a justification")
+			continue
+		}
+		reason, ticket := strings.TrimSpace(bm[2]), ""
+		if comma := strings.LastIndex(reason, ","); comma != -1 {
+			reason, ticket = strings.TrimSpace(reason[:comma]), strings.TrimSpace(reason[comma+1:])
+		}
+		if reason == "" {
+			report(lineNumber, "Deviation for "+bm[1]+" has no justification")
+			continue
+		}
+
+		dev := Deviation{
+			Uri:       uri,
+			Rule:      bm[1],
+			Reason:    reason,
+			Ticket:    ticket,
+			Line:      lineNumber,
+			StartLine: lineNumber,
+			EndLine:   lineNumber + 1,
+			Block:     kind == "-begin",
+		}
+		if dev.Block {
+			open = append(open, dev)
+		} else {
+			deviations = append(deviations, dev)
+		}
+	}
+
+	for _, dev := range open {
+		report(dev.Line, "Deviation begin for "+dev.Rule+" is never ended")
+	}
+	return deviations, malformed
+}
+
+/*
+ * ApplyDeviations removes the diagnostics covered by a deviation and adds
+ * diagnostics for unused and malformed deviation comments.
+ * @param uri The document URI
+ * @param text The document content
+ * @param profile The language profile of the document, may be nil
+ * @param diagnostics The diagnostics to filter
+ * @return diagnostics The remaining diagnostics
+ * @return deviations The deviations with their usage counts
+ */
+func ApplyDeviations(uri string, text string, profile *LanguageProfile, diagnostics []LspDiagnostic) ([]LspDiagnostic, []Deviation) {
+	deviations, malformed := ParseDeviations(uri, text, profile)
+
+	var remaining []LspDiagnostic
+	for _, d := range diagnostics {
+		suppressed := false
+		for i := range deviations {
+			if deviations[i].covers(d) {
+				deviations[i].Used++
+				suppressed = true
+			}
+		}
+		if suppressed {
+			logs.Printf("[+] Suppressed %s on line %d by deviation", d.Rule, d.LineNumber)
+			continue
+		}
+		remaining = append(remaining, d)
+	}
+
+	for _, dev := range deviations {
+		if dev.Used > 0 {
+			continue
+		}
+		remaining = append(remaining, LspDiagnostic{
+			Uri:            uri,
+			LineNumber:     dev.Line,
+			Source:         deviationSource,
+			Rule:           RuleDeviationUnused,
+			Severity:       "hint",
+			Description:    "Deviation for " + dev.Rule + " does not suppress any finding",
+			Recommendation: "Remove the deviation comment if the finding was fixed.",
+		})
+	}
+
+	return append(remaining, malformed...), deviations
+}
+
+// DeviationRegister keeps the active deviations of every document a session
+// analysed.
+type DeviationRegister struct {
+	mutex      sync.Mutex
+	deviations map[string][]Deviation
+}
+
+func NewDeviationRegister() *DeviationRegister {
+	return &DeviationRegister{deviations: make(map[string][]Deviation)}
+}
+
+func (r *DeviationRegister) Update(uri string, deviations []Deviation) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.deviations[uri] = deviations
+}
+
+// All returns every deviation sorted by document and line.
+func (r *DeviationRegister) All() []Deviation {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	all := []Deviation{}
+	for _, deviations := range r.deviations {
+		all = append(all, deviations...)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].Uri != all[j].Uri {
+			return all[i].Uri < all[j].Uri
+		}
+		return all[i].Line < all[j].Line
+	})
+	return all
+}
+
+// Export writes the register as a JSON array to fileName.
+func (r *DeviationRegister) Export(fileName string) error {
+	data, err := json.MarshalIndent(r.All(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fileName, data, 0644)
+}
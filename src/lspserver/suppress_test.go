@@ -0,0 +1,48 @@
+package lspserver
+
+import "testing"
+
+func TestParseDeviationsOnlyInComments(t *testing.T) {
+	c, _ := ProfileFor("c", "file:///a.c")
+	python, _ := ProfileFor("python", "file:///a.py")
+	rust, _ := ProfileFor("rust", "file:///a.rs")
+
+	tests := []struct {
+		name    string
+		profile *LanguageProfile
+		text    string
+		lines   []int // lines of the deviations found
+	}{
+		{"c block comment", c, "return; /* fuzzlsp-deviation MISRA-15.5: early exit, T-1 */", []int{1}},
+		{"c line comment", c, "x = 1;\n// fuzzlsp-deviation MISRA-10.1: checked", []int{2}},
+		{"c string", c, `puts("fuzzlsp-deviation MISRA-15.5: not a comment");`, nil},
+		{"c comment after a string", c, `puts("/*"); // fuzzlsp-deviation MISRA-17.7: ignored`, []int{1}},
+		{"c multi-line comment", c, "/*\n * fuzzlsp-deviation MISRA-21.3: pool\n */", []int{2}},
+		{"python comment", python, "x = 1  # fuzzlsp-deviation PEP8-E501: generated", []int{1}},
+		{"python string", python, "s = '# fuzzlsp-deviation PEP8-E501: no'", nil},
+		{"python escaped quote", python, `s = "\" # fuzzlsp-deviation PEP8-E501: no"`, nil},
+		{"rust lifetime", rust, "fn f<'a>(x: &'a str) {} // fuzzlsp-deviation RUST-1: ok", []int{1}},
+		{"rust block comment", rust, "/* a\nfuzzlsp-deviation RUST-2: ok */ let x = 1;", []int{2}},
+		{"no profile", nil, "fuzzlsp-deviation RULE-1: any line", []int{1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			deviations, malformed := ParseDeviations("file:///a", tt.text, tt.profile)
+			if len(malformed) > 0 {
+				t.Fatalf("malformed: %+v", malformed)
+			}
+			var lines []int
+			for _, d := range deviations {
+				lines = append(lines, d.Line)
+			}
+			if len(lines) != len(tt.lines) {
+				t.Fatalf("deviations on lines %v, want %v", lines, tt.lines)
+			}
+			for i := range lines {
+				if lines[i] != tt.lines[i] {
+					t.Fatalf("deviations on lines %v, want %v", lines, tt.lines)
+				}
+			}
+		})
+	}
+}
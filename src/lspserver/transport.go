@@ -0,0 +1,82 @@
+package lspserver
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/TobiasYin/go-lsp/jsonrpc"
+)
+
+// DefaultListenAddress is used by -listen tcp: without an address.
+const DefaultListenAddress = "127.0.0.1:7998"
+
+// Listen is where the server accepts clients, an empty Network is stdio.
+// Path is the HTTP path of the "ws" network.
+type Listen struct {
+	Network string
+	Address string
+	Path    string
+}
+
+/*
+ * ParseListen parses the -listen option: "tcp:host:port", "unix:/path",
+ * "ws://host:port/path" or "stdio". Every accepted connection is a client of
+ * its own, so one server with a loaded model can be shared by several editor
+ * windows.
+ * @param spec The option, empty for stdio
+ * @return listen The network and address
+ * @return error An unknown transport or a missing address
+ */
+func ParseListen(spec string) (Listen, error) {
+	if spec == "" || spec == "stdio" {
+		return Listen{}, nil
+	}
+	if strings.HasPrefix(spec, "ws://") {
+		u, err := url.Parse(spec)
+		if err != nil || u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+			return Listen{}, fmt.Errorf("invalid -listen %q, use ws://host:port/path", spec)
+		}
+		address := u.Host
+		if address == "" {
+			address = DefaultListenAddress
+		}
+		path := u.Path
+		if path == "" {
+			path = "/"
+		}
+		return Listen{Network: "ws", Address: address, Path: path}, nil
+	}
+	network, address, ok := strings.Cut(spec, ":")
+	if !ok {
+		return Listen{}, fmt.Errorf("invalid -listen %q, use tcp:host:port, unix:/path or ws://host:port/path", spec)
+	}
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		if address == "" {
+			address = DefaultListenAddress
+		}
+	case "unix":
+		if address == "" {
+			return Listen{}, fmt.Errorf("-listen unix: needs the socket path")
+		}
+	default:
+		return Listen{}, fmt.Errorf("unknown transport %q in -listen %q", network, spec)
+	}
+	return Listen{Network: network, Address: address}, nil
+}
+
+// webSocketOptions are the path, origins and token of a "ws" listen.
+func webSocketOptions(listen Listen) jsonrpc.WebSocketOptions {
+	var origins []string
+	for _, origin := range strings.Split(*ParamWebSocketOrigins, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+	return jsonrpc.WebSocketOptions{
+		Path:           listen.Path,
+		AllowedOrigins: origins,
+		Token:          *ParamWebSocketToken,
+	}
+}
@@ -0,0 +1,99 @@
+package lspserver
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseListen(t *testing.T) {
+	tests := []struct {
+		spec string
+		want Listen
+		err  bool
+	}{
+		{"", Listen{}, false},
+		{"stdio", Listen{}, false},
+		{"tcp:", Listen{Network: "tcp", Address: DefaultListenAddress}, false},
+		{"tcp:127.0.0.1:9000", Listen{Network: "tcp", Address: "127.0.0.1:9000"}, false},
+		{"tcp6:[::1]:9000", Listen{Network: "tcp6", Address: "[::1]:9000"}, false},
+		{"unix:/tmp/fuzzlsp.sock", Listen{Network: "unix", Address: "/tmp/fuzzlsp.sock"}, false},
+		{"ws://localhost:9000", Listen{Network: "ws", Address: "localhost:9000", Path: "/"}, false},
+		{"ws://localhost:9000/lsp", Listen{Network: "ws", Address: "localhost:9000", Path: "/lsp"}, false},
+		{"ws://localhost:9000/lsp?token=x", Listen{}, true},
+		{"unix:", Listen{}, true},
+		{"udp:127.0.0.1:9000", Listen{}, true},
+		{"9000", Listen{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			got, err := ParseListen(tt.spec)
+			if (err != nil) != tt.err {
+				t.Fatalf("error = %v, want error %v", err, tt.err)
+			}
+			if got != tt.want {
+				t.Errorf("ParseListen = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// freeAddress returns a TCP address nobody listens on.
+func freeAddress(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+func TestTransportAccept(t *testing.T) {
+	tests := []struct {
+		name string
+		spec func(t *testing.T) string
+	}{
+		{"tcp", func(t *testing.T) string { return "tcp:" + freeAddress(t) }},
+		{"unix", func(t *testing.T) string { return "unix:" + filepath.Join(t.TempDir(), "fuzzlsp.sock") }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			listen, err := ParseListen(tt.spec(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			l, err := newServer("fuzzlsp-test", listen, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			go l.server.Run()
+
+			// Every connection is a session of its own
+			for i := 0; i < 2; i++ {
+				var conn net.Conn
+				waitFor(t, "the listener", func() bool {
+					conn, err = net.DialTimeout(listen.Network, listen.Address, time.Second)
+					return err == nil
+				})
+				c := newTestClient(t, conn, nil)
+				var result struct {
+					Capabilities struct {
+						ExecuteCommandProvider struct {
+							Commands []string `json:"commands"`
+						} `json:"executeCommandProvider"`
+					} `json:"capabilities"`
+				}
+				params := map[string]interface{}{"rootUri": "file://" + t.TempDir(), "capabilities": map[string]interface{}{}}
+				if err := c.request("initialize", params, &result); err != nil {
+					t.Fatalf("initialize: %v", err)
+				}
+				if len(result.Capabilities.ExecuteCommandProvider.Commands) != len(Commands) {
+					t.Errorf("commands = %v, want %v", result.Capabilities.ExecuteCommandProvider.Commands, Commands)
+				}
+			}
+			waitFor(t, "both sessions", func() bool { return sessionCount(l) == 2 })
+		})
+	}
+}
@@ -0,0 +1,363 @@
+package lspserver
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/TobiasYin/go-lsp/logs"
+	"github.com/TobiasYin/go-lsp/lsp/defines"
+)
+
+// Fix verification modes (-verify-fixes)
+const (
+	VerifyFull   = "full"   // built-in checks and rule-scoped LLM analysis
+	VerifyStatic = "static" // built-in checks only
+	VerifyOff    = "off"
+)
+
+// FixVerification compares the findings in a region before and after a fix.
+type FixVerification struct {
+	Resolved   []LspDiagnostic // targeted findings that are gone
+	Remaining  []LspDiagnostic // targeted findings that are still reported
+	Unchecked  []LspDiagnostic // targeted findings that could not be re-checked
+	Introduced []LspDiagnostic // findings the fix added to the region
+	Counted    []LspDiagnostic // targeted findings the LLM re-checked, only compared by count
+}
+
+/*
+ * Accepted reports whether the fix may be offered: at least one targeted
+ * finding must not be reported anymore and no new finding of error severity
+ * (a mandatory or required rule) may appear.
+ * @param rules The rules of the document, they decide the severities
+ * @return accepted True if the fix may be offered
+ */
+func (v FixVerification) Accepted(rules *RuleSet) bool {
+	if len(v.Resolved)+len(v.Unchecked) == 0 {
+		return false
+	}
+	return len(v.mandatory(rules)) == 0
+}
+
+func (v FixVerification) mandatory(rules *RuleSet) []LspDiagnostic {
+	var mandatory []LspDiagnostic
+	for _, d := range v.Introduced {
+		if rules.LspSeverity(d) == defines.DiagnosticSeverityError {
+			mandatory = append(mandatory, d)
+		}
+	}
+	return mandatory
+}
+
+// Note is the risk note shown with an accepted fix, empty if the fix was
+// fully verified.
+func (v FixVerification) Note() string {
+	var notes []string
+	if n := len(v.Remaining); n > 0 {
+		notes = append(notes, fmt.Sprintf("%d of %d findings remain", n, n+len(v.Resolved)+len(v.Unchecked)))
+	}
+	if n := len(v.Introduced); n > 0 {
+		notes = append(notes, fmt.Sprintf("%d new findings: %s", n, FindingRuleIDs(v.Introduced)))
+	}
+	if n := len(v.Unchecked); n > 0 {
+		notes = append(notes, "not re-checked: "+FindingRuleIDs(v.Unchecked))
+	}
+	if n := len(v.Counted); n > 0 {
+		notes = append(notes, "LLM re-check counts findings: "+FindingRuleIDs(v.Counted))
+	}
+	if len(notes) == 0 {
+		return ""
+	}
+	return "risk: " + strings.Join(notes, "; ")
+}
+
+// Reason explains why a fix was not accepted.
+func (v FixVerification) Reason(rules *RuleSet) string {
+	if mandatory := v.mandatory(rules); len(mandatory) > 0 {
+		return "it introduces " + FindingRuleIDs(mandatory)
+	}
+	return FindingRuleIDs(v.Remaining) + " is still reported"
+}
+
+/*
+ * verifyFix applies a fix to a copy of the document and checks the region
+ * again: with the built-in checks and, unless -verify-fixes is "static",
+ * with an LLM analysis scoped to the rules of the targeted findings. The
+ * LLM analyses the region before the fix the same way, so both sides of the
+ * comparison have the same scope.
+ * @param ctx The context of the request
+ * @param state The state of the session
+ * @param uri The document URI
+ * @param text The document content the fix was made for
+ * @param r The fix
+ * @param findings The findings the fix is meant to resolve
+ * @return verification The comparison of the findings before and after
+ * @return error Any error that occurred while applying the fix
+ */
+func (l *lspServer) verifyFix(ctx context.Context, state *sessionState, uri string, text string, r *Refactoring, findings []LspDiagnostic) (FixVerification, error) {
+	mode := VerifyFull
+	if ParamVerifyFixes != nil && *ParamVerifyFixes != "" {
+		mode = *ParamVerifyFixes
+	}
+	if mode == VerifyOff {
+		return FixVerification{Resolved: findings}, nil
+	}
+
+	patched, err := ApplyEdits(text, r.Edits)
+	if err != nil {
+		return FixVerification{}, err
+	}
+	newEnd := r.StartLine + len(splitRegion(r.Replacement)) - 1
+
+	profile, ok := state.profile(uri)
+	if !ok {
+		return FixVerification{Unchecked: findings}, nil
+	}
+	rules := l.ruleSet(state, profile)
+	enabled := l.enabledRules(state, profile)
+
+	before := diagnosticsIn(RunStaticChecks(uri, text, profile, enabled), r.StartLine, r.EndLine)
+	after := diagnosticsIn(RunStaticChecks(uri, patched, profile, enabled), r.StartLine, newEnd)
+
+	// the targeted rules the built-in checks don't cover
+	var llmRules []Rule
+	var unchecked []string
+	for _, id := range strings.Split(FindingRuleIDs(findings), ", ") {
+		rule, ok := rules.Lookup(id)
+		switch {
+		case ok && rule.Static(profile):
+		case ok && mode == VerifyFull:
+			llmRules = append(llmRules, rule)
+		default:
+			unchecked = append(unchecked, id)
+		}
+	}
+	if len(llmRules) > 0 {
+		ctx := state.backendContext(ctx)
+		original, err := l.analyseRegion(ctx, uri, r.Original, r.StartLine, profile, llmRules)
+		var rechecked []LspDiagnostic
+		if err == nil {
+			rechecked, err = l.analyseRegion(ctx, uri, r.Replacement, r.StartLine, profile, llmRules)
+		}
+		if err != nil {
+			logs.Printf("Re-analysis of the fix failed: %v", err)
+			for _, rule := range llmRules {
+				unchecked = append(unchecked, rule.ID)
+			}
+		} else {
+			before = append(before, original...)
+			after = append(after, rechecked...)
+		}
+	}
+
+	var counted []string
+	for _, rule := range llmRules {
+		if !containsString(unchecked, rule.ID) {
+			counted = append(counted, rule.ID)
+		}
+	}
+	return compareFindings(text, patched, findings, before, after, unchecked, counted), nil
+}
+
+/*
+ * analyseRegion runs the LLM analysis for a few rules on a region and moves
+ * the findings to the lines of the document.
+ * @param ctx The context of the request
+ * @param uri The document URI
+ * @param code The region
+ * @param startLine The 1-based line the region starts on
+ * @param profile The language profile of the document
+ * @param rules The rules to check
+ * @return diagnostics The findings with document line numbers
+ * @return error Any error that occurred while analysing
+ */
+func (l *lspServer) analyseRegion(ctx context.Context, uri string, code string, startLine int, profile *LanguageProfile, rules []Rule) ([]LspDiagnostic, error) {
+	analysis, err := l.backend.AnalyseDocument(ctx, uri, code, profile, rules, nil)
+	if err != nil {
+		return nil, err
+	}
+	diagnostics, err := DiagnosticsUnmarshal(uri, analysis)
+	if err != nil {
+		return nil, err
+	}
+	for i := range diagnostics {
+		diagnostics[i].LineNumber += startLine - 1
+		if diagnostics[i].EndLine > 0 {
+			diagnostics[i].EndLine += startLine - 1
+		}
+	}
+	return diagnostics, nil
+}
+
+/*
+ * compareFindings decides per rule what a fix did. A targeted finding
+ * remains if its rule is reported as often as before or is still reported
+ * on an unchanged line; findings beyond the number reported before are new.
+ * The LLM's line numbers can't be relied on, so its re-checks mostly come
+ * down to the count and are listed as counted.
+ * @param text The document before the fix
+ * @param patched The document after the fix
+ * @param targeted The findings the fix is meant to resolve
+ * @param before The findings in the region before the fix
+ * @param after The findings in the region after the fix
+ * @param unchecked The targeted rules that could not be re-checked
+ * @param counted The targeted rules re-checked by the LLM
+ * @return verification The comparison
+ */
+func compareFindings(text string, patched string, targeted []LspDiagnostic, before []LspDiagnostic, after []LspDiagnostic, unchecked []string, counted []string) FixVerification {
+	oldLines := strings.Split(text, "\n")
+	newLines := strings.Split(patched, "\n")
+	lineText := func(lines []string, line int) string {
+		if line < 1 || line > len(lines) {
+			return ""
+		}
+		return strings.TrimSpace(lines[line-1])
+	}
+
+	var v FixVerification
+	for _, d := range targeted {
+		if containsString(unchecked, d.Rule) {
+			v.Unchecked = append(v.Unchecked, d)
+			continue
+		}
+		if containsString(counted, d.Rule) {
+			v.Counted = append(v.Counted, d)
+		}
+		remains := len(diagnosticsWithRule(after, d.Rule)) >= len(diagnosticsWithRule(before, d.Rule))
+		for _, a := range diagnosticsWithRule(after, d.Rule) {
+			if lineText(newLines, a.LineNumber) == lineText(oldLines, d.LineNumber) {
+				remains = true
+			}
+		}
+		if remains {
+			v.Remaining = append(v.Remaining, d)
+		} else {
+			v.Resolved = append(v.Resolved, d)
+		}
+	}
+
+	// per rule, the findings beyond the number reported before are new
+	seen := make(map[string]int)
+	for _, a := range after {
+		seen[a.Rule]++
+		if seen[a.Rule] > len(diagnosticsWithRule(before, a.Rule)) {
+			v.Introduced = append(v.Introduced, a)
+		}
+	}
+	return v
+}
+
+func diagnosticsWithRule(diagnostics []LspDiagnostic, rule string) []LspDiagnostic {
+	var with []LspDiagnostic
+	for _, d := range diagnostics {
+		if d.Rule == rule {
+			with = append(with, d)
+		}
+	}
+	return with
+}
+
+/*
+ * ApplyEdits applies non-overlapping text edits to a document in memory.
+ * Positions are 0-based lines and UTF-16 characters as in LSP.
+ * @param text The document content
+ * @param edits The edits
+ * @return text The edited document
+ * @return error An edit outside of the document or overlapping another
+ */
+func ApplyEdits(text string, edits []defines.TextEdit) (string, error) {
+	type span struct {
+		start, end int
+		text       string
+	}
+	var spans []span
+	for _, e := range edits {
+		start, err := positionOffset(text, e.Range.Start)
+		if err != nil {
+			return "", err
+		}
+		end, err := positionOffset(text, e.Range.End)
+		if err != nil {
+			return "", err
+		}
+		if end < start {
+			return "", fmt.Errorf("edit ends before it starts at line %d", e.Range.Start.Line)
+		}
+		spans = append(spans, span{start, end, e.NewText})
+	}
+	sort.SliceStable(spans, func(i, j int) bool { return spans[i].start < spans[j].start })
+
+	var b strings.Builder
+	last := 0
+	for _, s := range spans {
+		if s.start < last {
+			return "", fmt.Errorf("overlapping edits at offset %d", s.start)
+		}
+		b.WriteString(text[last:s.start])
+		b.WriteString(s.text)
+		last = s.end
+	}
+	b.WriteString(text[last:])
+	return b.String(), nil
+}
+
+// positionOffset converts an LSP position to a byte offset. A position past
+// the end of a line is the end of the line, a line past the end of the
+// document is the end of the document.
+func positionOffset(text string, pos defines.Position) (int, error) {
+	offset := 0
+	for line := uint(0); line < pos.Line; line++ {
+		next := strings.IndexByte(text[offset:], '\n')
+		if next == -1 {
+			if line+1 == pos.Line {
+				return len(text), nil
+			}
+			return 0, fmt.Errorf("line %d is outside of the document", pos.Line)
+		}
+		offset += next + 1
+	}
+
+	units := uint(0)
+	for offset < len(text) && text[offset] != '\n' && units < pos.Character {
+		r, size := utf8.DecodeRuneInString(text[offset:])
+		units += uint(utf16Len(string(r)))
+		offset += size
+	}
+	return offset, nil
+}
+
+/*
+ * checkFix verifies a fix before it is offered.
+ * @param ctx The context of the request
+ * @param state The state of the session
+ * @param uri The document URI
+ * @param text The document content the fix was made for
+ * @param r The fix
+ * @param findings The findings the fix is meant to resolve
+ * @return verification The comparison of the findings before and after
+ * @return error The reason the fix is rejected
+ */
+func (l *lspServer) checkFix(ctx context.Context, state *sessionState, uri string, text string, r *Refactoring, findings []LspDiagnostic) (FixVerification, error) {
+	v, err := l.verifyFix(ctx, state, uri, text, r, findings)
+	if err != nil {
+		return v, fmt.Errorf("the fix can't be applied: %w", err)
+	}
+	rules := l.documentRules(state, uri)
+	if !v.Accepted(rules) {
+		return v, fmt.Errorf("fix for lines %d-%d rejected, %s", r.StartLine, r.EndLine, v.Reason(rules))
+	}
+	if note := v.Note(); note != "" {
+		logs.Printf("[+] Fix for lines %d-%d accepted with %s", r.StartLine, r.EndLine, note)
+	}
+	return v, nil
+}
+
+// showNote shows the risk note of a resolved fix to the user, clients don't
+// show a title changed by codeAction/resolve.
+func (l *lspServer) showNote(ctx context.Context, req *defines.CodeAction, v FixVerification) {
+	if note := v.Note(); note != "" {
+		l.showMessage(ctx, defines.MessageTypeWarning, strings.TrimSuffix(req.Title, " [FuzzLSP]")+": "+note)
+	}
+}
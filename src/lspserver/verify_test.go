@@ -0,0 +1,243 @@
+package lspserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/TobiasYin/go-lsp/lsp/defines"
+)
+
+func edit(startLine, startChar, endLine, endChar uint, text string) defines.TextEdit {
+	return defines.TextEdit{
+		Range: defines.Range{
+			Start: defines.Position{Line: startLine, Character: startChar},
+			End:   defines.Position{Line: endLine, Character: endChar},
+		},
+		NewText: text,
+	}
+}
+
+func TestApplyEdits(t *testing.T) {
+	text := "a := 1\nb := \"😀x\"\nc := 3"
+	tests := []struct {
+		name  string
+		edits []defines.TextEdit
+		want  string
+		err   bool
+	}{
+		{"insert", []defines.TextEdit{edit(1, 0, 1, 0, "// b\n")}, "a := 1\n// b\nb := \"😀x\"\nc := 3", false},
+		{"replace a line", []defines.TextEdit{edit(0, 0, 1, 0, "a := 2\n")}, "a := 2\nb := \"😀x\"\nc := 3", false},
+		{"delete", []defines.TextEdit{edit(1, 0, 2, 0, "")}, "a := 1\nc := 3", false},
+		{"utf-16 characters", []defines.TextEdit{edit(1, 8, 1, 9, "y")}, "a := 1\nb := \"😀y\"\nc := 3", false},
+		{"past the end of a line", []defines.TextEdit{edit(0, 40, 0, 40, ";")}, "a := 1;\nb := \"😀x\"\nc := 3", false},
+		{"append after the last line", []defines.TextEdit{edit(3, 0, 3, 0, "\nd := 4")}, text + "\nd := 4", false},
+		{"edits in any order", []defines.TextEdit{edit(2, 0, 2, 1, "z"), edit(0, 0, 0, 1, "x")}, "x := 1\nb := \"😀x\"\nz := 3", false},
+		{"overlapping", []defines.TextEdit{edit(0, 0, 1, 2, ""), edit(1, 0, 1, 1, "")}, "", true},
+		{"line outside", []defines.TextEdit{edit(5, 0, 5, 0, "x")}, "", true},
+		{"end before start", []defines.TextEdit{edit(1, 0, 0, 0, "x")}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ApplyEdits(text, tt.edits)
+			if (err != nil) != tt.err {
+				t.Fatalf("error = %v, want error %v", err, tt.err)
+			}
+			if err == nil && got != tt.want {
+				t.Errorf("ApplyEdits = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func finding(rule string, line int) LspDiagnostic {
+	return LspDiagnostic{Rule: rule, LineNumber: line}
+}
+
+func TestCompareFindings(t *testing.T) {
+	text := "a\nx = f();\nb\ny = f();"
+	tests := []struct {
+		name       string
+		patched    string
+		targeted   []LspDiagnostic
+		before     []LspDiagnostic
+		after      []LspDiagnostic
+		unchecked  []string
+		counted    []string
+		resolved   int
+		remaining  int
+		introduced int
+		note       string
+	}{
+		{
+			name:     "resolved",
+			patched:  "a\nx = g();\nb\ny = f();",
+			targeted: []LspDiagnostic{finding("R1", 2)},
+			before:   []LspDiagnostic{finding("R1", 2), finding("R1", 4)},
+			after:    []LspDiagnostic{finding("R1", 4)},
+			resolved: 1,
+		},
+		{
+			name:      "reported as often as before",
+			patched:   "a\nx = g();\nb\ny = f();",
+			targeted:  []LspDiagnostic{finding("R1", 2)},
+			before:    []LspDiagnostic{finding("R1", 2)},
+			after:     []LspDiagnostic{finding("R1", 3)},
+			remaining: 1,
+			note:      "risk: 1 of 1 findings remain",
+		},
+		{
+			name:      "still reported on the unchanged line",
+			patched:   "a\nz = 1;\nx = f();\nb\ny = f();",
+			targeted:  []LspDiagnostic{finding("R1", 2), finding("R1", 4)},
+			before:    []LspDiagnostic{finding("R1", 2), finding("R1", 4)},
+			after:     []LspDiagnostic{finding("R1", 3)},
+			resolved:  1,
+			remaining: 1,
+			note:      "risk: 1 of 2 findings remain",
+		},
+		{
+			name:       "introduced",
+			patched:    "a\nx = g();\nb\ny = f(); goto z;",
+			targeted:   []LspDiagnostic{finding("R1", 2)},
+			before:     []LspDiagnostic{finding("R1", 2), finding("R2", 1)},
+			after:      []LspDiagnostic{finding("R2", 1), finding("R2", 4)},
+			resolved:   1,
+			introduced: 1,
+			note:       "risk: 1 new findings: R2",
+		},
+		{
+			name:      "unchecked and counted",
+			patched:   "a\nx = g();\nb\ny = g();",
+			targeted:  []LspDiagnostic{finding("R1", 2), finding("R3", 4)},
+			before:    []LspDiagnostic{finding("R1", 2)},
+			unchecked: []string{"R3"},
+			counted:   []string{"R1"},
+			resolved:  1,
+			note:      "risk: not re-checked: R3; LLM re-check counts findings: R1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := compareFindings(text, tt.patched, tt.targeted, tt.before, tt.after, tt.unchecked, tt.counted)
+			if len(v.Resolved) != tt.resolved || len(v.Remaining) != tt.remaining || len(v.Introduced) != tt.introduced {
+				t.Errorf("resolved %d, remaining %d, introduced %d, want %d, %d, %d",
+					len(v.Resolved), len(v.Remaining), len(v.Introduced), tt.resolved, tt.remaining, tt.introduced)
+			}
+			if got := v.Note(); got != tt.note {
+				t.Errorf("Note = %q, want %q", got, tt.note)
+			}
+		})
+	}
+}
+
+func TestFixVerificationAccepted(t *testing.T) {
+	rules := &RuleSet{byID: make(map[string]ruleRef)}
+	rules.add(&RulePack{
+		Severities: map[string]string{"required": "error", "advisory": "warning"},
+		Rules:      []Rule{{ID: "REQ", Category: "required"}, {ID: "ADV", Category: "advisory"}},
+	})
+	tests := []struct {
+		name string
+		v    FixVerification
+		want bool
+	}{
+		{"resolved", FixVerification{Resolved: []LspDiagnostic{finding("REQ", 1)}}, true},
+		{"unchecked", FixVerification{Unchecked: []LspDiagnostic{finding("REQ", 1)}}, true},
+		{"nothing resolved", FixVerification{Remaining: []LspDiagnostic{finding("REQ", 1)}}, false},
+		{"new advisory finding", FixVerification{Resolved: []LspDiagnostic{finding("REQ", 1)}, Introduced: []LspDiagnostic{finding("ADV", 2)}}, true},
+		{"new required finding", FixVerification{Resolved: []LspDiagnostic{finding("ADV", 1)}, Introduced: []LspDiagnostic{finding("REQ", 2)}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.v.Accepted(rules); got != tt.want {
+				t.Errorf("Accepted = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// regionBackend is the mock backend reporting MISRA-15.5 on every line
+// with an early return, it records the code it analysed.
+type regionBackend struct {
+	LspBackend
+	lock     sync.Mutex
+	analysed []string
+	fail     bool
+}
+
+func (b *regionBackend) AnalyseDocument(ctx context.Context, uri string, document string, profile *LanguageProfile, rules []Rule, progress AnalysisProgress) (string, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.analysed = append(b.analysed, document)
+	if b.fail {
+		return "", errors.New("no model")
+	}
+	var findings []string
+	for i, line := range strings.Split(document, "\n") {
+		if strings.Contains(line, "return early") {
+			findings = append(findings, fmt.Sprintf(`{"line_number": %d, "rule": "MISRA-15.5"}`, i+1))
+		}
+	}
+	if len(findings) == 0 {
+		return "[]", nil
+	}
+	return "[" + strings.Join(findings, ",") + "]", nil
+}
+
+func TestVerifyFix(t *testing.T) {
+	const uri = "file:///src/a.c"
+	text := "int g;\nint f(int x)\n{\n    if (x) {\n        return early;\n    }\n    return 0;\n}\n"
+	original := lineRange(text, 2, 8)
+	profile, _ := ProfileFor("c", uri)
+	targeted := []LspDiagnostic{finding("MISRA-15.5", 5)}
+
+	tests := []struct {
+		name        string
+		replacement string
+		fail        bool
+		resolved    int
+		remaining   int
+		unchecked   int
+		note        string
+	}{
+		{"resolved", "int f(int x)\n{\n    int r = 0;\n    if (x) {\n        r = early;\n    }\n    return r;\n}", false, 1, 0, 0, "risk: LLM re-check counts findings: MISRA-15.5"},
+		{"remaining", "int f(int x)\n{\n    if (x) {\n        /* still */\n        return early;\n    }\n    return 0;\n}", false, 0, 1, 0, "risk: 1 of 1 findings remain; LLM re-check counts findings: MISRA-15.5"},
+		{"re-check failed", "int f(int x)\n{\n    return x ? early : 0;\n}", true, 0, 0, 1, "risk: not re-checked: MISRA-15.5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newTestServer(t)
+			backend := &regionBackend{LspBackend: l.backend, fail: tt.fail}
+			l.backend = backend
+			state := newSessionState()
+
+			r, err := BuildRefactoring(uri, profile, original, 2, "```\n"+tt.replacement+"\n```")
+			if err != nil {
+				t.Fatal(err)
+			}
+			v, err := l.verifyFix(context.Background(), state, uri, text, r, targeted)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(v.Resolved) != tt.resolved || len(v.Remaining) != tt.remaining || len(v.Unchecked) != tt.unchecked {
+				t.Errorf("resolved %d, remaining %d, unchecked %d, want %d, %d, %d",
+					len(v.Resolved), len(v.Remaining), len(v.Unchecked), tt.resolved, tt.remaining, tt.unchecked)
+			}
+			if got := v.Note(); got != tt.note {
+				t.Errorf("Note = %q, want %q", got, tt.note)
+			}
+
+			// the region is analysed before and after the fix with the same scope
+			if tt.fail {
+				return
+			}
+			if len(backend.analysed) != 2 || backend.analysed[0] != r.Original || backend.analysed[1] != r.Replacement {
+				t.Errorf("analysed %q, want the region before and after the fix", backend.analysed)
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package lspserver
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/TobiasYin/go-lsp/jsonrpc"
+	"github.com/TobiasYin/go-lsp/logs"
+)
+
+// parentPollInterval is how often a client process is checked for where the
+// system can't wait for it.
+const parentPollInterval = 2 * time.Second
+
+// processID returns the processId of InitializeParams, null if the client
+// has no process of its own.
+func processID(v interface{}) (int, bool) {
+	switch id := v.(type) {
+	case float64:
+		return int(id), id > 0
+	case int:
+		return id, id > 0
+	case int64:
+		return int(id), id > 0
+	case json.Number:
+		n, err := id.Int64()
+		return int(n), err == nil && n > 0
+	}
+	return 0, false
+}
+
+/*
+ * watchParent ends the session when the client process that started the
+ * server disappears, e.g. when the editor crashed. With stdio the server
+ * shuts down and exits, on a unix socket the session is closed, which
+ * cancels its requests and analyses. Clients of TCP and WebSocket may run
+ * on another machine, their process isn't watched.
+ * @param ctx The context of the initialize request
+ * @param processId The processId of InitializeParams
+ */
+func (l *lspServer) watchParent(ctx context.Context, processId interface{}) {
+	pid, ok := processID(processId)
+	if !ok || !l.watchParents {
+		return
+	}
+	session := jsonrpc.SessionFromContext(ctx)
+	if session == nil {
+		return
+	}
+	if !processAlive(pid) {
+		logs.Printf("Client process %d is not running here, not watching it", pid)
+		return
+	}
+
+	logs.Printf("Watching client process %d", pid)
+	go func() {
+		select {
+		case <-waitProcess(pid, session.Done()):
+		case <-session.Done():
+			return
+		}
+		logs.Printf("Client process %d is gone", pid)
+		if l.stdio {
+			l.exit()
+		}
+		session.Close()
+	}()
+}
@@ -0,0 +1,37 @@
+//go:build unix
+
+package lspserver
+
+import (
+	"errors"
+	"syscall"
+	"time"
+)
+
+// processAlive tells if a process exists, it may belong to another user.
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// waitProcess is closed when the process ended, it is polled until stop is
+// closed.
+func waitProcess(pid int, stop <-chan struct{}) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(parentPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if !processAlive(pid) {
+					close(done)
+					return
+				}
+			}
+		}
+	}()
+	return done
+}
@@ -0,0 +1,47 @@
+//go:build windows
+
+package lspserver
+
+import (
+	"syscall"
+)
+
+// processAlive tells if a process exists and hasn't ended yet.
+func processAlive(pid int) bool {
+	handle, err := syscall.OpenProcess(syscall.SYNCHRONIZE, false, uint32(pid))
+	if err != nil {
+		// a process of another user can't be opened, but exists
+		return err == syscall.ERROR_ACCESS_DENIED
+	}
+	defer syscall.CloseHandle(handle)
+	event, err := syscall.WaitForSingleObject(handle, 0)
+	return err == nil && event == syscall.WAIT_TIMEOUT
+}
+
+// waitProcess is closed when the process ended, it is waited for until stop
+// is closed.
+func waitProcess(pid int, stop <-chan struct{}) <-chan struct{} {
+	done := make(chan struct{})
+	handle, err := syscall.OpenProcess(syscall.SYNCHRONIZE, false, uint32(pid))
+	if err != nil {
+		// the process can't be waited for, treat it as running
+		return done
+	}
+	go func() {
+		defer syscall.CloseHandle(handle)
+		timeout := uint32(parentPollInterval.Milliseconds())
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			event, err := syscall.WaitForSingleObject(handle, timeout)
+			if err != nil || event != syscall.WAIT_TIMEOUT {
+				close(done)
+				return
+			}
+		}
+	}()
+	return done
+}
@@ -1,14 +1,14 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
-	"log"
 	"github.com/TobiasYin/go-lsp/logs"
+	"io"
+	"log"
 	"lspserver/lspserver"
 	"os"
-	"encoding/json"
-	"io"
 	"path/filepath"
 )
 
@@ -16,33 +16,48 @@ var AppName = "lsp-server"
 var version = "unknown"
 
 type Config struct {
-    Stdio       bool   `json:"stdio"`
-    Version     bool   `json:"version"`
-    PromptFile  string `json:"prompt_file"`
-    Backend     string `json:"backend"`
-    ConnectTest bool   `json:"connect_test"`
-	RetryPrompt string `json:"retry_prompt"`
+	Stdio           bool   `json:"stdio"`
+	Version         bool   `json:"version"`
+	PromptFile      string `json:"prompt_file"`
+	Backend         string `json:"backend"`
+	ConnectTest     bool   `json:"connect_test"`
+	RetryPrompt     string `json:"retry_prompt"`
+	PromptDir       string `json:"prompt_dir"`
+	RulePacks       string `json:"rule_packs"`
+	PolicyFile      string `json:"policy_file"`
+	Deviations      string `json:"deviation_register"`
+	Baseline        string `json:"baseline"`
+	Analyzer        string `json:"analyzer"`
+	AnalyzerOut     string `json:"analyzer_output"`
+	NoTriage        bool   `json:"analyzer_no_triage"`
+	Profiles        string `json:"profiles"`
+	ExplainComments bool   `json:"explain_comments"`
+	VerifyFixes     string `json:"verify_fixes"`
+	Listen          string `json:"listen"`
+	WSOrigins       string `json:"ws_origins"`
+	WSToken         string `json:"ws_token"`
+	Trace           string `json:"trace"`
 }
 
 func readConfigFile(filePath string) (*Config, error) {
-    configFile, err := os.Open(filePath)
-    if err != nil {
-        return nil, fmt.Errorf("error opening config file: %w", err)
-    }
-    defer configFile.Close()
-
-    byteValue, err := io.ReadAll(configFile)
-    if err != nil {
-        return nil, fmt.Errorf("error reading config file: %w", err)
-    }
-
-    var config Config
-    err = json.Unmarshal(byteValue, &config)
-    if err != nil {
-        return nil, fmt.Errorf("error unmarshalling config file: %w", err)
-    }
-
-    return &config, nil
+	configFile, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("error opening config file: %w", err)
+	}
+	defer configFile.Close()
+
+	byteValue, err := io.ReadAll(configFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config file: %w", err)
+	}
+
+	var config Config
+	err = json.Unmarshal(byteValue, &config)
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshalling config file: %w", err)
+	}
+
+	return &config, nil
 }
 
 func init() {
@@ -55,32 +70,48 @@ func init() {
 	}()
 
 	// Determine the directory of the executable
-    exePath, err := os.Executable()
-    if err != nil {
-        logs.Printf("Error determining executable path: %v", err)
-    }
-    exeDir := filepath.Dir(exePath)
-
-    // Construct the path to the configuration file
-    configFilePath := filepath.Join(exeDir, "config.json")
-
-    // Read the configuration file
-    config, err := readConfigFile(configFilePath)
-    if err != nil {
-        logs.Printf("Error reading config file: %v", err)
-    }
-
-    _ = flag.Bool("stdio", config.Stdio, "Use stdio for LSP communication")
-    checkVersion = flag.Bool("version", config.Version, "Print version and exit")
-    lspserver.ParamPromptFile = flag.String("prompt-file", config.PromptFile, "prompt file path")
-    lspserver.ParamBackend = flag.String("backend", config.Backend, "backend to use (openai)")
-    lspserver.ParamConnectTest = flag.Bool("connect-test", config.ConnectTest, "test connection to backend")
+	exePath, err := os.Executable()
+	if err != nil {
+		logs.Printf("Error determining executable path: %v", err)
+	}
+	exeDir := filepath.Dir(exePath)
+
+	// Construct the path to the configuration file
+	configFilePath := filepath.Join(exeDir, "config.json")
+
+	// Read the configuration file
+	config, err := readConfigFile(configFilePath)
+	if err != nil {
+		logs.Printf("Error reading config file: %v", err)
+	}
+
+	_ = flag.Bool("stdio", config.Stdio, "Use stdio for LSP communication")
+	lspserver.ParamListen = flag.String("listen", config.Listen, "accept clients on tcp:host:port, unix:/path or ws://host:port/path instead of stdio, e.g. tcp:"+lspserver.DefaultListenAddress)
+	lspserver.ParamWebSocketOrigins = flag.String("ws-origins", config.WSOrigins, "comma separated origins allowed to connect to -listen ws://, * for any (default: the server's own host)")
+	lspserver.ParamWebSocketToken = flag.String("ws-token", config.WSToken, "token WebSocket clients must send as ?token= or bearer Authorization header")
+	lspserver.ParamTraceFile = flag.String("trace", config.Trace, "append every LSP message with a timestamp to this JSONL file, see: replay trace.jsonl")
+	checkVersion = flag.Bool("version", config.Version, "Print version and exit")
+	lspserver.ParamPromptFile = flag.String("prompt-file", config.PromptFile, "prompt file path")
+	lspserver.ParamBackend = flag.String("backend", config.Backend, "backend to use (ollama, openai or mock)")
+	lspserver.ParamConnectTest = flag.Bool("connect-test", config.ConnectTest, "test connection to backend")
 	lspserver.ParamRetryPromptFile = flag.String("retry-prompt", config.RetryPrompt, "Retry Prompt File")
-	
+	lspserver.ParamRulePacks = flag.String("rule-packs", config.RulePacks, "comma separated rule packs (built-in names or files), default: the packs of the document's language profile")
+	lspserver.ParamPolicyFile = flag.String("policy", config.PolicyFile, "workspace policy file (default: <workspace>/.fuzzlsp/policy.json)")
+	lspserver.ParamDeviationRegister = flag.String("deviation-register", config.Deviations, "write the register of active deviations to this JSON file")
+	lspserver.ParamBaselineFile = flag.String("baseline", config.Baseline, "baseline of accepted findings (default: <workspace>/"+lspserver.DefaultBaselineFile+")")
+	lspserver.ParamAnalyzerCommand = flag.String("analyzer", config.Analyzer, "static analyzer command run on open/save, {file} is replaced with the document path (e.g. \"cppcheck --xml {file}\")")
+	lspserver.ParamAnalyzerOutput = flag.String("analyzer-output", config.AnalyzerOut, "read analyzer findings from this cppcheck XML, SARIF or clang-tidy report instead of running -analyzer")
+	lspserver.ParamAnalyzerNoTriage = flag.Bool("analyzer-no-triage", config.NoTriage, "report analyzer findings without asking the backend to triage them")
+	lspserver.ParamExplainComments = flag.Bool("explain-comments", config.ExplainComments, "offer a code action that inserts the LLM explanation as a comment above the line")
+	lspserver.ParamVerifyFixes = flag.String("verify-fixes", config.VerifyFixes, "re-check LLM fixes before offering them: full (built-in checks and LLM, default), static or off")
+	lspserver.ParamProfilesFile = flag.String("profiles", config.Profiles, "JSON file with additional or replacement language profiles")
+	lspserver.ParamPromptDir = flag.String("prompt-dir", config.PromptDir, "directory with prompt template overrides and include fragments")
+
 	flag.Parse()
 
-	if *lspserver.ParamBackend != "ollama" && *lspserver.ParamBackend != "openai" {
-		fmt.Println("valid backends: ollama, openai")
+	replay := flag.Arg(0) == "replay"
+	if !replay && *lspserver.ParamBackend != "ollama" && *lspserver.ParamBackend != "openai" && *lspserver.ParamBackend != "mock" {
+		fmt.Println("valid backends: ollama, openai, mock")
 		os.Exit(1)
 	}
 
@@ -113,5 +144,15 @@ func init() {
 
 func main() {
 	logs.Printf("%s (build %s)\n", AppName, version)
+	if flag.Arg(0) == "replay" {
+		if flag.NArg() != 2 {
+			fmt.Printf("usage: %s [flags] replay trace.jsonl\n", filepath.Base(os.Args[0]))
+			os.Exit(2)
+		}
+		if lspserver.Replay(AppName, flag.Arg(1)) != 0 {
+			os.Exit(1)
+		}
+		return
+	}
 	lspserver.Serve(AppName)
 }
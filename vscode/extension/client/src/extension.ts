@@ -382,7 +382,9 @@ function startLSP(context: vscode.ExtensionContext){
             { scheme: 'file', language: 'c' },
             { scheme: 'file', language: 'cpp' },
             { scheme: 'file', language: 'hpp' },
-            { scheme: 'file', language: 'python' }
+            { scheme: 'file', language: 'python' },
+            { scheme: 'file', language: 'rust' },
+            { scheme: 'file', language: 'go' }
         ],
         synchronize: {
             // Notify the server about file changes to '.clientrc files contained in the workspace
@@ -403,17 +405,7 @@ function startLSP(context: vscode.ExtensionContext){
 
     // Listen for the server notification for generated code suggestions
     client.onNotification('window/showGeneratedCode', (params) => handleGeneratedCodeSuggestion(params, context));
-    client.onNotification('analysisStarted', (params) => handleSpinner(params, context));
-    client.onNotification('analysisDone', (params) => handleSpinner(params, context));
-}
-
-function handleSpinner(params: any, context: ExtensionContext){
-    if (params == "AnalysisStarted"){
-        startSpinner("FuzzLSP Analysis");
-    }
-    else if (params == "AnalysisDone") {
-        stopSpinner("FuzzLSP");
-    }
+    // Analysis progress arrives as standard $/progress, shown by the client itself
 }
 
 function restartLSP(context: vscode.ExtensionContext) {